@@ -30,6 +30,9 @@ var siteRouter, appRouter = createRouters()
 const (
 	companyCtxKey = iota
 	userCtxKey
+	csrfCtxKey
+	sessionCtxKey
+	apiTokenCtxKey
 )
 
 const (
@@ -45,9 +48,14 @@ func createRouters() (*httprouter.Router, *httprouter.Router) {
 		config.Secret.Authentication,
 		config.Secret.Encryption,
 	)
-	site := negroni.New(negroni.Wrap(siteRouter))
+	site := negroni.New(
+		sessions.Sessions("__", store),
+		negroni.HandlerFunc(CSRF),
+		negroni.Wrap(siteRouter),
+	)
 	app := negroni.New(
 		sessions.Sessions("__", store),
+		negroni.HandlerFunc(CSRF),
 		negroni.HandlerFunc(Subdomain(siteRouter)),
 		negroni.HandlerFunc(Auth),
 		negroni.HandlerFunc(Access),
@@ -77,6 +85,12 @@ func createRenderer() *render.Render {
 		"routeSub": func(name Route, subdomain string, params ...string) string {
 			return ReverseRoute(name).Subdomain(subdomain).Params(params...).Build()
 		},
+
+		"csrfField": csrfField,
+
+		"csrfToken": func() string {
+			return csrfPlaceholder
+		},
 	}
 
 	return render.New(render.Options{
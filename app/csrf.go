@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/goincremental/negroni-sessions"
+	"github.com/gorilla/context"
+)
+
+const (
+	csrfSessionKey = "csrf"
+	csrfHeader     = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+)
+
+var (
+	// csrfExemptPaths are the state-changing routes that are called
+	// by third parties rather than by our own pages.  OAuth callbacks
+	// are GET requests so they're never checked.
+	csrfExemptPaths = []string{
+		"/api/bt-webhooks",
+		"/sso/saml/acs",
+	}
+
+	// csrfPlaceholder is rendered into templates in place of the
+	// current session's token since templates are shared between
+	// requests.  CSRF replaces it before the response is written.
+	csrfPlaceholder = "csrf-placeholder-" + newCSRFToken()
+)
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// csrfToken returns the current session's CSRF token.
+func csrfToken(req *http.Request) string {
+	token, _ := context.Get(req, csrfCtxKey).(string)
+	return token
+}
+
+// csrfField renders a hidden form field for the current token.  It's
+// used by the _fields/csrf partial.
+func csrfField() template.HTML {
+	return template.HTML(`<input type="hidden" name="` + csrfFormField + `" value="` + csrfPlaceholder + `" />`)
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	return false
+}
+
+// submittedCSRFToken looks for the token in the request header, then
+// in url-encoded form bodies and finally in the query string.
+// Multipart bodies are never parsed here since blobstore uploads
+// need to read them themselves; the upload URL carries the token in
+// its query string instead.
+func submittedCSRFToken(req *http.Request) string {
+	if token := req.Header.Get(csrfHeader); token != "" {
+		return token
+	}
+
+	if strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		if token := req.PostFormValue(csrfFormField); token != "" {
+			return token
+		}
+	}
+
+	return req.URL.Query().Get(csrfFormField)
+}
+
+// csrfResponseWriter substitutes the real token for csrfPlaceholder
+// in HTML responses.
+type csrfResponseWriter struct {
+	http.ResponseWriter
+	placeholder []byte
+	token       []byte
+}
+
+func (w *csrfResponseWriter) Write(b []byte) (int, error) {
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		return w.ResponseWriter.Write(b)
+	}
+
+	if _, err := w.ResponseWriter.Write(bytes.Replace(b, w.placeholder, w.token, -1)); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+// CSRF ensures that state-changing requests carry the session's CSRF
+// token.  Every session is issued a token the first time it's seen.
+func CSRF(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	session := sessions.GetSession(req)
+	token, _ := session.Get(csrfSessionKey).(string)
+	if token == "" {
+		token = newCSRFToken()
+		session.Set(csrfSessionKey, token)
+	}
+
+	// Browsers never attach Authorization headers on their own, so
+	// requests that carry a bearer token can't be forged.  Auth
+	// ignores the session cookie for those requests.
+	_, isTokenRequest := bearerToken(req)
+	if !isSafeMethod(req.Method) && !isTokenRequest && !isSubpath(req.URL.Path, csrfExemptPaths) {
+		submitted := submittedCSRFToken(req)
+		if subtle.ConstantTimeCompare([]byte(submitted), []byte(token)) != 1 {
+			http.Error(res, "invalid csrf token", http.StatusForbidden)
+			return
+		}
+	}
+
+	context.Set(req, csrfCtxKey, token)
+	defer context.Clear(req)
+
+	next(&csrfResponseWriter{
+		ResponseWriter: res,
+		placeholder:    []byte(csrfPlaceholder),
+		token:          []byte(token),
+	}, req)
+}
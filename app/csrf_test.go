@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/codegangsta/negroni"
+	"github.com/goincremental/negroni-sessions"
+	"github.com/goincremental/negroni-sessions/cookiestore"
+)
+
+func TestCSRF(t *testing.T) {
+	t.Parallel()
+
+	var token string
+	n := negroni.New(
+		sessions.Sessions("__", cookiestore.New([]byte("secret"))),
+		negroni.HandlerFunc(CSRF),
+		negroni.Wrap(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			token = csrfToken(req)
+			res.Header().Set("Content-Type", "text/html")
+			res.Write([]byte(string(csrfField())))
+		})),
+	)
+
+	serve := func(method, path, cookie string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, nil)
+		req.Header.Set("Cookie", cookie)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+
+		res := httptest.NewRecorder()
+		n.ServeHTTP(res, req)
+		return res
+	}
+
+	res := serve("GET", "/", "", nil)
+	if res.Code != http.StatusOK || token == "" {
+		t.Fatalf("expected GET to issue a token")
+	}
+
+	if strings.Contains(res.Body.String(), csrfPlaceholder) || !strings.Contains(res.Body.String(), token) {
+		t.Errorf("expected placeholder to be replaced with the token: %q", res.Body.String())
+	}
+
+	cookie := strings.SplitN(res.Header().Get("Set-Cookie"), ";", 2)[0]
+	cases := []struct {
+		method   string
+		path     string
+		headers  map[string]string
+		expected int
+	}{
+		{"POST", "/api/profile", nil, http.StatusForbidden},
+		{"DELETE", "/api/users/a@example.com", map[string]string{csrfHeader: "bad"}, http.StatusForbidden},
+		{"POST", "/api/profile", map[string]string{csrfHeader: token}, http.StatusOK},
+		{"POST", "/api/upload?" + csrfFormField + "=" + token, nil, http.StatusOK},
+		{"POST", "/api/bt-webhooks", nil, http.StatusOK},
+		{"POST", "/api/invites", map[string]string{"Authorization": "Bearer tz_token"}, http.StatusOK},
+		{"HEAD", "/", nil, http.StatusOK},
+	}
+
+	for _, test := range cases {
+		if res := serve(test.method, test.path, cookie, test.headers); res.Code != test.expected {
+			t.Errorf("expected %s %s to return %d, got %d", test.method, test.path, test.expected, res.Code)
+		}
+	}
+
+	if res := serve("POST", "/api/profile", "", map[string]string{csrfHeader: token}); res.Code != http.StatusForbidden {
+		t.Errorf("expected token from another session to be rejected")
+	}
+}
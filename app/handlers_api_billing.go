@@ -18,37 +18,37 @@ func init() {
 	GET(
 		appRouter,
 		"billing-get-subscription", "/api/billing/subscriptions/current",
-		currentSubscriptionHandler, models.RoleMain,
+		currentSubscriptionHandler, models.RoleMain, models.RoleBilling,
 	)
 	DELETE(
 		appRouter,
 		"billing-delete-subscription", "/api/billing/subscriptions/current",
-		cancelSubscriptionHandler, models.RoleMain,
+		cancelSubscriptionHandler, models.RoleMain, models.RoleBilling,
 	)
 	POST(
 		appRouter,
 		"billing-update-vat-id", "/api/billing/vat-id",
-		updateVATIDHandler, models.RoleMain,
+		updateVATIDHandler, models.RoleMain, models.RoleBilling,
 	)
 	POST(
 		appRouter,
 		"billing-update-plan", "/api/billing/plans",
-		updatePlanHandler, models.RoleMain,
+		updatePlanHandler, models.RoleMain, models.RoleBilling,
 	)
 	GET(
 		appRouter,
 		"billing-invoices", "/api/billing/invoices",
-		invoiceListHandler, models.RoleMain,
+		invoiceListHandler, models.RoleMain, models.RoleBilling,
 	)
 	GET(
 		appRouter,
 		"billing-invoice", "/api/billing/invoices/:id",
-		invoiceHandler, models.RoleMain,
+		invoiceHandler, models.RoleMain, models.RoleBilling,
 	)
 	GET(
 		appRouter,
 		"billing-receipt", "/receipts/:id",
-		receiptHandler, models.RoleMain,
+		receiptHandler, models.RoleMain, models.RoleBilling,
 	)
 }
 
@@ -99,6 +99,7 @@ func cancelSubscriptionHandler(res http.ResponseWriter, req *http.Request, _ htt
 		return
 	}
 
+	planID := company.SubscriptionPlanID
 	err = company.CancelSubscription(ctx, sub)
 	if err != nil {
 		log.Errorf(ctx, "failed to cancel subscription: %v", err)
@@ -106,6 +107,8 @@ func cancelSubscriptionHandler(res http.ResponseWriter, req *http.Request, _ htt
 		return
 	}
 
+	audit(req, models.AuditSubscriptionCanceled, planID, nil, nil)
+
 	res.WriteHeader(http.StatusOK)
 }
 
@@ -126,6 +129,7 @@ func updateVATIDHandler(res http.ResponseWriter, req *http.Request, _ httprouter
 	}
 
 	company := context.Get(req, companyCtxKey).(*models.Company)
+	previousVATID := company.SubscriptionVATID
 	company.SubscriptionVATID = data.VATID
 	company.Put(ctx)
 
@@ -136,6 +140,8 @@ func updateVATIDHandler(res http.ResponseWriter, req *http.Request, _ httprouter
 		return
 	}
 
+	audit(req, models.AuditVATIDChanged, company.Subdomain, previousVATID, data.VATID)
+
 	res.WriteHeader(http.StatusOK)
 }
 
@@ -152,6 +158,7 @@ func updatePlanHandler(res http.ResponseWriter, req *http.Request, _ httprouter.
 	var err error
 	ctx := appengine.NewContext(req)
 	company := context.Get(req, companyCtxKey).(*models.Company)
+	previousPlanID := company.SubscriptionPlanID
 	if company.SubscriptionStatus == braintree.SubscriptionStatusCanceled {
 		_, err = company.Resubscribe(ctx, data.PlanID)
 	} else {
@@ -164,6 +171,8 @@ func updatePlanHandler(res http.ResponseWriter, req *http.Request, _ httprouter.
 		return
 	}
 
+	audit(req, models.AuditPlanChanged, company.Subdomain, previousPlanID, data.PlanID)
+
 	res.WriteHeader(http.StatusOK)
 }
 
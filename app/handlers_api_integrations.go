@@ -20,12 +20,12 @@ func init() {
 	POST(
 		appRouter,
 		"integrations-refresh", "/api/integrations/refresh",
-		refreshIntegrationHandler,
+		refreshIntegrationHandler, Everyone,
 	)
 	POST(
 		appRouter,
 		"integrations-disconnect", "/api/integrations/disconnect",
-		disconnectIntegrationHandler,
+		disconnectIntegrationHandler, Everyone,
 	)
 	GET(
 		appRouter,
@@ -35,7 +35,7 @@ func init() {
 	POST(
 		appRouter,
 		"integrations-calendar-schedule", "/api/integrations/gcalendar/meetings",
-		scheduleMeetingHandler,
+		scheduleMeetingHandler, Everyone,
 	)
 	GET(
 		appRouter,
@@ -50,12 +50,12 @@ func init() {
 	DELETE(
 		appRouter,
 		"integrations-calendar-cancel-meeting", "/api/integrations/gcalendar/meetings/:id",
-		cancelMeetingHandler,
+		cancelMeetingHandler, Everyone,
 	)
 	PATCH(
 		appRouter,
 		"integrations-calendar-set-default", "/api/integrations/gcalendar/meetings",
-		setDefaultCalendarHandler,
+		setDefaultCalendarHandler, Everyone,
 	)
 }
 
@@ -129,6 +129,7 @@ func disconnectIntegrationHandler(res http.ResponseWriter, req *http.Request, _
 		nds.Delete(ctx, user.GCalendarToken)
 		user.GCalendarToken = nil
 		user.Put(ctx)
+		audit(req, models.AuditIntegrationDisconnect, data.Integration, nil, nil)
 		res.WriteHeader(http.StatusNoContent)
 		return
 	default:
@@ -173,6 +174,25 @@ func scheduleMeetingHandler(res http.ResponseWriter, req *http.Request, _ httpro
 	ctx := appengine.NewContext(req)
 	company := context.Get(req, companyCtxKey).(*models.Company)
 	user := context.Get(req, userCtxKey).(*models.User)
+
+	// Meetings with a Group invite all of its active members along
+	// with anyone that was picked explicitly.
+	if meeting.Group != 0 {
+		group, ok := getGroup(res, req, strconv.FormatInt(meeting.Group, 10))
+		if !ok {
+			return
+		}
+
+		users, err := models.GetActiveUsers(ctx, company.Key(ctx))
+		if err != nil {
+			log.Errorf(ctx, "failed to list users: %v", err)
+			serverError(res)
+			return
+		}
+
+		meeting.Attendees = groupAttendees(meeting.Attendees, groupMembers(users, group), user)
+	}
+
 	k := models.NewMeetingKey(ctx, user.Key(ctx))
 	k, err := nds.Put(ctx, k, meeting)
 	if err != nil {
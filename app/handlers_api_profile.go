@@ -3,6 +3,7 @@ package handlers
 import (
 	"fmt"
 	"net/http"
+	"strings"
 	"teamzones/forms"
 	"teamzones/integrations"
 	"teamzones/models"
@@ -24,17 +25,22 @@ func init() {
 	POST(
 		appRouter,
 		"profile-update", "/api/profile",
-		updateProfileHandler,
+		updateProfileHandler, Everyone,
+	)
+	POST(
+		appRouter,
+		"profile-details-update", "/api/profile/details",
+		updateProfileDetailsHandler, Everyone,
 	)
 	ALL(
 		appRouter,
 		"avatar-upload", "/api/upload",
-		avatarUploadHandler,
+		avatarUploadHandler, Everyone,
 	)
 	DELETE(
 		appRouter,
 		"avatar-delete", "/api/avatar",
-		deleteAvatarHandler,
+		deleteAvatarHandler, Everyone,
 	)
 }
 
@@ -102,6 +108,7 @@ func updateProfileHandler(res http.ResponseWriter, req *http.Request, _ httprout
 	ctx := appengine.NewContext(req)
 	user := context.Get(req, userCtxKey).(*models.User)
 	user.FirstName = data.FirstName
+	user.LastName = data.LastName
 	user.Timezone = data.Timezone
 	user.Workdays = data.Workdays
 	user.Put(ctx)
@@ -109,6 +116,58 @@ func updateProfileHandler(res http.ResponseWriter, req *http.Request, _ httprout
 	res.WriteHeader(http.StatusNoContent)
 }
 
+// updateProfileDetailsHandler updates the optional parts of the
+// current User's profile, including their values for the Company's
+// ProfileFields.  These are kept separate from the rest of the
+// profile so that clients that don't know about them can't wipe them.
+func updateProfileDetailsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		JobTitle     string                    `json:"jobTitle" validate:"MaxLength:100"`
+		Department   string                    `json:"department" validate:"MaxLength:100"`
+		Phone        string                    `json:"phone" validate:"Phone"`
+		City         string                    `json:"city" validate:"MaxLength:100"`
+		Pronouns     string                    `json:"pronouns" validate:"MaxLength:30"`
+		Bio          string                    `json:"bio" validate:"MaxLength:500"`
+		CustomFields []models.CustomFieldValue `json:"customFields"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	fields, err := models.GetProfileFields(ctx, company.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list profile fields: %v", err)
+		serverError(res)
+		return
+	}
+
+	customFields, err := models.ValidateCustomFields(fields, data.CustomFields)
+	if err != nil {
+		badRequest(res, "CustomFields: "+err.Error())
+		return
+	}
+
+	user := context.Get(req, userCtxKey).(*models.User)
+	user.JobTitle = strings.TrimSpace(data.JobTitle)
+	user.Department = strings.TrimSpace(data.Department)
+	user.Phone = strings.TrimSpace(data.Phone)
+	user.City = strings.TrimSpace(data.City)
+	user.Pronouns = strings.TrimSpace(data.Pronouns)
+	user.Bio = strings.TrimSpace(data.Bio)
+	user.CustomFields = customFields
+	if _, err := user.Put(ctx); err != nil {
+		log.Errorf(ctx, "failed to update profile details: %v", err)
+		serverError(res)
+		return
+	}
+
+	renderer.JSON(res, http.StatusOK, user)
+}
+
 func avatarUploadHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
 	ctx := appengine.NewContext(req)
 
@@ -161,7 +220,9 @@ func avatarUploadHandler(res http.ResponseWriter, req *http.Request, _ httproute
 		return
 	}
 
-	location := ReverseSimple("avatar-upload")
+	// Blobstore forwards the upload to this path so the CSRF token
+	// has to travel in the query string.
+	location := ReverseRoute("avatar-upload").Query(csrfFormField, csrfToken(req)).Build()
 	uri, err := blobstore.UploadURL(ctx, location, &blobstore.UploadURLOptions{
 		MaxUploadBytesPerBlob: 1024 * 1024 * 8,
 
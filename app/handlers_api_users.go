@@ -1,20 +1,17 @@
 package handlers
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
-	"strconv"
+	"strings"
 	"teamzones/forms"
 	"teamzones/models"
-	"time"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/memcache"
 
 	"github.com/gorilla/context"
-	"github.com/qedus/nds"
 
 	"gopkg.in/julienschmidt/httprouter.v1"
 )
@@ -30,30 +27,101 @@ func init() {
 		"invites-send", "/api/invites",
 		sendInviteHandler, models.RoleMain, models.RoleManager,
 	)
+	DELETE(
+		appRouter,
+		"users-deactivate", "/api/users/:email",
+		deactivateUserHandler, models.RoleMain, models.RoleManager,
+	)
+	GET(
+		appRouter,
+		"users-deactivated", "/api/deactivated-users",
+		deactivatedUsersHandler, models.RoleMain, models.RoleManager,
+	)
 	POST(
 		appRouter,
-		"invites-create-bulk", "/api/bulk-invites",
-		createBulkInviteHandler, models.RoleMain, models.RoleManager,
+		"users-reactivate", "/api/users/:email/reactivate",
+		reactivateUserHandler, models.RoleMain, models.RoleManager,
 	)
-	DELETE(
+	POST(
 		appRouter,
-		"users-delete", "/api/users/:email",
-		deleteUserHandler,
+		"users-purge", "/api/users/:email/purge",
+		purgeUserHandler, models.RoleMain,
+	)
+	POST(
+		appRouter,
+		"roles-update", "/api/roles",
+		updateRoleHandler, models.RoleMain,
+	)
+	POST(
+		appRouter,
+		"ownership-transfer", "/api/ownership",
+		transferOwnershipHandler, models.RoleMain,
 	)
 }
 
-func sendInviteHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	var data struct {
-		FirstName string `json:"firstName" validate:"MinLength:3,MaxLength:50"`
-		LastName  string `json:"lastName" validate:"MinLength:3,MaxLength:50"`
-		Email     string `json:"email" validate:"Email"`
+// inviteData is the information needed to invite a single person.
+// It's shared by individual and CSV invites so that both are held to
+// the same rules.
+type inviteData struct {
+	FirstName string `json:"firstName" validate:"MinLength:3,MaxLength:50"`
+	LastName  string `json:"lastName" validate:"MinLength:3,MaxLength:50"`
+	Email     string `json:"email" validate:"Email"`
+
+	// AllowOtherEmail lets the invitee sign up with a
+	// different address.
+	AllowOtherEmail bool `json:"allowOtherEmail"`
+
+	Role     string `json:"role"`
+	Timezone string `json:"timezone" validate:"Timezone"`
+
+	// Groups are the ids of the Groups that the invitee is added
+	// to when they sign up.
+	Groups []int64 `json:"groups"`
+}
+
+// apply copies the details of an invitation onto invite.
+func (data inviteData) apply(invite *models.Invite, invitedBy string) {
+	invite.FirstName = data.FirstName
+	invite.LastName = data.LastName
+	invite.AllowOtherEmail = data.AllowOtherEmail
+	invite.InvitedBy = invitedBy
+	invite.Role = data.Role
+	invite.Timezone = data.Timezone
+	invite.Groups = data.Groups
+}
+
+// checkInviteRole ensures that user may grant role to an invitee.
+// Only the owner may invite people with elevated roles, same as
+// changing roles after the fact.
+func checkInviteRole(user *models.User, role string) error {
+	if role == "" || role == models.RoleUser {
+		return nil
+	}
+
+	if !models.IsAssignableRole(role) {
+		return models.ErrInvalidRole
+	}
+
+	if user.Role != models.RoleMain {
+		return errors.New("Only the owner can invite people with this role.")
 	}
 
+	return nil
+}
+
+func sendInviteHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data inviteData
 	if err := forms.BindJSON(req, &data); err != nil {
 		badRequest(res, err.Error())
 		return
 	}
 
+	user := context.Get(req, userCtxKey).(*models.User)
+	if err := checkInviteRole(user, data.Role); err != nil {
+		badRequest(res, "Role: "+err.Error())
+		return
+	}
+
 	ctx := appengine.NewContext(req)
 	company := context.Get(req, companyCtxKey).(*models.Company)
 	if company.SeatsLeft(ctx) <= 0 {
@@ -61,19 +129,93 @@ func sendInviteHandler(res http.ResponseWriter, req *http.Request, _ httprouter.
 		return
 	}
 
-	inviteUser.Call(ctx, company.Key(ctx), data.FirstName, data.LastName, data.Email)
+	for _, id := range data.Groups {
+		if _, err := models.GetGroup(ctx, company.Key(ctx), id); err == datastore.ErrNoSuchEntity {
+			badRequest(res, "Groups: This group doesn't exist.")
+			return
+		} else if err != nil {
+			log.Errorf(ctx, "failed to get group: %v", err)
+			serverError(res)
+			return
+		}
+	}
+
+	inviteUser.Call(ctx, company.Key(ctx), data, user.Email)
+	audit(req, models.AuditInviteSent, data.Email, nil, data)
 	res.WriteHeader(http.StatusCreated)
 }
 
-type bulkInviteResponse struct {
-	URI string  `json:"uri"`
-	TTL float64 `json:"ttl"`
+// deactivateUserHandler deactivates a member, freeing up their seat
+// and signing them out everywhere.  Their upcoming meetings are kept
+// unless reassignTo names another member to hand them over to.
+func deactivateUserHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	user := context.Get(req, userCtxKey).(*models.User)
+	email := params.ByName("email")
+	if strings.EqualFold(user.Email, email) {
+		forbidden(res)
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	previous, err := models.GetUser(ctx, company.Key(ctx), email)
+	if err != nil {
+		notFound(res)
+		return
+	}
+
+	var reassignTo *models.User
+	if to := req.FormValue("reassignTo"); to != "" {
+		reassignTo, err = models.GetUser(ctx, company.Key(ctx), to)
+		if err != nil || reassignTo.Deactivated || strings.EqualFold(reassignTo.Email, previous.Email) {
+			badRequest(res, "Meetings can only be reassigned to another active member.")
+			return
+		}
+	}
+
+	deactivated, err := models.DeactivateUser(ctx, previous.Key(ctx), user.Email)
+	switch err {
+	case nil:
+	case models.ErrLastOwner, models.ErrUserDeactivated:
+		badRequest(res, err.Error())
+		return
+	default:
+		log.Errorf(ctx, "failed to deactivate user: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditUserDeactivated, deactivated.Email, previous, deactivated)
+
+	if err := models.RevokeSessions(ctx, deactivated.Key(ctx)); err != nil {
+		log.Errorf(ctx, "failed to revoke sessions: %v", err)
+	}
+
+	if err := models.RevokeAPITokens(ctx, deactivated.Key(ctx)); err != nil {
+		log.Errorf(ctx, "failed to revoke api tokens: %v", err)
+	}
+
+	if reassignTo != nil {
+		reassignMeetings.Call(ctx, deactivated.Key(ctx), reassignTo.Key(ctx))
+	}
+
+	res.WriteHeader(http.StatusNoContent)
 }
 
-func createBulkInviteHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	var inviteIDStr string
-	var invite *models.Invite
+func deactivatedUsersHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	users := []models.User{}
+	if _, err := models.FindDeactivatedUsers(company.Key(ctx)).GetAll(ctx, &users); err != nil {
+		log.Errorf(ctx, "failed to list deactivated users: %v", err)
+		serverError(res)
+		return
+	}
 
+	renderer.JSON(res, http.StatusOK, users)
+}
+
+func reactivateUserHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
 	ctx := appengine.NewContext(req)
 	company := context.Get(req, companyCtxKey).(*models.Company)
 	if company.SeatsLeft(ctx) <= 0 {
@@ -81,62 +223,124 @@ func createBulkInviteHandler(res http.ResponseWriter, req *http.Request, _ httpr
 		return
 	}
 
-	companyKey := company.Key(ctx)
-	cacheKey := fmt.Sprintf("bulk-invites:%d", companyKey.IntID())
-	inviteData, err := memcache.Get(ctx, cacheKey)
-	if err == nil {
-		inviteIDStr = string(inviteData.Value)
-		inviteID, _ := strconv.ParseInt(inviteIDStr, 10, 64)
-		invite, _ = models.GetInvite(ctx, companyKey, inviteID)
-	} else {
-		var key *datastore.Key
+	userKey := models.NewUserKey(ctx, company.Key(ctx), params.ByName("email"))
+	user, err := models.ReactivateUser(ctx, userKey)
+	switch err {
+	case nil:
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	case models.ErrUserActive:
+		badRequest(res, err.Error())
+		return
+	default:
+		log.Errorf(ctx, "failed to reactivate user: %v", err)
+		serverError(res)
+		return
+	}
 
-		key, invite, err = models.CreateBulkInvite(ctx, companyKey)
-		if err != nil {
-			log.Errorf(ctx, "failed to create invite: %v", err)
-			serverError(res)
-			return
-		}
+	audit(req, models.AuditUserReactivated, user.Email, nil, user)
+	notifyMemberAdded.Call(ctx, company.Key(ctx), userKey)
+	renderer.JSON(res, http.StatusOK, user)
+}
 
-		inviteIDStr = strconv.FormatInt(key.IntID(), 10)
-		memcache.Set(ctx, &memcache.Item{
-			Key:        cacheKey,
-			Value:      []byte(inviteIDStr),
-			Expiration: models.BulkInviteTTL - 600,
-		})
+// purgeUserHandler permanently deletes a deactivated member and
+// everything they own in the background.
+func purgeUserHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	user, err := models.GetUser(ctx, company.Key(ctx), params.ByName("email"))
+	if err != nil {
+		notFound(res)
+		return
 	}
 
-	location := ReverseRoute("team-sign-up").
-		Param("invite", inviteIDStr).
-		Subdomain(company.Subdomain).
-		Build()
+	if !user.Deactivated {
+		badRequest(res, models.ErrUserActive.Error())
+		return
+	}
 
-	renderer.JSON(res, http.StatusCreated, bulkInviteResponse{
-		URI: location,
-		TTL: invite.CreatedAt.Add(models.BulkInviteTTL).Sub(time.Now()).Seconds(),
-	})
+	purgeUser.Call(ctx, user.Key(ctx))
+	audit(req, models.AuditUserDeleted, user.Email, user, nil)
+	res.WriteHeader(http.StatusAccepted)
 }
 
-func deleteUserHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	user := context.Get(req, userCtxKey).(*models.User)
-	email := params.ByName("email")
-	if user.Role == models.RoleUser || user.Email == email {
-		forbidden(res)
+func updateRoleHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		Email string `json:"email" validate:"Email"`
+		Role  string `json:"role"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
 		return
 	}
 
 	ctx := appengine.NewContext(req)
 	company := context.Get(req, companyCtxKey).(*models.Company)
-	user, err := models.GetUser(ctx, company.Key(ctx), email)
-	if err != nil || user.Role == models.RoleMain {
+	userKey := models.NewUserKey(ctx, company.Key(ctx), data.Email)
+	previous, err := models.GetUser(ctx, company.Key(ctx), data.Email)
+	if err != nil {
 		notFound(res)
 		return
 	}
 
-	if err := nds.Delete(ctx, user.Key(ctx)); err != nil {
+	user, err := models.SetRole(ctx, userKey, data.Role)
+	switch err {
+	case nil:
+	case models.ErrInvalidRole, models.ErrLastOwner:
+		badRequest(res, err.Error())
+		return
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	default:
+		log.Errorf(ctx, "failed to update role: %v", err)
 		serverError(res)
 		return
 	}
 
-	res.WriteHeader(http.StatusNoContent)
+	audit(req, models.AuditRoleChanged, user.Email, previous.Role, user.Role)
+	renderer.JSON(res, http.StatusOK, user)
+}
+
+func transferOwnershipHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		Email string `json:"email" validate:"Email"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	user := context.Get(req, userCtxKey).(*models.User)
+	if strings.ToLower(data.Email) == strings.ToLower(user.Email) {
+		badRequest(res, "You already own this team.")
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	toKey := models.NewUserKey(ctx, company.Key(ctx), data.Email)
+	_, owner, err := models.TransferOwnership(ctx, user.Key(ctx), toKey)
+	switch err {
+	case nil:
+	case models.ErrNotOwner:
+		forbidden(res)
+		return
+	case models.ErrInvalidOwner:
+		badRequest(res, err.Error())
+		return
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	default:
+		log.Errorf(ctx, "failed to transfer ownership: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditOwnershipTransferred, owner.Email, user.Email, owner.Email)
+	res.WriteHeader(http.StatusOK)
 }
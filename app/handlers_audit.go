@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"teamzones/models"
+	"time"
+
+	"github.com/gorilla/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+const (
+	auditPageSize    = 50
+	auditMaxPageSize = 200
+)
+
+func init() {
+	GET(
+		appRouter,
+		"audit-events", "/api/audit-events",
+		auditEventsHandler, models.RoleMain,
+	)
+	GET(
+		appRouter,
+		"audit-events-export", "/api/audit-events/export",
+		exportAuditEventsHandler, models.RoleMain,
+	)
+}
+
+// audit records an action taken by the current User.  Failing to
+// record an event is logged rather than surfaced since the action
+// itself has already happened by the time this is called.
+func audit(req *http.Request, action, target string, before, after interface{}) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	actor, _ := context.Get(req, userCtxKey).(*models.User)
+	_, err := models.RecordAuditEvent(
+		ctx, company.Key(ctx), actor,
+		action, target, clientIP(req),
+		before, after,
+	)
+	if err != nil {
+		log.Errorf(ctx, "failed to record audit event %q: %v", action, err)
+	}
+}
+
+// parseAuditFilter reads the filter from the query string.  Dates are
+// expected to be in RFC 3339 format.
+func parseAuditFilter(req *http.Request) (models.AuditFilter, error) {
+	var err error
+
+	query := req.URL.Query()
+	filter := models.AuditFilter{
+		Action: query.Get("action"),
+		Actor:  query.Get("actor"),
+	}
+
+	if since := query.Get("since"); since != "" {
+		if filter.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return filter, err
+		}
+	}
+
+	if until := query.Get("until"); until != "" {
+		if filter.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return filter, err
+		}
+	}
+
+	return filter, nil
+}
+
+type auditEventResponse struct {
+	*models.AuditEvent
+	Before json.RawMessage `json:"before"`
+	After  json.RawMessage `json:"after"`
+}
+
+func newAuditEventResponse(event *models.AuditEvent) auditEventResponse {
+	response := auditEventResponse{AuditEvent: event}
+	if event.Before != "" {
+		response.Before = json.RawMessage(event.Before)
+	}
+
+	if event.After != "" {
+		response.After = json.RawMessage(event.After)
+	}
+
+	return response
+}
+
+type auditEventsResponse struct {
+	Events []auditEventResponse `json:"events"`
+	Cursor string               `json:"cursor"`
+}
+
+func auditEventsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	filter, err := parseAuditFilter(req)
+	if err != nil {
+		badRequest(res, "Dates must be in RFC 3339 format.")
+		return
+	}
+
+	limit := auditPageSize
+	if n, err := strconv.Atoi(req.FormValue("limit")); err == nil && n > 0 && n <= auditMaxPageSize {
+		limit = n
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	query := models.FindAuditEvents(company.Key(ctx), filter).Limit(limit)
+	if s := req.FormValue("cursor"); s != "" {
+		cursor, err := datastore.DecodeCursor(s)
+		if err != nil {
+			badRequest(res, "Invalid cursor.")
+			return
+		}
+
+		query = query.Start(cursor)
+	}
+
+	response := auditEventsResponse{Events: []auditEventResponse{}}
+	it := query.Run(ctx)
+	for {
+		var event models.AuditEvent
+		_, err := it.Next(&event)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			log.Errorf(ctx, "failed to list audit events: %v", err)
+			serverError(res)
+			return
+		}
+
+		response.Events = append(response.Events, newAuditEventResponse(&event))
+	}
+
+	// A full page means there may be more events.
+	if len(response.Events) == limit {
+		cursor, err := it.Cursor()
+		if err != nil {
+			log.Errorf(ctx, "failed to get audit event cursor: %v", err)
+			serverError(res)
+			return
+		}
+
+		response.Cursor = cursor.String()
+	}
+
+	renderer.JSON(res, http.StatusOK, response)
+}
+
+func exportAuditEventsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	filter, err := parseAuditFilter(req)
+	if err != nil {
+		badRequest(res, "Dates must be in RFC 3339 format.")
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	res.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	res.Header().Set("Content-Disposition", `attachment; filename="audit-log.csv"`)
+
+	writer := csv.NewWriter(res)
+	writer.Write([]string{"time", "actor", "actor_name", "action", "target", "ip", "before", "after"})
+
+	it := models.FindAuditEvents(company.Key(ctx), filter).Run(ctx)
+	for {
+		var event models.AuditEvent
+		_, err := it.Next(&event)
+		if err == datastore.Done {
+			break
+		} else if err != nil {
+			// The headers have already been sent so all we can do
+			// is cut the export short.
+			log.Errorf(ctx, "failed to export audit events: %v", err)
+			break
+		}
+
+		writer.Write([]string{
+			event.CreatedAt.UTC().Format(time.RFC3339),
+			event.Actor,
+			event.ActorName,
+			event.Action,
+			event.Target,
+			event.IP,
+			event.Before,
+			event.After,
+		})
+	}
+
+	writer.Flush()
+}
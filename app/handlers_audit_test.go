@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseAuditFilter(t *testing.T) {
+	t.Parallel()
+
+	req, _ := http.NewRequest("GET", "/api/audit-events?action=user.deleted&actor=a@example.com&since=2016-01-02T15:04:05Z", nil)
+	filter, err := parseAuditFilter(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	since := time.Date(2016, 1, 2, 15, 4, 5, 0, time.UTC)
+	if filter.Action != "user.deleted" || filter.Actor != "a@example.com" || !filter.Since.Equal(since) || !filter.Until.IsZero() {
+		t.Errorf("unexpected filter: %+v", filter)
+	}
+
+	req, _ = http.NewRequest("GET", "/api/audit-events?until=yesterday", nil)
+	if _, err := parseAuditFilter(req); err == nil {
+		t.Errorf("expected malformed date to be rejected")
+	}
+}
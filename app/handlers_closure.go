@@ -0,0 +1,137 @@
+package handlers
+
+import (
+	"net/http"
+	"teamzones/forms"
+	"teamzones/integrations"
+	"teamzones/models"
+
+	"github.com/gorilla/context"
+	"github.com/lionelbarrow/braintree-go"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/taskqueue"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+func init() {
+	POST(appRouter, "closure", "/api/closure", closeCompanyHandler, models.RoleMain)
+	ALL(appRouter, "team-closed", "/closed", closedHandler, Everyone)
+}
+
+// closeCompanyHandler cancels the Company's subscription and closes
+// it.  Its data is deleted in the background once the grace period
+// is over unless the owner reopens it first.  The owner has to
+// confirm by sending the Company's subdomain.
+func closeCompanyHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		Subdomain string `json:"subdomain"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	user := context.Get(req, userCtxKey).(*models.User)
+	if data.Subdomain != company.Subdomain {
+		badRequest(res, "Please enter your team's subdomain to confirm.")
+		return
+	}
+
+	if company.Closed() {
+		badRequest(res, models.ErrCompanyClosed.Error())
+		return
+	}
+
+	if company.SubscriptionID != "" && company.SubscriptionStatus != braintree.SubscriptionStatusCanceled {
+		sub, err := integrations.BraintreeCancelSubscription(ctx, company.SubscriptionID)
+		if err != nil {
+			log.Errorf(ctx, "failed to cancel subscription for %v: %v", company.Subdomain, err)
+			serverError(res)
+			return
+		}
+
+		if err := company.CancelSubscription(ctx, sub); err != nil {
+			log.Errorf(ctx, "failed to cancel subscription: %v", err)
+			serverError(res)
+			return
+		}
+	}
+
+	if err := company.Close(ctx, user.Email); err != nil {
+		log.Errorf(ctx, "failed to close company: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditCompanyClosed, company.Subdomain, nil, nil)
+
+	task, err := purgeCompany.Task(company.Key(ctx))
+	if err != nil {
+		panic(err)
+	}
+
+	task.ETA = company.DeleteAt
+	if _, err := taskqueue.Add(ctx, task, ""); err != nil {
+		log.Errorf(ctx, "failed to schedule company deletion: %v", err)
+		serverError(res)
+		return
+	}
+
+	sendClosureEmail.Call(ctx, company.Key(ctx))
+	res.WriteHeader(http.StatusAccepted)
+}
+
+// closedHandler is shown instead of every page while the Company is
+// closed.  The owner can reopen it until it's deleted.  Closing a
+// Company cancels its subscription and reopening it doesn't restore
+// it, so owners are sent to the billing page to subscribe again.
+func closedHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	user := context.Get(req, userCtxKey).(*models.User)
+	if !company.Closed() {
+		http.Redirect(res, req, ReverseSimple("dashboard"), http.StatusFound)
+		return
+	}
+
+	data := struct {
+		Company     *models.Company
+		Owner       bool
+		Resubscribe bool
+		Error       string
+	}{
+		Company:     company,
+		Owner:       user.Role == models.RoleMain,
+		Resubscribe: company.SubscriptionID != "" && company.SubscriptionStatus == braintree.SubscriptionStatusCanceled,
+	}
+
+	if req.Method == http.MethodPost {
+		if !data.Owner {
+			forbidden(res)
+			return
+		}
+
+		if err := company.Reopen(ctx); err != nil {
+			data.Error = err.Error()
+			renderer.HTML(res, http.StatusBadRequest, "closed", data)
+			return
+		}
+
+		audit(req, models.AuditCompanyReopened, company.Subdomain, nil, nil)
+		if data.Resubscribe {
+			http.Redirect(res, req, ReverseSimple("settings-billing"), http.StatusFound)
+			return
+		}
+
+		http.Redirect(res, req, ReverseSimple("dashboard"), http.StatusFound)
+		return
+	}
+
+	renderer.HTML(res, http.StatusOK, "closed", data)
+}
@@ -0,0 +1,531 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"teamzones/forms"
+	"teamzones/integrations"
+	"teamzones/models"
+	"teamzones/utils"
+	"time"
+
+	"github.com/gorilla/context"
+
+	netcontext "golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+const (
+	joinLinkTTL = 48 * time.Hour
+
+	// joinLinkInterval limits how often confirmation links are sent
+	// to the same address.
+	joinLinkInterval = 1 * time.Minute
+
+	joinLinkFailedMessage = "This confirmation link is invalid or has expired."
+	joinClosedMessage     = "This team isn't accepting requests to join right now."
+	joinRequestedMessage  = ("Your request has been sent to the team's managers. " +
+		"We'll e-mail you once it's been approved.")
+)
+
+// domainResolver looks up the TXT records used to verify Domains.  It
+// is a variable so that it can be replaced in tests.
+var domainResolver integrations.TXTResolver = integrations.HTTPSResolver{}
+
+func init() {
+	GET(
+		appRouter,
+		"domains", "/api/domains",
+		domainsHandler, models.RoleMain,
+	)
+	POST(
+		appRouter,
+		"domains-create", "/api/domains",
+		createDomainHandler, models.RoleMain,
+	)
+	POST(
+		appRouter,
+		"domains-verify", "/api/domains/:domain/verify",
+		verifyDomainHandler, models.RoleMain,
+	)
+	DELETE(
+		appRouter,
+		"domains-delete", "/api/domains/:domain",
+		deleteDomainHandler, models.RoleMain,
+	)
+	GET(
+		appRouter,
+		"domain-settings", "/api/domain-settings",
+		domainSettingsHandler, models.RoleMain,
+	)
+	POST(
+		appRouter,
+		"domain-settings-update", "/api/domain-settings",
+		updateDomainSettingsHandler, models.RoleMain,
+	)
+	GET(
+		appRouter,
+		"join-requests", "/api/join-requests",
+		joinRequestsHandler, models.RoleMain, models.RoleManager,
+	)
+	POST(
+		appRouter,
+		"join-requests-approve", "/api/join-requests/:email/approve",
+		approveJoinRequestHandler, models.RoleMain, models.RoleManager,
+	)
+	DELETE(
+		appRouter,
+		"join-requests-deny", "/api/join-requests/:email",
+		denyJoinRequestHandler, models.RoleMain, models.RoleManager,
+	)
+	ALL(appRouter, "team-join", "/join", joinHandler, Everyone)
+	ALL(appRouter, "team-join-confirm", "/join/:token", confirmJoinHandler, Everyone)
+}
+
+type domainResponse struct {
+	*models.Domain
+	Record string `json:"record"`
+}
+
+func newDomainResponse(domain *models.Domain) domainResponse {
+	return domainResponse{domain, integrations.DomainVerificationPrefix + domain.Token}
+}
+
+func domainsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	domains, err := models.GetDomains(ctx, company.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list domains: %v", err)
+		serverError(res)
+		return
+	}
+
+	response := make([]domainResponse, len(domains))
+	for i, domain := range domains {
+		response[i] = newDomainResponse(domain)
+	}
+
+	renderer.JSON(res, http.StatusOK, response)
+}
+
+func createDomainHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		Domain string `json:"domain"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	name := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(data.Domain), "@"))
+	if err := validateEmailDomain(name); err != nil {
+		badRequest(res, "domain: "+err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	domain, err := models.CreateDomain(ctx, company.Key(ctx), name, user.Email)
+	switch err {
+	case nil:
+	case models.ErrDomainExists:
+		badRequest(res, "domain: "+err.Error())
+		return
+	default:
+		log.Errorf(ctx, "failed to create domain: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditDomainAdded, domain.Name, nil, nil)
+	renderer.JSON(res, http.StatusCreated, newDomainResponse(domain))
+}
+
+// verifyDomainHandler looks for the Domain's verification token in its
+// TXT records.  Verification can be retried as many times as needed
+// since DNS changes can take a while to propagate.
+func verifyDomainHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	companyKey := company.Key(ctx)
+	domain, err := models.GetDomain(ctx, companyKey, params.ByName("domain"))
+	switch err {
+	case nil:
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	default:
+		log.Errorf(ctx, "failed to get domain: %v", err)
+		serverError(res)
+		return
+	}
+
+	verified, err := integrations.VerifyDomain(ctx, domainResolver, domain.Name, domain.Token)
+	if err != nil {
+		log.Warningf(ctx, "failed to look up txt records for %q: %v", domain.Name, err)
+		badRequest(res, "We couldn't look up this domain's DNS records. Please try again later.")
+		return
+	}
+
+	if !verified {
+		badRequest(res, "We couldn't find the TXT record yet. DNS changes can take a while to show up.")
+		return
+	}
+
+	domain, err = models.MarkDomainVerified(ctx, companyKey, domain.Name)
+	switch err {
+	case nil:
+	case models.ErrDomainTaken:
+		badRequest(res, err.Error())
+		return
+	default:
+		log.Errorf(ctx, "failed to verify domain: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditDomainVerified, domain.Name, nil, nil)
+	renderer.JSON(res, http.StatusOK, newDomainResponse(domain))
+}
+
+func deleteDomainHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	name := strings.ToLower(params.ByName("domain"))
+	switch err := models.DeleteDomain(ctx, company.Key(ctx), name); err {
+	case nil:
+		audit(req, models.AuditDomainRemoved, name, nil, nil)
+		res.WriteHeader(http.StatusNoContent)
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+	default:
+		log.Errorf(ctx, "failed to delete domain: %v", err)
+		serverError(res)
+	}
+}
+
+type domainSettings struct {
+	JoinPolicy string `json:"joinPolicy"`
+}
+
+func domainSettingsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	renderer.JSON(res, http.StatusOK, domainSettings{company.DomainJoinPolicy})
+}
+
+func updateDomainSettingsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data domainSettings
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	previous := domainSettings{company.DomainJoinPolicy}
+	if err := company.SetDomainJoinPolicy(data.JoinPolicy); err != nil {
+		badRequest(res, "joinPolicy: "+err.Error())
+		return
+	}
+
+	if _, err := company.Put(ctx); err != nil {
+		log.Errorf(ctx, "failed to update domain settings: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditDomainJoinPolicy, company.Subdomain, previous, data)
+	renderer.JSON(res, http.StatusOK, data)
+}
+
+func joinRequestsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	requests, err := models.GetJoinRequests(ctx, company.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list join requests: %v", err)
+		serverError(res)
+		return
+	}
+
+	renderer.JSON(res, http.StatusOK, requests)
+}
+
+func approveJoinRequestHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	companyKey := company.Key(ctx)
+	request, err := models.GetJoinRequest(ctx, companyKey, params.ByName("email"))
+	switch err {
+	case nil:
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	default:
+		log.Errorf(ctx, "failed to get join request: %v", err)
+		serverError(res)
+		return
+	}
+
+	if company.SeatsLeft(ctx) <= 0 {
+		badRequest(res, seatsExhaustedMessage)
+		return
+	}
+
+	user, created, err := models.ProvisionUser(
+		ctx, companyKey,
+		request.FirstName, request.LastName, request.Email, request.Timezone,
+	)
+	if err != nil {
+		log.Errorf(ctx, "failed to provision user: %v", err)
+		serverError(res)
+		return
+	}
+
+	if err := models.DeleteJoinRequest(ctx, companyKey, request.Email); err != nil {
+		log.Warningf(ctx, "failed to delete join request: %v", err)
+	}
+
+	if created {
+		notifyMemberAdded.Call(ctx, companyKey, user.Key(ctx))
+	}
+
+	// Approved members don't have a password yet so they're sent a
+	// sign in link instead.
+	sendSignInLink.Call(ctx, companyKey, user.Email, "")
+	audit(req, models.AuditJoinRequestApproved, request.Email, nil, nil)
+	renderer.JSON(res, http.StatusOK, user)
+}
+
+func denyJoinRequestHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	companyKey := company.Key(ctx)
+	request, err := models.GetJoinRequest(ctx, companyKey, params.ByName("email"))
+	switch err {
+	case nil:
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	default:
+		log.Errorf(ctx, "failed to get join request: %v", err)
+		serverError(res)
+		return
+	}
+
+	if err := models.DeleteJoinRequest(ctx, companyKey, request.Email); err != nil {
+		log.Errorf(ctx, "failed to delete join request: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditJoinRequestDenied, request.Email, request, nil)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// joinLinkData is what confirmation links carry.  Nothing is stored
+// until the address has been confirmed.
+type joinLinkData struct {
+	Subdomain string `json:"s"`
+	FirstName string `json:"f"`
+	LastName  string `json:"l"`
+	Email     string `json:"e"`
+	Timezone  string `json:"t"`
+}
+
+// joinLinkKey derives the key that join confirmation links are signed
+// with from the application secret.
+func joinLinkKey() []byte {
+	mac := hmac.New(sha256.New, config.Secret.Authentication)
+	mac.Write([]byte("domain-join"))
+	return mac.Sum(nil)
+}
+
+func newJoinLinkToken(data joinLinkData) string {
+	value, _ := json.Marshal(data)
+	return utils.SignValue(joinLinkKey(), string(value), time.Now().Add(joinLinkTTL))
+}
+
+// parseJoinLinkToken returns the data carried by a confirmation link
+// if it is valid for company.
+func parseJoinLinkToken(company *models.Company, token string) (*joinLinkData, bool) {
+	value, err := utils.VerifySignedValue(joinLinkKey(), token, time.Now())
+	if err != nil {
+		return nil, false
+	}
+
+	var data joinLinkData
+	if err := json.Unmarshal([]byte(value), &data); err != nil || data.Subdomain != company.Subdomain {
+		return nil, false
+	}
+
+	return &data, true
+}
+
+type joinForm struct {
+	FirstName forms.Field
+	LastName  forms.Field
+	Email     forms.Field
+	Timezone  forms.Field
+}
+
+func newJoinForm(ctx netcontext.Context, company *models.Company) *joinForm {
+	return &joinForm{
+		forms.Field{
+			Name:        "first-name",
+			Label:       "First Name",
+			Validators:  []forms.Validator{forms.Name},
+			HideLabel:   true,
+			Placeholder: "First name",
+			Attributes:  map[string]string{"class": "input"},
+		},
+		forms.Field{
+			Name:        "last-name",
+			Label:       "Last Name",
+			Validators:  []forms.Validator{forms.Name},
+			HideLabel:   true,
+			Placeholder: "Last name",
+			Attributes:  map[string]string{"class": "input"},
+		},
+		forms.Field{
+			Name:  "email",
+			Label: "Work e-mail address",
+			Validators: []forms.Validator{
+				forms.Email,
+				func(email string) error {
+					if !company.HasVerifiedDomain(ctx, email) {
+						return errors.New("Please use your work e-mail address.")
+					}
+
+					return nil
+				},
+			},
+			HideLabel:   true,
+			Placeholder: "Work email",
+			Attributes:  map[string]string{"class": "input"},
+		},
+		forms.Field{
+			Name:       "timezone",
+			Label:      "Timezone",
+			Validators: []forms.Validator{forms.Timezone},
+		},
+	}
+}
+
+// joinHandler lets people with an address on one of the Company's
+// verified Domains ask to join without an invite.  They are sent a
+// confirmation link first.
+func joinHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	if company.DomainJoinPolicy == models.DomainJoinOff {
+		notFound(res)
+		return
+	}
+
+	form := newJoinForm(ctx, company)
+	data := struct {
+		Company *models.Company
+		Form    *joinForm
+	}{company, form}
+
+	if req.Method == http.MethodPost {
+		if !forms.Bind(req, form) {
+			renderer.HTML(res, http.StatusBadRequest, "join", data)
+			return
+		}
+
+		email := strings.ToLower(form.Email.Value)
+		if !throttle(ctx, "join:"+accountID(company, email), joinLinkInterval) {
+			sendJoinLink.Call(ctx, company.Key(ctx), email, newJoinLinkToken(joinLinkData{
+				Subdomain: company.Subdomain,
+				FirstName: form.FirstName.Value,
+				LastName:  form.LastName.Value,
+				Email:     email,
+				Timezone:  form.Timezone.Value,
+			}))
+		}
+
+		renderer.HTML(res, http.StatusOK, "join-sent", email)
+		return
+	}
+
+	renderer.HTML(res, http.StatusOK, "join", data)
+}
+
+// confirmJoinHandler asks for confirmation before acting on a join
+// link since some mail clients follow links in order to scan them.
+// Depending on the Company's policy, confirmed requests are either
+// admitted straight away or queued for approval.
+func confirmJoinHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	companyKey := company.Key(ctx)
+	data, ok := parseJoinLinkToken(company, params.ByName("token"))
+	if !ok || !company.HasVerifiedDomain(ctx, data.Email) {
+		renderer.HTML(res, http.StatusBadRequest, "join-status", joinLinkFailedMessage)
+		return
+	}
+
+	if company.DomainJoinPolicy == models.DomainJoinOff {
+		renderer.HTML(res, http.StatusBadRequest, "join-status", joinClosedMessage)
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		renderer.HTML(res, http.StatusOK, "join-confirm", data)
+		return
+	}
+
+	if _, err := models.GetUser(ctx, companyKey, data.Email); err == nil {
+		http.Redirect(res, req, ReverseSimple("team-sign-in"), http.StatusFound)
+		return
+	}
+
+	if company.DomainJoinPolicy != models.DomainJoinAuto || company.SeatsLeft(ctx) <= 0 {
+		_, err := models.CreateJoinRequest(
+			ctx, companyKey,
+			data.FirstName, data.LastName, data.Email, data.Timezone,
+		)
+		if err != nil {
+			log.Errorf(ctx, "failed to create join request: %v", err)
+			serverError(res)
+			return
+		}
+
+		renderer.HTML(res, http.StatusOK, "join-status", joinRequestedMessage)
+		return
+	}
+
+	user, created, err := models.ProvisionUser(
+		ctx, companyKey,
+		data.FirstName, data.LastName, data.Email, data.Timezone,
+	)
+	if err != nil {
+		log.Errorf(ctx, "failed to provision user: %v", err)
+		serverError(res)
+		return
+	}
+
+	if created {
+		notifyMemberAdded.Call(ctx, companyKey, user.Key(ctx))
+	}
+
+	if ssoEnforced(ctx, user) {
+		http.Redirect(res, req, ReverseSimple("team-sign-in"), http.StatusFound)
+		return
+	}
+
+	signIn(res, req, user, "/", false)
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"teamzones/models"
+	"testing"
+)
+
+func TestJoinLinkTokens(t *testing.T) {
+	t.Parallel()
+
+	acme := &models.Company{Subdomain: "acme"}
+	token := newJoinLinkToken(joinLinkData{
+		Subdomain: "acme",
+		FirstName: "Jim",
+		LastName:  "Halpert",
+		Email:     "jim@acme.com",
+		Timezone:  "America/New_York",
+	})
+
+	data, ok := parseJoinLinkToken(acme, token)
+	if !ok || data.Email != "jim@acme.com" || data.FirstName != "Jim" || data.Timezone != "America/New_York" {
+		t.Errorf("expected token to round trip, got %+v", data)
+	}
+
+	if _, ok := parseJoinLinkToken(&models.Company{Subdomain: "evil"}, token); ok {
+		t.Errorf("expected token to be bound to its company")
+	}
+
+	if _, ok := parseJoinLinkToken(acme, token+"x"); ok {
+		t.Errorf("expected tampered token to be rejected")
+	}
+
+	if _, ok := parseJoinLinkToken(acme, newEmailVerificationToken(acme, "jim@acme.com")); ok {
+		t.Errorf("expected e-mail verification tokens to be rejected")
+	}
+}
@@ -0,0 +1,385 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"teamzones/forms"
+	"teamzones/models"
+	"time"
+
+	"github.com/gorilla/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+func init() {
+	GET(appRouter, "groups", "/api/groups", groupsHandler)
+	POST(
+		appRouter,
+		"groups-create", "/api/groups",
+		createGroupHandler, models.RoleMain, models.RoleManager,
+	)
+	PATCH(
+		appRouter,
+		"groups-update", "/api/groups/:id",
+		updateGroupHandler, Everyone,
+	)
+	DELETE(
+		appRouter,
+		"groups-delete", "/api/groups/:id",
+		deleteGroupHandler, models.RoleMain, models.RoleManager,
+	)
+	GET(appRouter, "groups-overlap", "/api/groups/:id/overlap", groupOverlapHandler)
+}
+
+// groupData is the editable part of a Group.
+type groupData struct {
+	Name    string   `json:"name" validate:"MaxLength:50"`
+	Members []string `json:"members"`
+	Leads   []string `json:"leads"`
+}
+
+// canManageGroups returns true if user may create, rename and delete
+// any of their Company's Groups.
+func canManageGroups(user *models.User) bool {
+	return user.Role == models.RoleMain || user.Role == models.RoleManager
+}
+
+// getGroup looks up one of the current Company's Groups by its id,
+// responding with an error if it can't be found.
+func getGroup(res http.ResponseWriter, req *http.Request, sid string) (*models.Group, bool) {
+	id, err := strconv.ParseInt(sid, 10, 64)
+	if err != nil {
+		notFound(res)
+		return nil, false
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	group, err := models.GetGroup(ctx, company.Key(ctx), id)
+	switch err {
+	case nil:
+		return group, true
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+	default:
+		log.Errorf(ctx, "failed to get group: %v", err)
+		serverError(res)
+	}
+
+	return nil, false
+}
+
+// checkGroupMembers ensures that every one of a Group's members that
+// isn't in existing is an active member of the Company.  Members that
+// were deactivated after joining the Group stay in it until they're
+// deleted, so only newly added members are checked.
+func checkGroupMembers(users []models.User, group *models.Group, existing []string) bool {
+	allowed := make(map[string]bool, len(users)+len(existing))
+	for _, user := range users {
+		allowed[user.Email] = true
+	}
+
+	for _, member := range existing {
+		allowed[member] = true
+	}
+
+	for _, member := range group.Members {
+		if !allowed[member] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// groupMembers returns the Users that are members of group.
+func groupMembers(users []models.User, group *models.Group) []models.User {
+	members := []models.User{}
+	for _, user := range users {
+		if group.HasMember(user.Email) {
+			members = append(members, user)
+		}
+	}
+
+	return members
+}
+
+func groupsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	groups, err := models.GetGroups(ctx, company.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list groups: %v", err)
+		serverError(res)
+		return
+	}
+
+	renderer.JSON(res, http.StatusOK, groups)
+}
+
+func createGroupHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data groupData
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	group := models.Group{
+		Name:    data.Name,
+		Members: data.Members,
+		Leads:   data.Leads,
+	}
+
+	if err := group.Validate(); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	users, err := models.GetActiveUsers(ctx, company.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list users: %v", err)
+		serverError(res)
+		return
+	}
+
+	if !checkGroupMembers(users, &group, nil) {
+		badRequest(res, "Members: Groups may only contain active members of the team.")
+		return
+	}
+
+	switch err := models.CreateGroup(ctx, company.Key(ctx), &group); err {
+	case nil:
+	case models.ErrTooManyGroups:
+		badRequest(res, err.Error())
+		return
+	default:
+		log.Errorf(ctx, "failed to create group: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditGroupCreated, group.Name, nil, &group)
+	renderer.JSON(res, http.StatusCreated, &group)
+}
+
+// updateGroupHandler updates a Group.  Group leads may change who
+// belongs to their Group but only managers may rename it or change
+// its leads.
+func updateGroupHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	var data groupData
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	group, ok := getGroup(res, req, params.ByName("id"))
+	if !ok {
+		return
+	}
+
+	user := context.Get(req, userCtxKey).(*models.User)
+	if !canManageGroups(user) && !group.IsLead(user.Email) {
+		forbidden(res)
+		return
+	}
+
+	previous := *group
+	group.Members = data.Members
+	if canManageGroups(user) {
+		group.Name = data.Name
+		group.Leads = data.Leads
+	}
+
+	if err := group.Validate(); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	users, err := models.GetActiveUsers(ctx, company.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list users: %v", err)
+		serverError(res)
+		return
+	}
+
+	if !checkGroupMembers(users, group, previous.Members) {
+		badRequest(res, "Members: Groups may only contain active members of the team.")
+		return
+	}
+
+	if err := group.Put(ctx); err != nil {
+		log.Errorf(ctx, "failed to update group: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditGroupUpdated, group.Name, &previous, group)
+	renderer.JSON(res, http.StatusOK, group)
+}
+
+func deleteGroupHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	group, ok := getGroup(res, req, params.ByName("id"))
+	if !ok {
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	if err := models.DeleteGroup(ctx, group.Company, group.ID); err != nil {
+		log.Errorf(ctx, "failed to delete group: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditGroupDeleted, group.Name, group, nil)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// overlapRange is a span of time during which every member of a Group
+// is working.
+type overlapRange struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+}
+
+// workingHours returns the spans of time within the 24 hours starting
+// at day during which user is working, according to their Workdays
+// and Timezone.
+func workingHours(user *models.User, day time.Time) []overlapRange {
+	location, err := time.LoadLocation(user.Timezone)
+	if err != nil {
+		location = time.UTC
+	}
+
+	end := day.Add(24 * time.Hour)
+	local := day.In(location)
+	ranges := []overlapRange{}
+	for offset := -1; offset <= 1; offset++ {
+		date := time.Date(local.Year(), local.Month(), local.Day()+offset, 0, 0, 0, 0, location)
+		workday := user.Workdays.On(date.Weekday())
+		if workday.Start >= workday.End {
+			continue
+		}
+
+		r := overlapRange{
+			Start: time.Date(date.Year(), date.Month(), date.Day(), workday.Start, 0, 0, 0, location).UTC(),
+			End:   time.Date(date.Year(), date.Month(), date.Day(), workday.End, 0, 0, 0, location).UTC(),
+		}
+
+		if r.Start.Before(day) {
+			r.Start = day
+		}
+
+		if r.End.After(end) {
+			r.End = end
+		}
+
+		if r.Start.Before(r.End) {
+			ranges = append(ranges, r)
+		}
+	}
+
+	return ranges
+}
+
+// intersectRanges returns the spans of time that are in both a and
+// b.  Both must be sorted and free of overlaps.
+func intersectRanges(a, b []overlapRange) []overlapRange {
+	ranges := []overlapRange{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		r := overlapRange{a[i].Start, a[i].End}
+		if b[j].Start.After(r.Start) {
+			r.Start = b[j].Start
+		}
+
+		if b[j].End.Before(r.End) {
+			r.End = b[j].End
+		}
+
+		if r.Start.Before(r.End) {
+			ranges = append(ranges, r)
+		}
+
+		if a[i].End.Before(b[j].End) {
+			i++
+		} else {
+			j++
+		}
+	}
+
+	return ranges
+}
+
+// workingOverlap returns the spans of time within the 24 hours
+// starting at day during which all of users are working.
+func workingOverlap(users []models.User, day time.Time) []overlapRange {
+	if len(users) == 0 {
+		return []overlapRange{}
+	}
+
+	ranges := []overlapRange{{day, day.Add(24 * time.Hour)}}
+	for i := range users {
+		ranges = intersectRanges(ranges, workingHours(&users[i], day))
+	}
+
+	return ranges
+}
+
+// groupOverlapHandler computes when all of a Group's members are
+// working on the day given by the date parameter (in YYYY-MM-DD
+// format, UTC).  It defaults to the current day.
+func groupOverlapHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	day := time.Now().UTC().Truncate(24 * time.Hour)
+	if date := req.FormValue("date"); date != "" {
+		var err error
+		if day, err = time.Parse("2006-01-02", date); err != nil {
+			badRequest(res, "date: Dates must be in YYYY-MM-DD format.")
+			return
+		}
+	}
+
+	group, ok := getGroup(res, req, params.ByName("id"))
+	if !ok {
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	users, err := models.GetActiveUsers(ctx, group.Company)
+	if err != nil {
+		log.Errorf(ctx, "failed to list users: %v", err)
+		serverError(res)
+		return
+	}
+
+	renderer.JSON(res, http.StatusOK, workingOverlap(groupMembers(users, group), day))
+}
+
+// groupAttendees adds the e-mail addresses of a Group's members to
+// attendees, leaving out the Meeting's owner and any duplicates.
+func groupAttendees(attendees []string, members []models.User, owner *models.User) []string {
+	seen := make(map[string]bool)
+	merged := []string{}
+	for _, attendee := range attendees {
+		if !seen[attendee] {
+			seen[attendee] = true
+			merged = append(merged, attendee)
+		}
+	}
+
+	for _, member := range members {
+		if !seen[member.Email] && member.Email != owner.Email {
+			seen[member.Email] = true
+			merged = append(merged, member.Email)
+		}
+	}
+
+	return merged
+}
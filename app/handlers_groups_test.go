@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"reflect"
+	"teamzones/models"
+	"testing"
+	"time"
+)
+
+func TestWorkingOverlap(t *testing.T) {
+	t.Parallel()
+
+	weekdays := func(start, end int) models.Workdays {
+		day := models.Workday{Start: start, End: end}
+		return models.Workdays{Monday: day, Tuesday: day, Wednesday: day, Thursday: day, Friday: day}
+	}
+
+	at := func(hour, minute int) time.Time {
+		return time.Date(2016, time.June, 6, hour, minute, 0, 0, time.UTC)
+	}
+
+	// 2016-06-06 is a Monday.
+	monday := at(0, 0)
+	bucharest := models.User{Timezone: "Europe/Bucharest", Workdays: weekdays(9, 17)}
+	london := models.User{Timezone: "Europe/London", Workdays: weekdays(9, 17)}
+	newYork := models.User{Timezone: "America/New_York", Workdays: weekdays(9, 17)}
+	tokyo := models.User{Timezone: "Asia/Tokyo", Workdays: weekdays(9, 17)}
+	nightOwl := models.User{Timezone: "UTC", Workdays: weekdays(20, 24)}
+	weekender := models.User{Timezone: "UTC", Workdays: models.Workdays{Saturday: models.Workday{Start: 9, End: 17}}}
+
+	cases := []struct {
+		users    []models.User
+		expected []overlapRange
+	}{
+		{[]models.User{}, []overlapRange{}},
+		{[]models.User{bucharest}, []overlapRange{{at(6, 0), at(14, 0)}}},
+		{[]models.User{bucharest, london}, []overlapRange{{at(8, 0), at(14, 0)}}},
+		{[]models.User{bucharest, london, newYork}, []overlapRange{{at(13, 0), at(14, 0)}}},
+		{[]models.User{bucharest, newYork, tokyo}, []overlapRange{}},
+		{[]models.User{tokyo}, []overlapRange{{at(0, 0), at(8, 0)}}},
+		{[]models.User{nightOwl, newYork}, []overlapRange{{at(20, 0), at(21, 0)}}},
+		{[]models.User{weekender}, []overlapRange{}},
+	}
+
+	for i, test := range cases {
+		overlap := workingOverlap(test.users, monday)
+		if !reflect.DeepEqual(overlap, test.expected) {
+			t.Errorf("case %d: expected %v, got %v", i, test.expected, overlap)
+		}
+	}
+}
+
+func TestGroupAttendees(t *testing.T) {
+	t.Parallel()
+
+	owner := &models.User{Email: "peter@example.com"}
+	members := []models.User{
+		{Email: "peter@example.com"},
+		{Email: "jim@example.com"},
+		{Email: "bob@example.com"},
+	}
+
+	attendees := groupAttendees([]string{"jim@example.com", "guest@example.org"}, members, owner)
+	expected := []string{"jim@example.com", "guest@example.org", "bob@example.com"}
+	if !reflect.DeepEqual(attendees, expected) {
+		t.Errorf("expected %v, got %v", expected, attendees)
+	}
+}
+
+func TestCheckGroupMembers(t *testing.T) {
+	t.Parallel()
+
+	users := []models.User{{Email: "jim@example.com"}, {Email: "pam@example.com"}}
+	cases := []struct {
+		members  []string
+		existing []string
+		expected bool
+	}{
+		{[]string{}, nil, true},
+		{[]string{"jim@example.com", "pam@example.com"}, nil, true},
+		{[]string{"jim@example.com", "dwight@example.com"}, nil, false},
+		{[]string{"jim@example.com", "dwight@example.com"}, []string{"dwight@example.com"}, true},
+		{[]string{"jim@example.com", "ryan@example.com"}, []string{"dwight@example.com"}, false},
+	}
+
+	for i, test := range cases {
+		group := &models.Group{Members: test.members}
+		if checkGroupMembers(users, group, test.existing) != test.expected {
+			t.Errorf("case %d: expected %v", i, test.expected)
+		}
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	t.Parallel()
+
+	users := []models.User{{Email: "jim@example.com"}, {Email: "pam@example.com"}, {Email: "dwight@example.com"}}
+	group := &models.Group{Members: []string{"dwight@example.com", "jim@example.com"}}
+
+	members := groupMembers(users, group)
+	if len(members) != 2 || members[0].Email != "jim@example.com" || members[1].Email != "dwight@example.com" {
+		t.Errorf("unexpected members: %+v", members)
+	}
+}
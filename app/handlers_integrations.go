@@ -140,6 +140,7 @@ func gcalendarOAuthTeamHandler(res http.ResponseWriter, req *http.Request, _ htt
 		return
 	}
 
+	audit(req, models.AuditIntegrationConnected, models.OAuth2GCalendar, nil, nil)
 	location := ReverseRoute("integrations-calendar").Build()
 	http.Redirect(res, req, location, http.StatusFound)
 }
@@ -0,0 +1,712 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"teamzones/forms"
+	"teamzones/models"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/qedus/nds"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+func init() {
+	GET(
+		appRouter,
+		"invites", "/api/invites",
+		invitesHandler, models.RoleMain, models.RoleManager,
+	)
+	POST(
+		appRouter,
+		"invites-resend", "/api/invites/:id/resend",
+		resendInviteHandler, models.RoleMain, models.RoleManager,
+	)
+	DELETE(
+		appRouter,
+		"invites-revoke", "/api/invites/:id",
+		revokeInviteHandler, models.RoleMain, models.RoleManager,
+	)
+	GET(
+		appRouter,
+		"invite-settings", "/api/invite-settings",
+		inviteSettingsHandler, models.RoleMain, models.RoleManager,
+	)
+	POST(
+		appRouter,
+		"invite-settings-update", "/api/invite-settings",
+		updateInviteSettingsHandler, models.RoleMain,
+	)
+	GET(
+		appRouter,
+		"bulk-invites", "/api/bulk-invites",
+		bulkInvitesHandler, models.RoleMain, models.RoleManager,
+	)
+	POST(
+		appRouter,
+		"invites-create-bulk", "/api/bulk-invites",
+		createBulkInviteHandler, models.RoleMain, models.RoleManager,
+	)
+	DELETE(
+		appRouter,
+		"bulk-invites-revoke", "/api/bulk-invites/:id",
+		revokeBulkInviteHandler, models.RoleMain, models.RoleManager,
+	)
+	POST(
+		appRouter,
+		"invite-jobs-create", "/api/invite-jobs",
+		createInviteJobHandler, models.RoleMain, models.RoleManager,
+	)
+	GET(
+		appRouter,
+		"invite-jobs", "/api/invite-jobs/:id",
+		inviteJobHandler, models.RoleMain, models.RoleManager,
+	)
+}
+
+const (
+	inviteCSVMaxBytes = 1024 * 1024
+	inviteCSVMaxRows  = 1000
+
+	bulkInviteMaxBytes    = 64 * 1024
+	bulkInviteDefaultName = "Invite link"
+)
+
+type inviteResponse struct {
+	*models.Invite
+	ID      int64 `json:"id"`
+	Expired bool  `json:"expired"`
+}
+
+type inviteSettings struct {
+	ExpiresInDays int `json:"expiresInDays"`
+}
+
+func newInviteSettings(company *models.Company) inviteSettings {
+	days := company.InviteTTLDays
+	if days == 0 {
+		days = models.DefaultInviteTTLDays
+	}
+
+	return inviteSettings{days}
+}
+
+func invitesHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	keys, invites, err := models.GetPendingInvites(ctx, company.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list invites: %v", err)
+		serverError(res)
+		return
+	}
+
+	now := time.Now()
+	response := make([]inviteResponse, len(invites))
+	for i, invite := range invites {
+		response[i] = inviteResponse{
+			Invite:  invite,
+			ID:      keys[i].IntID(),
+			Expired: invite.Expired(now),
+		}
+	}
+
+	renderer.JSON(res, http.StatusOK, response)
+}
+
+// resendInviteHandler e-mails an Invite again and pushes its expiry
+// back.  Expired invites can be resent as long as there's a seat
+// available for them.
+func resendInviteHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	inviteID, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil {
+		notFound(res)
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	companyKey := company.Key(ctx)
+	invite, err := models.GetInvite(ctx, companyKey, inviteID)
+	switch err {
+	case nil:
+		if invite.Bulk {
+			notFound(res)
+			return
+		}
+	case models.ErrInviteExpired:
+		if company.SeatsLeft(ctx) <= 0 {
+			badRequest(res, seatsExhaustedMessage)
+			return
+		}
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	default:
+		log.Errorf(ctx, "failed to get invite: %v", err)
+		serverError(res)
+		return
+	}
+
+	invite, err = models.RenewInvite(ctx, companyKey, inviteID, company.InviteTTL(), nil)
+	switch err {
+	case nil:
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	default:
+		log.Errorf(ctx, "failed to renew invite: %v", err)
+		serverError(res)
+		return
+	}
+
+	sendInviteEmail.Call(ctx, companyKey, inviteID)
+	audit(req, models.AuditInviteResent, invite.Email, nil, nil)
+	renderer.JSON(res, http.StatusOK, inviteResponse{invite, inviteID, false})
+}
+
+func revokeInviteHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	inviteID, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil {
+		notFound(res)
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	companyKey := company.Key(ctx)
+	invite, err := models.GetInvite(ctx, companyKey, inviteID)
+	switch err {
+	case nil, models.ErrInviteExpired:
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	default:
+		log.Errorf(ctx, "failed to get invite: %v", err)
+		serverError(res)
+		return
+	}
+
+	// Bulk invites are managed through their own endpoint.
+	if invite.Bulk {
+		notFound(res)
+		return
+	}
+
+	if err := models.DeleteInvite(ctx, companyKey, inviteID); err != nil {
+		log.Errorf(ctx, "failed to revoke invite: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditInviteRevoked, invite.Email, nil, nil)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+type bulkInviteResponse struct {
+	*models.Invite
+	ID      int64   `json:"id"`
+	URI     string  `json:"uri"`
+	TTL     float64 `json:"ttl"`
+	Expired bool    `json:"expired"`
+}
+
+func newBulkInviteResponse(company *models.Company, inviteID int64, invite *models.Invite) bulkInviteResponse {
+	now := time.Now()
+	location := ReverseRoute("team-sign-up").
+		Param("invite", strconv.FormatInt(inviteID, 10)).
+		Subdomain(company.Subdomain).
+		Build()
+
+	ttl := invite.ExpiresAt.Sub(now).Seconds()
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	return bulkInviteResponse{
+		Invite:  invite,
+		ID:      inviteID,
+		URI:     location,
+		TTL:     ttl,
+		Expired: invite.Expired(now) || invite.UsedUp(),
+	}
+}
+
+// bulkInviteData configures a bulk invite link.  Zero values fall back
+// to a link that anyone can use for BulkInviteTTL.
+type bulkInviteData struct {
+	Name           string `json:"name" validate:"MaxLength:50"`
+	ExpiresInHours int    `json:"expiresInHours"`
+	MaxUses        int    `json:"maxUses"`
+	Role           string `json:"role"`
+	AllowedDomain  string `json:"allowedDomain"`
+}
+
+// validateEmailDomain checks that domain looks like the part of an
+// e-mail address after the @.
+func validateEmailDomain(domain string) error {
+	if len(domain) > 150 || !strings.Contains(domain, ".") || strings.ContainsAny(domain, "@ \t") {
+		return errors.New("Please enter a valid domain, eg. example.com.")
+	}
+
+	return nil
+}
+
+func (data *bulkInviteData) validate(user *models.User) error {
+	if err := forms.Validate(data); err != nil {
+		return err
+	}
+
+	if data.ExpiresInHours < 0 || data.ExpiresInHours > models.MaxInviteTTLDays*24 {
+		return fmt.Errorf("expiresInHours: Links must expire within %d days.", models.MaxInviteTTLDays)
+	}
+
+	if data.MaxUses < 0 {
+		return errors.New("maxUses: Must be 0 for unlimited uses or greater.")
+	}
+
+	if err := checkInviteRole(user, data.Role); err != nil {
+		return fmt.Errorf("role: %v", err)
+	}
+
+	data.AllowedDomain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(data.AllowedDomain), "@"))
+	if data.AllowedDomain != "" {
+		if err := validateEmailDomain(data.AllowedDomain); err != nil {
+			return fmt.Errorf("allowedDomain: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func bulkInvitesHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	keys, invites, err := models.GetBulkInvites(ctx, company.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list bulk invites: %v", err)
+		serverError(res)
+		return
+	}
+
+	response := make([]bulkInviteResponse, len(invites))
+	for i, invite := range invites {
+		response[i] = newBulkInviteResponse(company, keys[i].IntID(), invite)
+	}
+
+	renderer.JSON(res, http.StatusOK, response)
+}
+
+// createBulkInviteHandler creates a shareable invite link.  Requests
+// without a body share a single default link per Company that is
+// cached until shortly before it expires.
+func createBulkInviteHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(res, req.Body, bulkInviteMaxBytes))
+	if err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	var data bulkInviteData
+	isDefault := len(bytes.TrimSpace(body)) == 0 || string(bytes.TrimSpace(body)) == "null"
+	if !isDefault {
+		if err := json.Unmarshal(body, &data); err != nil {
+			badRequest(res, err.Error())
+			return
+		}
+	}
+
+	user := context.Get(req, userCtxKey).(*models.User)
+	if err := data.validate(user); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	if company.SeatsLeft(ctx) <= 0 {
+		badRequest(res, seatsExhaustedMessage)
+		return
+	}
+
+	companyKey := company.Key(ctx)
+	cacheKey := fmt.Sprintf("bulk-invites:%d", companyKey.IntID())
+	if isDefault {
+		if item, err := memcache.Get(ctx, cacheKey); err == nil {
+			inviteID, _ := strconv.ParseInt(string(item.Value), 10, 64)
+			if invite, err := models.GetInvite(ctx, companyKey, inviteID); err == nil {
+				renderer.JSON(res, http.StatusCreated, newBulkInviteResponse(company, inviteID, invite))
+				return
+			}
+		}
+	}
+
+	if data.Name == "" {
+		data.Name = bulkInviteDefaultName
+	}
+
+	ttl := models.BulkInviteTTL
+	if data.ExpiresInHours > 0 {
+		ttl = time.Duration(data.ExpiresInHours) * time.Hour
+	}
+
+	invite := models.NewBulkInvite(companyKey, data.Name)
+	invite.InvitedBy = user.Email
+	invite.MaxUses = data.MaxUses
+	invite.Role = data.Role
+	invite.AllowedDomain = data.AllowedDomain
+	key, err := models.CreateInvite(ctx, invite, ttl)
+	if err != nil {
+		log.Errorf(ctx, "failed to create invite: %v", err)
+		serverError(res)
+		return
+	}
+
+	inviteIDStr := strconv.FormatInt(key.IntID(), 10)
+	audit(req, models.AuditBulkInviteCreated, inviteIDStr, nil, data)
+	if isDefault {
+		memcache.Set(ctx, &memcache.Item{
+			Key:        cacheKey,
+			Value:      []byte(inviteIDStr),
+			Expiration: models.BulkInviteTTL - 10*time.Minute,
+		})
+	}
+
+	renderer.JSON(res, http.StatusCreated, newBulkInviteResponse(company, key.IntID(), invite))
+}
+
+func revokeBulkInviteHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	inviteID, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil {
+		notFound(res)
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	companyKey := company.Key(ctx)
+	invite, err := models.GetInvite(ctx, companyKey, inviteID)
+	switch err {
+	case nil, models.ErrInviteExpired, models.ErrInviteUsedUp:
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	default:
+		log.Errorf(ctx, "failed to get invite: %v", err)
+		serverError(res)
+		return
+	}
+
+	if !invite.Bulk {
+		notFound(res)
+		return
+	}
+
+	if err := models.DeleteInvite(ctx, companyKey, inviteID); err != nil {
+		log.Errorf(ctx, "failed to revoke bulk invite: %v", err)
+		serverError(res)
+		return
+	}
+
+	// The default link is cached so it has to be forgotten as well.
+	cacheKey := fmt.Sprintf("bulk-invites:%d", companyKey.IntID())
+	if item, err := memcache.Get(ctx, cacheKey); err == nil && string(item.Value) == params.ByName("id") {
+		memcache.Delete(ctx, cacheKey)
+	}
+
+	audit(req, models.AuditBulkInviteRevoked, params.ByName("id"), invite, nil)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func inviteSettingsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	renderer.JSON(res, http.StatusOK, newInviteSettings(company))
+}
+
+func updateInviteSettingsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data inviteSettings
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	previous := newInviteSettings(company)
+	if err := company.SetInviteTTLDays(data.ExpiresInDays); err != nil {
+		badRequest(res, "expiresInDays: "+err.Error())
+		return
+	}
+
+	if _, err := company.Put(ctx); err != nil {
+		log.Errorf(ctx, "failed to update invite settings: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditInviteSettings, company.Subdomain, previous, data)
+	renderer.JSON(res, http.StatusOK, newInviteSettings(company))
+}
+
+// inviteRowResult reports on a single row of an uploaded CSV file.
+// Rows are numbered from 1, counting the header if there is one.
+type inviteRowResult struct {
+	Row       int    `json:"row"`
+	Email     string `json:"email"`
+	Error     string `json:"error,omitempty"`
+	Duplicate bool   `json:"duplicate,omitempty"`
+}
+
+// parseInviteCSV reads rows of the form first name, last name, e-mail
+// address and, optionally, role and timezone.  Each row is validated
+// the same way individual invites are.  Rows that repeat an address
+// are reported as duplicates and skipped.
+func parseInviteCSV(r io.Reader, user *models.User) ([]inviteData, []inviteRowResult, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var rows []inviteData
+	var results []inviteRowResult
+	seen := make(map[string]bool)
+	for i, record := range records {
+		for j := range record {
+			record[j] = strings.TrimSpace(record[j])
+		}
+
+		if i == 0 && len(record) >= 3 && strings.EqualFold(record[2], "email") {
+			continue
+		}
+
+		result := inviteRowResult{Row: i + 1}
+		if len(record) < 3 || len(record) > 5 {
+			result.Error = "Expected first name, last name, email and optionally role and timezone."
+			results = append(results, result)
+			continue
+		}
+
+		data := inviteData{
+			FirstName: record[0],
+			LastName:  record[1],
+			Email:     record[2],
+		}
+		if len(record) > 3 {
+			data.Role = record[3]
+		}
+		if len(record) > 4 {
+			data.Timezone = record[4]
+		}
+
+		result.Email = data.Email
+		if err := forms.Validate(&data); err != nil {
+			result.Error = err.Error()
+		} else if err := checkInviteRole(user, data.Role); err != nil {
+			result.Error = "Role: " + err.Error()
+		} else if seen[strings.ToLower(data.Email)] {
+			result.Duplicate = true
+		} else {
+			seen[strings.ToLower(data.Email)] = true
+			rows = append(rows, data)
+		}
+
+		if result.Error != "" || result.Duplicate {
+			results = append(results, result)
+		}
+	}
+
+	return rows, results, nil
+}
+
+// readInviteCSV returns the uploaded CSV file.  It can either be
+// the request body or a multipart form file named "file".
+func readInviteCSV(res http.ResponseWriter, req *http.Request) (io.ReadCloser, error) {
+	req.Body = http.MaxBytesReader(res, req.Body, inviteCSVMaxBytes)
+	if !strings.HasPrefix(req.Header.Get("Content-Type"), "multipart/form-data") {
+		return req.Body, nil
+	}
+
+	file, _, err := req.FormFile("file")
+	return file, err
+}
+
+type inviteJobErrorsResponse struct {
+	Errors []string          `json:"errors"`
+	Rows   []inviteRowResult `json:"rows"`
+}
+
+type inviteJobResponse struct {
+	*models.InviteJob
+	Rows []inviteRowResult `json:"rows"`
+}
+
+// inviteJobSeats returns the number of seats that inviting everyone in
+// rows takes up.  People that already have a pending invite hold on to
+// a seat that's been accounted for; their invites only get renewed.
+func inviteJobSeats(rows []models.InviteJobRow, invites []*models.Invite, now time.Time) int {
+	pending := make(map[string]bool, len(invites))
+	for _, invite := range invites {
+		if !invite.Expired(now) {
+			pending[invite.Email] = true
+		}
+	}
+
+	seats := 0
+	for _, row := range rows {
+		if !pending[row.Email] {
+			seats++
+		}
+	}
+
+	return seats
+}
+
+// createInviteJobHandler validates an uploaded CSV file of people to
+// invite and, if every row is valid, creates an InviteJob that sends
+// out the invites in the background.  Duplicates and people that are
+// already members are skipped.
+func createInviteJobHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	file, err := readInviteCSV(res, req)
+	if err != nil {
+		badRequest(res, "Please upload a CSV file.")
+		return
+	}
+	defer file.Close()
+
+	user := context.Get(req, userCtxKey).(*models.User)
+	rows, results, err := parseInviteCSV(file, user)
+	if err != nil {
+		badRequest(res, "Invalid CSV file: "+err.Error())
+		return
+	}
+
+	if len(rows)+len(results) > inviteCSVMaxRows {
+		badRequest(res, fmt.Sprintf("CSV files may contain at most %d rows.", inviteCSVMaxRows))
+		return
+	}
+
+	for _, result := range results {
+		if result.Error != "" {
+			renderer.JSON(res, http.StatusBadRequest, inviteJobErrorsResponse{
+				Errors: []string{"Some rows are invalid."},
+				Rows:   results,
+			})
+			return
+		}
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	companyKey := company.Key(ctx)
+	userKeys := make([]*datastore.Key, len(rows))
+	for i, row := range rows {
+		userKeys[i] = models.NewUserKey(ctx, companyKey, row.Email)
+	}
+
+	users := make([]models.User, len(rows))
+	memberErrs := make([]error, len(rows))
+	if err := nds.GetMulti(ctx, userKeys, users); err != nil {
+		merr, ok := err.(appengine.MultiError)
+		if !ok {
+			log.Errorf(ctx, "failed to look up members: %v", err)
+			serverError(res)
+			return
+		}
+
+		memberErrs = merr
+	}
+
+	var jobRows []models.InviteJobRow
+	for i, row := range rows {
+		switch memberErrs[i] {
+		case nil:
+			results = append(results, inviteRowResult{Email: row.Email, Duplicate: true})
+			continue
+		case datastore.ErrNoSuchEntity:
+		default:
+			log.Errorf(ctx, "failed to look up member: %v", memberErrs[i])
+			serverError(res)
+			return
+		}
+
+		jobRows = append(jobRows, models.InviteJobRow{
+			FirstName: row.FirstName,
+			LastName:  row.LastName,
+			Email:     row.Email,
+			Role:      row.Role,
+			Timezone:  row.Timezone,
+		})
+	}
+
+	if len(jobRows) == 0 {
+		badRequest(res, "Everyone in this file is already a member.")
+		return
+	}
+
+	_, invites, err := models.GetPendingInvites(ctx, companyKey)
+	if err != nil {
+		log.Errorf(ctx, "failed to list pending invites: %v", err)
+		serverError(res)
+		return
+	}
+
+	if inviteJobSeats(jobRows, invites, time.Now()) > company.SeatsLeft(ctx) {
+		badRequest(res, seatsExhaustedMessage)
+		return
+	}
+
+	job, err := models.CreateInviteJob(ctx, companyKey, user.Email, jobRows)
+	if err != nil {
+		log.Errorf(ctx, "failed to create invite job: %v", err)
+		serverError(res)
+		return
+	}
+
+	enqueueInviteJob.Call(ctx, companyKey, job.ID)
+	audit(req, models.AuditInviteJobCreated, strconv.FormatInt(job.ID, 10), nil, map[string]int{
+		"total": job.Total,
+	})
+
+	location := ReverseRoute("invite-jobs").Param("id", strconv.FormatInt(job.ID, 10)).Build()
+	res.Header().Set("Location", location)
+	renderer.JSON(res, http.StatusAccepted, inviteJobResponse{job, results})
+}
+
+func inviteJobHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	jobID, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil {
+		notFound(res)
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	job, err := models.GetInviteJob(ctx, company.Key(ctx), jobID)
+	switch err {
+	case nil:
+		renderer.JSON(res, http.StatusOK, job)
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+	default:
+		log.Errorf(ctx, "failed to get invite job: %v", err)
+		serverError(res)
+	}
+}
@@ -0,0 +1,158 @@
+package handlers
+
+import (
+	"strings"
+	"teamzones/models"
+	"testing"
+	"time"
+)
+
+func TestParseInviteCSV(t *testing.T) {
+	t.Parallel()
+
+	input := strings.Join([]string{
+		"first name,last name,email,role,timezone",
+		"Peter,Parker,peter@example.com",
+		"Mary,Watson,mary@example.com,manager,America/New_York",
+		"Jo,Smith,jo@example.com",
+		"Peter,Parker,PETER@example.com",
+		"Harry,Osborn,harry",
+		"Miles,Morales,miles@example.com,admin",
+		"Gwen,Stacy,gwen@example.com,,Mars/Olympus_Mons",
+		"Flash",
+	}, "\n")
+
+	owner := &models.User{Role: models.RoleMain}
+	rows, results, err := parseInviteCSV(strings.NewReader(input), owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 2 || rows[0].Email != "peter@example.com" || rows[1].Role != models.RoleManager {
+		t.Fatalf("unexpected rows: %+v", rows)
+	}
+
+	expected := []struct {
+		row       int
+		duplicate bool
+	}{
+		{4, false},
+		{5, true},
+		{6, false},
+		{7, false},
+		{8, false},
+		{9, false},
+	}
+
+	if len(results) != len(expected) {
+		t.Fatalf("expected %d results, got %+v", len(expected), results)
+	}
+
+	for i, e := range expected {
+		result := results[i]
+		if result.Row != e.row || result.Duplicate != e.duplicate || (result.Error == "") != e.duplicate {
+			t.Errorf("unexpected result for row %d: %+v", e.row, result)
+		}
+	}
+}
+
+func TestParseInviteCSVRoles(t *testing.T) {
+	t.Parallel()
+
+	manager := &models.User{Role: models.RoleManager}
+	input := "Mary,Watson,mary@example.com,manager\nPeter,Parker,peter@example.com,user\n"
+	rows, results, err := parseInviteCSV(strings.NewReader(input), manager)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rows) != 1 || len(results) != 1 || results[0].Row != 1 || results[0].Error == "" {
+		t.Errorf("expected managers to be unable to invite managers, got %+v %+v", rows, results)
+	}
+}
+
+func TestBulkInviteDataValidate(t *testing.T) {
+	t.Parallel()
+
+	owner := &models.User{Role: models.RoleMain}
+	manager := &models.User{Role: models.RoleManager}
+	cases := []struct {
+		data bulkInviteData
+		user *models.User
+		pass bool
+	}{
+		{bulkInviteData{}, manager, true},
+		{bulkInviteData{Name: "Engineering", ExpiresInHours: 48, MaxUses: 10}, manager, true},
+		{bulkInviteData{AllowedDomain: "@Example.com"}, manager, true},
+		{bulkInviteData{Role: models.RoleManager}, owner, true},
+		{bulkInviteData{Role: models.RoleManager}, manager, false},
+		{bulkInviteData{ExpiresInHours: -1}, manager, false},
+		{bulkInviteData{ExpiresInHours: models.MaxInviteTTLDays*24 + 1}, manager, false},
+		{bulkInviteData{MaxUses: -1}, manager, false},
+		{bulkInviteData{AllowedDomain: "example"}, manager, false},
+		{bulkInviteData{AllowedDomain: "jo@example.com"}, manager, false},
+	}
+
+	for i, test := range cases {
+		err := test.data.validate(test.user)
+		if test.pass && err != nil {
+			t.Errorf("expected case %d to pass: %v", i, err)
+		} else if !test.pass && err == nil {
+			t.Errorf("expected case %d to fail", i)
+		}
+	}
+
+	data := bulkInviteData{AllowedDomain: " @Example.com"}
+	data.validate(manager)
+	if data.AllowedDomain != "example.com" {
+		t.Errorf("expected domain to be normalized, got %q", data.AllowedDomain)
+	}
+}
+
+func TestInviteJobSeats(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	invites := []*models.Invite{
+		{Email: "jim@example.com", ExpiresAt: now.Add(time.Hour)},
+		{Email: "dwight@example.com", ExpiresAt: now.Add(-time.Hour)},
+	}
+
+	rows := []models.InviteJobRow{
+		{Email: "jim@example.com"},
+		{Email: "dwight@example.com"},
+		{Email: "pam@example.com"},
+	}
+
+	if seats := inviteJobSeats(rows, invites, now); seats != 2 {
+		t.Errorf("expected invites to take up 2 seats, got %d", seats)
+	}
+}
+
+func TestInviteDataApply(t *testing.T) {
+	t.Parallel()
+
+	invite := &models.Invite{
+		Email:  "peter@example.com",
+		Role:   models.RoleUser,
+		Groups: []int64{1},
+	}
+
+	data := inviteData{
+		FirstName: "Peter",
+		LastName:  "Parker",
+		Email:     "peter@example.com",
+		Role:      models.RoleManager,
+		Timezone:  "Europe/Bucharest",
+		Groups:    []int64{2, 3},
+	}
+	data.apply(invite, "mary@example.com")
+
+	if invite.Role != models.RoleManager || invite.Timezone != "Europe/Bucharest" || invite.InvitedBy != "mary@example.com" {
+		t.Fatalf("invite details were not updated: %+v", invite)
+	}
+
+	if len(invite.Groups) != 2 || invite.Groups[0] != 2 || invite.Groups[1] != 3 {
+		t.Fatalf("invite groups were not replaced: %v", invite.Groups)
+	}
+}
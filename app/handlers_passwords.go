@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"net/http"
+	"teamzones/forms"
+	"teamzones/models"
+	"time"
+
+	"github.com/gorilla/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+const (
+	passwordResetRequiredMessage = ("Your team requires you to choose a new password. " +
+		"We've e-mailed you a link to do so.")
+
+	// passwordResetEmailInterval limits how often signing in with a
+	// password that has to be reset sends out a new reset link.
+	passwordResetEmailInterval = 10 * time.Minute
+)
+
+func init() {
+	GET(
+		appRouter,
+		"password-policy", "/api/password-policy",
+		passwordPolicyHandler, models.RoleMain,
+	)
+	POST(
+		appRouter,
+		"password-policy-update", "/api/password-policy",
+		updatePasswordPolicyHandler, models.RoleMain,
+	)
+	POST(
+		appRouter,
+		"password-resets", "/api/password-resets",
+		forcePasswordResetsHandler, models.RoleMain,
+	)
+}
+
+func passwordPolicyHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	renderer.JSON(res, http.StatusOK, company.PasswordPolicy)
+}
+
+func updatePasswordPolicyHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var policy models.PasswordPolicy
+	if err := forms.BindJSON(req, &policy); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	if err := policy.Check(); err != nil {
+		badRequest(res, "minLength: "+err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	previous := company.PasswordPolicy
+	company.PasswordPolicy = policy
+	if _, err := company.Put(ctx); err != nil {
+		log.Errorf(ctx, "failed to update password policy: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditPasswordPolicy, company.Subdomain, previous, policy)
+	renderer.JSON(res, http.StatusOK, company.PasswordPolicy)
+}
+
+// forcePasswordResetsHandler requires the given members, or everyone
+// but the owner when no e-mail addresses are given, to choose a new
+// password.
+func forcePasswordResetsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		Emails []string `json:"emails"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	for _, email := range data.Emails {
+		if err := forms.Email(email); err != nil {
+			badRequest(res, "emails: "+err.Error())
+			return
+		}
+	}
+
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	emails := data.Emails
+	if len(emails) == 0 {
+		users, err := models.GetActiveUsers(ctx, company.Key(ctx))
+		if err != nil {
+			log.Errorf(ctx, "failed to list users: %v", err)
+			serverError(res)
+			return
+		}
+
+		for _, u := range users {
+			if u.Email != user.Email {
+				emails = append(emails, u.Email)
+			}
+		}
+	}
+
+	for _, email := range emails {
+		forcePasswordReset.Call(ctx, company.Key(ctx), email)
+		audit(req, models.AuditPasswordResetForced, email, nil, nil)
+	}
+
+	res.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"teamzones/forms"
+	"teamzones/models"
+	"time"
+
+	"github.com/gorilla/context"
+
+	"google.golang.org/appengine"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+const (
+	// dataExportInterval limits how often a user can request an
+	// export of their personal data.
+	dataExportInterval = time.Hour
+)
+
+func init() {
+	POST(appRouter, "privacy-export", "/api/privacy/export", dataExportHandler, Everyone)
+	POST(appRouter, "privacy-erase", "/api/privacy/erase", dataErasureHandler, Everyone)
+}
+
+// dataExportHandler starts exporting the current user's personal
+// data.  The archive is e-mailed to them once it's ready.
+func dataExportHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	user := context.Get(req, userCtxKey).(*models.User)
+	if throttle(ctx, "privacy-export:"+accountID(company, user.Email), dataExportInterval) {
+		badRequest(res, "An export has already been requested recently.  Please check your e-mail.")
+		return
+	}
+
+	exportPersonalData.Call(ctx, user.Key(ctx))
+	audit(req, models.AuditDataExportRequested, user.Email, nil, nil)
+	res.WriteHeader(http.StatusAccepted)
+}
+
+// dataErasureHandler signs the current user out and starts erasing
+// all of their personal data.  Users have to confirm by sending their
+// own e-mail address.  Owners have to transfer ownership first.
+func dataErasureHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		Email string `json:"email" validate:"Email"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	if !strings.EqualFold(data.Email, user.Email) {
+		badRequest(res, "Please enter your e-mail address to confirm.")
+		return
+	}
+
+	if user.Role == models.RoleMain {
+		badRequest(res, "You must transfer ownership of the team before erasing your data.")
+		return
+	}
+
+	audit(req, models.AuditDataErasureRequested, user.Email, nil, nil)
+	erasePersonalData.Call(ctx, user.Key(ctx))
+	endSession(req)
+	res.WriteHeader(http.StatusAccepted)
+}
+
+type oauth2TokenExport struct {
+	Kind        string    `json:"kind"`
+	AccessToken string    `json:"accessToken"`
+	TokenType   string    `json:"tokenType"`
+	Expiry      time.Time `json:"expiry"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// redactedValue replaces secrets in personal data exports.
+const redactedValue = "[redacted]"
+
+// buildPersonalDataArchive renders a User's PersonalData as a zip
+// archive containing one JSON file per kind of record.
+func buildPersonalDataArchive(data *models.PersonalData) ([]byte, error) {
+	tokens := make([]oauth2TokenExport, len(data.OAuth2Tokens))
+	for i, token := range data.OAuth2Tokens {
+		tokens[i] = oauth2TokenExport{
+			Kind:        token.Kind,
+			AccessToken: redactedValue,
+			TokenType:   token.Token.TokenType,
+			Expiry:      token.Token.Expiry,
+			CreatedAt:   token.CreatedAt,
+			UpdatedAt:   token.UpdatedAt,
+		}
+	}
+
+	events := make([]auditEventResponse, len(data.AuditEvents))
+	for i, event := range data.AuditEvents {
+		events[i] = newAuditEventResponse(event)
+	}
+
+	files := []struct {
+		Name string
+		Data interface{}
+	}{
+		{"user.json", data.User},
+		{"meetings.json", data.Meetings},
+		{"attended-meetings.json", data.AttendedMeetings},
+		{"calendars.json", data.GCalendarData},
+		{"oauth2-tokens.json", tokens},
+		{"sessions.json", data.Sessions},
+		{"api-tokens.json", data.APITokens},
+		{"security-keys.json", data.WebAuthnCredentials},
+		{"invites.json", data.Invites},
+		{"audit-events.json", events},
+	}
+
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	for _, file := range files {
+		w, err := archive.Create(file.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(file.Data); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"teamzones/models"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestBuildPersonalDataArchive(t *testing.T) {
+	t.Parallel()
+
+	data := &models.PersonalData{
+		User: &models.User{Email: "peter@example.com", Password: "hash"},
+		OAuth2Tokens: []*models.OAuth2Token{{
+			Kind: models.OAuth2GCalendar,
+			Token: oauth2.Token{
+				AccessToken:  "access-secret",
+				RefreshToken: "refresh-secret",
+			},
+		}},
+		AuditEvents: []*models.AuditEvent{{
+			Actor:  "peter@example.com",
+			Action: models.AuditDataExportRequested,
+			After:  `{"email":"peter@example.com"}`,
+		}},
+	}
+
+	archive, err := buildPersonalDataArchive(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := make(map[string]string)
+	for _, file := range r.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		files[file.Name] = string(contents)
+	}
+
+	if len(files) != 10 {
+		t.Fatalf("expected 10 files, got %d", len(files))
+	}
+
+	if !strings.Contains(files["user.json"], "peter@example.com") || strings.Contains(files["user.json"], "hash") {
+		t.Errorf("unexpected user.json: %s", files["user.json"])
+	}
+
+	tokens := files["oauth2-tokens.json"]
+	if strings.Contains(tokens, "secret") || !strings.Contains(tokens, redactedValue) {
+		t.Errorf("oauth2 tokens weren't redacted: %s", tokens)
+	}
+
+	if !strings.Contains(files["audit-events.json"], `"after":{"email":"peter@example.com"}`) {
+		t.Errorf("unexpected audit-events.json: %s", files["audit-events.json"])
+	}
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"teamzones/forms"
+	"teamzones/models"
+
+	"github.com/gorilla/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+func init() {
+	GET(appRouter, "profile-fields", "/api/profile-fields", profileFieldsHandler)
+	POST(
+		appRouter,
+		"profile-fields-create", "/api/profile-fields",
+		createProfileFieldHandler, models.RoleMain, models.RoleManager,
+	)
+	PATCH(
+		appRouter,
+		"profile-fields-update", "/api/profile-fields/:id",
+		updateProfileFieldHandler, models.RoleMain, models.RoleManager,
+	)
+	DELETE(
+		appRouter,
+		"profile-fields-delete", "/api/profile-fields/:id",
+		deleteProfileFieldHandler, models.RoleMain, models.RoleManager,
+	)
+	GET(appRouter, "team-members", "/api/team", teamMembersHandler)
+}
+
+// profileFieldData is the editable part of a ProfileField.
+type profileFieldData struct {
+	Name       string   `json:"name" validate:"MaxLength:50"`
+	Kind       string   `json:"kind"`
+	Options    []string `json:"options"`
+	Visibility string   `json:"visibility"`
+}
+
+func profileFieldsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	fields, err := models.GetProfileFields(ctx, company.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list profile fields: %v", err)
+		serverError(res)
+		return
+	}
+
+	renderer.JSON(res, http.StatusOK, fields)
+}
+
+func createProfileFieldHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data profileFieldData
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	field := models.ProfileField{
+		Name:       data.Name,
+		Kind:       data.Kind,
+		Options:    data.Options,
+		Visibility: data.Visibility,
+	}
+
+	if err := field.Validate(); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	switch err := models.CreateProfileField(ctx, company.Key(ctx), &field); err {
+	case nil:
+	case models.ErrTooManyProfileFields:
+		badRequest(res, err.Error())
+		return
+	default:
+		log.Errorf(ctx, "failed to create profile field: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditProfileFieldCreated, field.Name, nil, &field)
+	renderer.JSON(res, http.StatusCreated, &field)
+}
+
+func updateProfileFieldHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil {
+		notFound(res)
+		return
+	}
+
+	var data profileFieldData
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	field, err := models.GetProfileField(ctx, company.Key(ctx), id)
+	switch err {
+	case nil:
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	default:
+		log.Errorf(ctx, "failed to get profile field: %v", err)
+		serverError(res)
+		return
+	}
+
+	previous := *field
+	field.Name = data.Name
+	field.Kind = data.Kind
+	field.Options = data.Options
+	field.Visibility = data.Visibility
+	if err := field.Validate(); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	if err := field.Put(ctx); err != nil {
+		log.Errorf(ctx, "failed to update profile field: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditProfileFieldUpdated, field.Name, &previous, field)
+	renderer.JSON(res, http.StatusOK, field)
+}
+
+func deleteProfileFieldHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	id, err := strconv.ParseInt(params.ByName("id"), 10, 64)
+	if err != nil {
+		notFound(res)
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	field, err := models.GetProfileField(ctx, company.Key(ctx), id)
+	switch err {
+	case nil:
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+		return
+	default:
+		log.Errorf(ctx, "failed to get profile field: %v", err)
+		serverError(res)
+		return
+	}
+
+	if err := models.DeleteProfileField(ctx, company.Key(ctx), id); err != nil {
+		log.Errorf(ctx, "failed to delete profile field: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditProfileFieldDeleted, field.Name, field, nil)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// teamView prepares a Company's active Users for viewer.  Custom field
+// values that viewer isn't allowed to see are removed before the
+// Users are matched against query so that hidden values can't be
+// searched for.
+func teamView(users []models.User, viewer *models.User, fields []*models.ProfileField, query string) []models.User {
+	team := []models.User{}
+	for _, user := range users {
+		user.CustomFields = user.VisibleCustomFields(viewer, fields)
+		if user.Matches(query) {
+			team = append(team, user)
+		}
+	}
+
+	return team
+}
+
+// teamMembersHandler lists the Company's active members.  The q
+// parameter narrows the list down to the members whose profile
+// matches it and the group parameter to the members of a Group.
+func teamMembersHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	users, err := models.GetActiveUsers(ctx, company.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list users: %v", err)
+		serverError(res)
+		return
+	}
+
+	fields, err := models.GetProfileFields(ctx, company.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list profile fields: %v", err)
+		serverError(res)
+		return
+	}
+
+	if groupID := req.FormValue("group"); groupID != "" {
+		group, ok := getGroup(res, req, groupID)
+		if !ok {
+			return
+		}
+
+		users = groupMembers(users, group)
+	}
+
+	viewer := context.Get(req, userCtxKey).(*models.User)
+	renderer.JSON(res, http.StatusOK, teamView(users, viewer, fields, req.FormValue("q")))
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"teamzones/models"
+	"testing"
+)
+
+func TestTeamView(t *testing.T) {
+	t.Parallel()
+
+	fields := []*models.ProfileField{
+		{ID: 1, Name: "Team", Kind: models.ProfileFieldText, Visibility: models.ProfileFieldVisibleTeam},
+		{ID: 2, Name: "Salary band", Kind: models.ProfileFieldText, Visibility: models.ProfileFieldVisibleManagers},
+	}
+
+	users := []models.User{
+		{
+			FirstName: "Peter",
+			Email:     "peter@example.com",
+			JobTitle:  "Software Engineer",
+			Role:      models.RoleUser,
+			CustomFields: []models.CustomFieldValue{
+				{FieldID: 1, Value: "Platform"},
+				{FieldID: 2, Value: "L5"},
+				{FieldID: 3, Value: "deleted"},
+			},
+		},
+		{
+			FirstName: "Jim",
+			Email:     "jim@example.com",
+			City:      "Cluj-Napoca",
+			Role:      models.RoleManager,
+		},
+	}
+
+	cases := []struct {
+		viewer  *models.User
+		query   string
+		emails  []string
+		nvalues int
+	}{
+		{&users[1], "", []string{"peter@example.com", "jim@example.com"}, 2},
+		{&users[0], "", []string{"peter@example.com", "jim@example.com"}, 2},
+		{&models.User{Email: "bob@example.com", Role: models.RoleUser}, "", []string{"peter@example.com", "jim@example.com"}, 1},
+		{&users[1], "software platform", []string{"peter@example.com"}, 2},
+		{&users[1], "CLUJ", []string{"jim@example.com"}, 0},
+		{&users[1], "l5", []string{"peter@example.com"}, 2},
+		{&models.User{Email: "bob@example.com", Role: models.RoleUser}, "l5", []string{}, 0},
+		{&users[1], "deleted", []string{}, 0},
+	}
+
+	for i, test := range cases {
+		team := teamView(users, test.viewer, fields, test.query)
+		if len(team) != len(test.emails) {
+			t.Errorf("case %d: expected %d members, got %d", i, len(test.emails), len(team))
+			continue
+		}
+
+		for j, user := range team {
+			if user.Email != test.emails[j] {
+				t.Errorf("case %d: expected %q, got %q", i, test.emails[j], user.Email)
+			}
+		}
+
+		if len(team) > 0 && team[0].Email == "peter@example.com" && len(team[0].CustomFields) != test.nvalues {
+			t.Errorf("case %d: expected %d custom field values, got %d", i, test.nvalues, len(team[0].CustomFields))
+		}
+	}
+
+	if len(users[0].CustomFields) != 3 {
+		t.Errorf("teamView modified its input")
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"net/http"
+	"teamzones/models"
+	"time"
+
+	"github.com/goincremental/negroni-sessions"
+	"github.com/gorilla/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+const (
+	sidSessionKey = "sid"
+)
+
+func init() {
+	GET(
+		appRouter,
+		"sessions", "/api/sessions",
+		sessionsHandler,
+	)
+	DELETE(
+		appRouter,
+		"sessions-revoke-others", "/api/sessions",
+		revokeOtherSessionsHandler, Everyone,
+	)
+	DELETE(
+		appRouter,
+		"sessions-revoke", "/api/sessions/:id",
+		revokeSessionHandler, Everyone,
+	)
+}
+
+// startSession signs user in by creating a server-side Session and
+// storing its id in the session cookie.  Remembered sessions outlive
+// the browser.
+func startSession(req *http.Request, user *models.User, rememberMe bool) {
+	ctx := appengine.NewContext(req)
+	id, record, err := models.CreateSession(ctx, user, req.UserAgent(), clientIP(req), rememberMe)
+	if err != nil {
+		panic(err)
+	}
+
+	session := sessions.GetSession(req)
+	session.Set(uidSessionKey, user.Email)
+	session.Set(sidSessionKey, id)
+	session.Options(sessions.Options{
+		Path:     "/",
+		MaxAge:   int(record.MaxAge() / time.Second),
+		HTTPOnly: true,
+	})
+}
+
+// endSession signs the current user out and revokes their Session.
+func endSession(req *http.Request) {
+	ctx := appengine.NewContext(req)
+	if record, ok := context.Get(req, sessionCtxKey).(*models.Session); ok {
+		if err := models.RevokeSession(ctx, record.User, record.ID); err != nil {
+			log.Warningf(ctx, "failed to revoke session: %v", err)
+		}
+	}
+
+	session := sessions.GetSession(req)
+	session.Delete(uidSessionKey)
+	session.Delete(sidSessionKey)
+}
+
+type sessionResponse struct {
+	*models.Session
+	Current bool `json:"current"`
+}
+
+func sessionsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	current := context.Get(req, sessionCtxKey).(*models.Session)
+	records, err := models.GetSessions(ctx, user.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list sessions: %v", err)
+		serverError(res)
+		return
+	}
+
+	response := make([]sessionResponse, len(records))
+	for i, record := range records {
+		response[i] = sessionResponse{record, record.ID == current.ID}
+	}
+
+	renderer.JSON(res, http.StatusOK, response)
+}
+
+func revokeSessionHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	if err := models.RevokeSession(ctx, user.Key(ctx), params.ByName("id")); err != nil {
+		log.Errorf(ctx, "failed to revoke session: %v", err)
+		serverError(res)
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func revokeOtherSessionsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	current := context.Get(req, sessionCtxKey).(*models.Session)
+	records, err := models.GetSessions(ctx, user.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list sessions: %v", err)
+		serverError(res)
+		return
+	}
+
+	for _, record := range records {
+		if record.ID == current.ID {
+			continue
+		}
+
+		if err := models.RevokeSession(ctx, user.Key(ctx), record.ID); err != nil {
+			log.Errorf(ctx, "failed to revoke session: %v", err)
+			serverError(res)
+			return
+		}
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
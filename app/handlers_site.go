@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"html/template"
 	"net/http"
+	"strings"
 	"teamzones/forms"
 	"teamzones/integrations"
 	"teamzones/models"
@@ -21,9 +22,9 @@ func init() {
 	GET(siteRouter, "home", "/", homeHandler)
 	GET(siteRouter, "about", "/about/", aboutHandler)
 	GET(siteRouter, "terms", "/terms/", termsHandler)
-	ALL(siteRouter, "sign-up", "/sign-up/:plan/", signUpHandler)
-	ALL(siteRouter, "sign-in", "/sign-in/", siteSignInHandler)
-	ALL(siteRouter, "find-team", "/find-team/", findTeamHandler)
+	ALL(siteRouter, "sign-up", "/sign-up/:plan/", signUpHandler, Everyone)
+	ALL(siteRouter, "sign-in", "/sign-in/", siteSignInHandler, Everyone)
+	ALL(siteRouter, "find-team", "/find-team/", findTeamHandler, Everyone)
 
 	GET(
 		siteRouter,
@@ -33,7 +34,7 @@ func init() {
 	POST(
 		siteRouter,
 		"braintree-webhook", "/api/bt-webhooks",
-		braintreeWebhookHandler,
+		braintreeWebhookHandler, Everyone,
 	)
 }
 
@@ -106,7 +107,7 @@ func signUpHandler(res http.ResponseWriter, req *http.Request, params httprouter
 		forms.Field{
 			Name:       "password",
 			Label:      "Password",
-			Validators: []forms.Validator{forms.MinLength(6)},
+			Validators: []forms.Validator{models.DefaultPasswordPolicy.Validate},
 		},
 		forms.Field{
 			Name:       "address-1",
@@ -236,7 +237,7 @@ func signUpHandler(res http.ResponseWriter, req *http.Request, params httprouter
 		company.SubscriptionID = subscription.Id
 		company.SubscriptionCustomerID = customer.Id
 
-		_, err = models.CreateMainUser(
+		user, err := models.CreateMainUser(
 			ctx,
 			company,
 			form.FirstName.Value,
@@ -244,10 +245,13 @@ func signUpHandler(res http.ResponseWriter, req *http.Request, params httprouter
 			form.Email.Value,
 			form.Password.Value,
 			form.Timezone.Value,
+			true,
 		)
 
 		switch err {
 		case nil:
+			sendVerificationEmail.Call(ctx, company.Key(ctx), user.Email)
+
 			notifySignup.Call(ctx, company.Subdomain)
 			location := ReverseRoute("team-sign-in").
 				Subdomain(form.CompanySubdomain.Value).
@@ -322,7 +326,14 @@ func findTeamHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Pa
 			return
 		}
 
-		// FIXME: Send out notifications
+		// The response is the same whether or not the address belongs
+		// to any teams so that it can't be used to probe membership.
+		ctx := appengine.NewContext(req)
+		email := strings.ToLower(form.Email.Value)
+		if !throttle(ctx, "find-team:"+email, 10*time.Minute) {
+			sendTeamList.Call(ctx, email)
+		}
+
 		renderer.HTML(res, http.StatusOK, "find-team-success", nil)
 		return
 	}
@@ -0,0 +1,498 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"teamzones/forms"
+	"teamzones/integrations"
+	"teamzones/models"
+	"teamzones/utils"
+	"time"
+
+	"github.com/goincremental/negroni-sessions"
+	"github.com/gorilla/context"
+	"github.com/qedus/nds"
+
+	netcontext "golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+const (
+	samlRequestSessionKey  = "saml-request"
+	googleStateSessionKey  = "google-state"
+	googleNonceSessionKey  = "google-nonce"
+	googleReturnSessionKey = "google-return"
+
+	ssoRequiredMessage = "Your team requires you to sign in using single sign-on."
+	ssoFailedMessage   = "We couldn't sign you in using single sign-on. Please try again."
+	deactivatedMessage = "Your account has been deactivated. Please contact your account owner."
+
+	googleFailedMessage = "We couldn't sign you in with Google. Please try again."
+)
+
+func init() {
+	GET(appRouter, "team-sso-metadata", "/sso/saml/metadata", samlMetadataHandler)
+	GET(appRouter, "team-sso-sign-in", "/sso/saml/sign-in", samlSignInHandler)
+	POST(appRouter, "team-sso-acs", "/sso/saml/acs", samlACSHandler, Everyone)
+	GET(appRouter, "team-sign-in-google", "/sign-in/google", googleSignInHandler)
+	GET(siteRouter, "google-sign-in-callback", "/sign-in/google/callback", googleSignInCallbackHandler)
+	GET(appRouter, "team-sign-in-google-callback", "/sign-in/google/callback", googleSignInTeamHandler)
+
+	GET(
+		appRouter,
+		"sso-saml", "/api/sso/saml",
+		samlProviderHandler, models.RoleMain,
+	)
+	POST(
+		appRouter,
+		"sso-saml-update", "/api/sso/saml",
+		updateSAMLProviderHandler, models.RoleMain,
+	)
+	DELETE(
+		appRouter,
+		"sso-saml-delete", "/api/sso/saml",
+		deleteSAMLProviderHandler, models.RoleMain,
+	)
+	GET(
+		appRouter,
+		"sso-google", "/api/sso/google",
+		googleSettingsHandler, models.RoleMain,
+	)
+	POST(
+		appRouter,
+		"sso-google-update", "/api/sso/google",
+		updateGoogleSettingsHandler, models.RoleMain,
+	)
+
+	// Hook up the Sign in with Google OAuth2 URL.
+	integrations.SetSignInRedirectURL(
+		ReverseRoute("google-sign-in-callback").Absolute().Build(),
+	)
+}
+
+// ssoEnforced returns true when the user may only sign in through the
+// Company's SAML identity provider.  Owners are exempt so that they
+// can't lock themselves out of their account.
+func ssoEnforced(ctx netcontext.Context, user *models.User) bool {
+	if user.Role == models.RoleMain {
+		return false
+	}
+
+	provider, err := models.GetSAMLProvider(ctx, user.Company)
+	return err == nil && provider.Enforced
+}
+
+func samlServiceProvider(company *models.Company) *integrations.SAMLServiceProvider {
+	return &integrations.SAMLServiceProvider{
+		EntityID: ReverseRoute("team-sso-metadata").Subdomain(company.Subdomain).Build(),
+		ACSURL:   ReverseRoute("team-sso-acs").Subdomain(company.Subdomain).Build(),
+	}
+}
+
+// isLocalPath returns true if path can safely be redirected to after
+// signing in.
+func isLocalPath(path string) bool {
+	return strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "//")
+}
+
+func samlMetadataHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	metadata, err := samlServiceProvider(company).Metadata()
+	if err != nil {
+		serverError(res)
+		return
+	}
+
+	res.Header().Set("content-type", "application/samlmetadata+xml")
+	res.WriteHeader(http.StatusOK)
+	res.Write(metadata)
+}
+
+func samlSignInHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	provider, err := models.GetSAMLProvider(ctx, company.Key(ctx))
+	if err != nil {
+		notFound(res)
+		return
+	}
+
+	idp, err := provider.IdentityProvider()
+	if err != nil {
+		log.Errorf(ctx, "invalid saml metadata for %v: %v", company.Subdomain, err)
+		serverError(res)
+		return
+	}
+
+	relayState := req.FormValue("r")
+	if !isLocalPath(relayState) {
+		relayState = "/"
+	}
+
+	location, requestID, err := samlServiceProvider(company).AuthnRequestURL(idp, relayState)
+	if err != nil {
+		log.Errorf(ctx, "failed to build authn request: %v", err)
+		serverError(res)
+		return
+	}
+
+	session := sessions.GetSession(req)
+	session.Set(samlRequestSessionKey, requestID)
+	http.Redirect(res, req, location, http.StatusFound)
+}
+
+func samlACSHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	companyKey := company.Key(ctx)
+	provider, err := models.GetSAMLProvider(ctx, companyKey)
+	if err != nil {
+		notFound(res)
+		return
+	}
+
+	templateCtx := newSignInTemplateContext(req)
+	fail := func(message string) {
+		templateCtx.Error = message
+		renderer.HTML(res, http.StatusBadRequest, "sign-in", templateCtx)
+	}
+
+	idp, err := provider.IdentityProvider()
+	if err != nil {
+		log.Errorf(ctx, "invalid saml metadata for %v: %v", company.Subdomain, err)
+		serverError(res)
+		return
+	}
+
+	assertion, err := samlServiceProvider(company).ParseResponse(
+		idp, req.PostFormValue("SAMLResponse"), time.Now(),
+	)
+	if err != nil {
+		log.Warningf(ctx, "rejected saml response for %v: %v", company.Subdomain, err)
+		fail(ssoFailedMessage)
+		return
+	}
+
+	// Unsolicited (IdP-initiated) responses don't have an
+	// InResponseTo but solicited ones must match the request we sent.
+	session := sessions.GetSession(req)
+	requestID, _ := session.Get(samlRequestSessionKey).(string)
+	session.Delete(samlRequestSessionKey)
+	if assertion.InResponseTo != "" && assertion.InResponseTo != requestID {
+		log.Warningf(ctx, "saml response does not match request %q", requestID)
+		fail(ssoFailedMessage)
+		return
+	}
+
+	// Assertions may only be used once.  If we can't record that
+	// one has been used then we can't tell whether it's being
+	// replayed either so it's rejected.
+	err = memcache.Add(ctx, &memcache.Item{
+		Key:        fmt.Sprintf("saml-assertion:%s:%s", company.Subdomain, assertion.ID),
+		Value:      []byte{},
+		Expiration: assertion.ReplayWindow(time.Now()),
+	})
+	switch err {
+	case nil:
+	case memcache.ErrNotStored:
+		log.Warningf(ctx, "saml assertion %q replayed", assertion.ID)
+		fail(ssoFailedMessage)
+		return
+	default:
+		log.Errorf(ctx, "failed to record saml assertion %q: %v", assertion.ID, err)
+		fail(ssoFailedMessage)
+		return
+	}
+
+	email := assertion.Email()
+	if forms.Email(email) != nil {
+		log.Warningf(ctx, "saml assertion does not contain an e-mail address")
+		fail(ssoFailedMessage)
+		return
+	}
+
+	user, err := models.GetUser(ctx, companyKey, email)
+	if err == datastore.ErrNoSuchEntity {
+		// Anyone with access to the IdP's configuration can make it
+		// assert any address so only addresses on the team's
+		// verified domains are provisioned automatically.
+		if !company.HasVerifiedDomain(ctx, email) {
+			log.Warningf(ctx, "refused to provision %q for %v: domain is not verified", email, company.Subdomain)
+			fail("Your account doesn't belong to this team. Please ask your account owner to invite you.")
+			return
+		}
+
+		if company.SeatsLeft(ctx) <= 0 {
+			fail("This team has reached its member limit. Please contact your account owner.")
+			return
+		}
+
+		firstName, lastName := assertion.FirstName(), assertion.LastName()
+		if firstName == "" {
+			firstName = strings.SplitN(email, "@", 2)[0]
+		}
+
+		var created bool
+		user, created, err = models.ProvisionUser(ctx, companyKey, firstName, lastName, email, "UTC")
+		if err != nil {
+			panic(err)
+		}
+
+		if created {
+			notifyMemberAdded.Call(ctx, companyKey, user.Key(ctx))
+		}
+	} else if err != nil {
+		panic(err)
+	}
+
+	if user.Deactivated {
+		fail(deactivatedMessage)
+		return
+	}
+
+	// The IdP's own second factor isn't trusted so members that
+	// enrolled in two-factor authentication still have to use it.
+	signIn(res, req, user, req.PostFormValue("RelayState"), false)
+}
+
+type serviceProviderResponse struct {
+	EntityID    string `json:"entityId"`
+	ACSURL      string `json:"acsUrl"`
+	MetadataURL string `json:"metadataUrl"`
+}
+
+type samlProviderResponse struct {
+	ServiceProvider  serviceProviderResponse `json:"serviceProvider"`
+	IdentityProvider *models.SAMLProvider    `json:"identityProvider"`
+}
+
+func newSAMLProviderResponse(company *models.Company, provider *models.SAMLProvider) samlProviderResponse {
+	sp := samlServiceProvider(company)
+	return samlProviderResponse{
+		ServiceProvider: serviceProviderResponse{
+			EntityID:    sp.EntityID,
+			ACSURL:      sp.ACSURL,
+			MetadataURL: sp.EntityID,
+		},
+		IdentityProvider: provider,
+	}
+}
+
+func samlProviderHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	provider, err := models.GetSAMLProvider(ctx, company.Key(ctx))
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(ctx, "failed to get saml provider: %v", err)
+		serverError(res)
+		return
+	}
+
+	renderer.JSON(res, http.StatusOK, newSAMLProviderResponse(company, provider))
+}
+
+func updateSAMLProviderHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		Metadata string `json:"metadata"`
+		Enforced bool   `json:"enforced"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	companyKey := company.Key(ctx)
+	provider, err := models.GetSAMLProvider(ctx, companyKey)
+	if data.Metadata != "" {
+		provider, err = models.NewSAMLProvider(companyKey, data.Metadata)
+		if err != nil {
+			badRequest(res, err.Error())
+			return
+		}
+	} else if err != nil {
+		badRequest(res, "metadata: This field is required.")
+		return
+	}
+
+	provider.Enforced = data.Enforced
+	if _, err := provider.Put(ctx); err != nil {
+		log.Errorf(ctx, "failed to save saml provider: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditSAMLUpdated, provider.EntityID, nil, provider)
+
+	renderer.JSON(res, http.StatusOK, newSAMLProviderResponse(company, provider))
+}
+
+func deleteSAMLProviderHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	if err := nds.Delete(ctx, models.NewSAMLProviderKey(ctx, company.Key(ctx))); err != nil {
+		log.Errorf(ctx, "failed to delete saml provider: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditSAMLDeleted, company.Subdomain, nil, nil)
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func googleSignInHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	state, nonce := utils.UUID4(), utils.UUID4()
+	location := req.FormValue("r")
+	if !isLocalPath(location) {
+		location = "/"
+	}
+
+	session := sessions.GetSession(req)
+	session.Set(googleStateSessionKey, state)
+	session.Set(googleNonceSessionKey, nonce)
+	session.Set(googleReturnSessionKey, location)
+
+	redirectURL := integrations.GetSignInAuthURL(
+		fmt.Sprintf("%s,%s", company.Subdomain, state),
+		nonce, company.GoogleHostedDomain,
+	)
+	http.Redirect(res, req, redirectURL, http.StatusFound)
+}
+
+// Google redirects users to the main domain with
+// state=SUBDOMAIN,STATE at which point they get redirected to the
+// team handler where we have access to their session.
+func googleSignInCallbackHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	segments := strings.SplitN(req.FormValue("state"), ",", 2)
+	if len(segments) <= 1 {
+		notFound(res)
+		return
+	}
+
+	location := ReverseRoute("team-sign-in-google-callback").
+		Subdomain(segments[0]).
+		Query("state", segments[1]).
+		Query("code", req.FormValue("code")).
+		Query("error", req.FormValue("error")).
+		Build()
+
+	http.Redirect(res, req, location, http.StatusFound)
+}
+
+func googleSignInTeamHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	templateCtx := newSignInTemplateContext(req)
+	fail := func(message string) {
+		templateCtx.Error = message
+		renderer.HTML(res, http.StatusBadRequest, "sign-in", templateCtx)
+	}
+
+	session := sessions.GetSession(req)
+	state, _ := session.Get(googleStateSessionKey).(string)
+	nonce, _ := session.Get(googleNonceSessionKey).(string)
+	location, _ := session.Get(googleReturnSessionKey).(string)
+	session.Delete(googleStateSessionKey)
+	session.Delete(googleNonceSessionKey)
+	session.Delete(googleReturnSessionKey)
+
+	if state == "" || req.FormValue("state") != state {
+		fail(googleFailedMessage)
+		return
+	}
+
+	if req.FormValue("error") != "" {
+		fail("Signing in with Google was canceled.")
+		return
+	}
+
+	rawToken, err := integrations.ExchangeSignInCode(ctx, req.FormValue("code"))
+	if err != nil {
+		log.Warningf(ctx, "failed to exchange google sign in code: %v", err)
+		fail(googleFailedMessage)
+		return
+	}
+
+	token, err := integrations.VerifyGoogleIDToken(ctx, rawToken, nonce)
+	if err != nil {
+		log.Warningf(ctx, "rejected google id token: %v", err)
+		fail(googleFailedMessage)
+		return
+	}
+
+	if company.GoogleHostedDomain != "" && !strings.EqualFold(token.HostedDomain, company.GoogleHostedDomain) {
+		fail(fmt.Sprintf("Please sign in using your %s Google account.", company.GoogleHostedDomain))
+		return
+	}
+
+	user, err := models.GetUser(ctx, company.Key(ctx), token.Email)
+	if err == datastore.ErrNoSuchEntity {
+		fail(fmt.Sprintf("%s is not a member of this team.", token.Email))
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	if user.Deactivated {
+		fail(deactivatedMessage)
+		return
+	}
+
+	if ssoEnforced(ctx, user) {
+		fail(ssoRequiredMessage)
+		return
+	}
+
+	signIn(res, req, user, location, false)
+}
+
+type googleSettingsResponse struct {
+	HostedDomain string `json:"hostedDomain"`
+}
+
+func googleSettingsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	renderer.JSON(res, http.StatusOK, googleSettingsResponse{company.GoogleHostedDomain})
+}
+
+func updateGoogleSettingsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		HostedDomain string `json:"hostedDomain" validate:"MaxLength:253"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	domain := strings.ToLower(strings.TrimSpace(data.HostedDomain))
+	if domain != "" && !strings.Contains(domain, ".") {
+		badRequest(res, "hostedDomain: Please enter a valid domain name.")
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	previousDomain := company.GoogleHostedDomain
+	company.GoogleHostedDomain = domain
+	if _, err := company.Put(ctx); err != nil {
+		log.Errorf(ctx, "failed to update google settings: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditGoogleSignInUpdated, company.Subdomain, previousDomain, domain)
+
+	renderer.JSON(res, http.StatusOK, googleSettingsResponse{company.GoogleHostedDomain})
+}
@@ -2,17 +2,20 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"html/template"
 	"net/http"
 	"strconv"
+	"strings"
 	"teamzones/forms"
 	"teamzones/models"
+	"time"
 
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/channel"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 
-	"github.com/goincremental/negroni-sessions"
 	"github.com/gorilla/context"
 	"github.com/qedus/nds"
 
@@ -24,16 +27,19 @@ func init() {
 	GET(appRouter, "invite", "/invite", dashboardHandler)
 	GET(appRouter, "current-profile", "/profile", dashboardHandler)
 	GET(appRouter, "teammate-profile", "/profile/:email", dashboardHandler)
+	GET(appRouter, "group", "/groups/:id", groupDashboardHandler)
 	GET(appRouter, "meetings", "/meetings/", dashboardHandler)
 	GET(appRouter, "meeting", "/meetings/:id", dashboardHandler)
 	GET(appRouter, "integrations-calendar", "/integrations/google-calendar", dashboardHandler)
 	GET(appRouter, "settings-team", "/settings/team", dashboardHandler)
 	GET(appRouter, "settings-billing", "/settings/billing", dashboardHandler)
-	ALL(appRouter, "team-sign-up", "/sign-up/:invite", teamSignUpHandler)
-	ALL(appRouter, "team-sign-in", "/sign-in/", signInHandler)
+	ALL(appRouter, "team-sign-up", "/sign-up/:invite", teamSignUpHandler, Everyone)
+	ALL(appRouter, "team-sign-in", "/sign-in/", signInHandler, Everyone)
+	ALL(appRouter, "team-sign-in-link", "/sign-in/link", signInLinkHandler, Everyone)
+	ALL(appRouter, "team-sign-in-link-consume", "/sign-in/link/:token", consumeSignInLinkHandler, Everyone)
 	GET(appRouter, "team-sign-out", "/sign-out/", signOutHandler)
-	ALL(appRouter, "team-recover-password", "/recover-password/", recoverPasswordHandler)
-	ALL(appRouter, "team-reset-password", "/reset-password/:token", resetPasswordHandler)
+	ALL(appRouter, "team-recover-password", "/recover-password/", recoverPasswordHandler, Everyone)
+	ALL(appRouter, "team-reset-password", "/reset-password/:token", resetPasswordHandler, Everyone)
 }
 
 type integrationsPayload struct {
@@ -41,21 +47,63 @@ type integrationsPayload struct {
 }
 
 type dashboardPayload struct {
-	Suspended bool            `json:"suspended"`
-	Company   *models.Company `json:"company"`
-	User      *models.User    `json:"user"`
-	Team      []models.User   `json:"team"`
-	ChanToken string          `json:"channelToken"`
+	Suspended     bool                   `json:"suspended"`
+	Company       *models.Company        `json:"company"`
+	User          *models.User           `json:"user"`
+	Team          []models.User          `json:"team"`
+	ProfileFields []*models.ProfileField `json:"profileFields"`
+	Groups        []*models.Group        `json:"groups"`
+	Group         *models.Group          `json:"group"`
+	ChanToken     string                 `json:"channelToken"`
+	CSRFToken     string                 `json:"csrfToken"`
 
 	Integrations integrationsPayload `json:"integrationStates"`
 }
 
 func dashboardHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	var users []models.User
+	var group *models.Group
+	if groupID := req.FormValue("group"); groupID != "" {
+		var ok bool
+		if group, ok = getGroup(res, req, groupID); !ok {
+			return
+		}
+	}
+
+	renderDashboard(res, req, group)
+}
+
+// groupDashboardHandler renders the dashboard showing only the members
+// of a Group.
+func groupDashboardHandler(res http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+	group, ok := getGroup(res, req, ps.ByName("id"))
+	if !ok {
+		return
+	}
 
+	renderDashboard(res, req, group)
+}
+
+// renderDashboard renders the dashboard for the current user.  The
+// team is narrowed down to group's members unless group is nil.
+func renderDashboard(res http.ResponseWriter, req *http.Request, group *models.Group) {
 	ctx := appengine.NewContext(req)
 	company := context.Get(req, companyCtxKey).(*models.Company)
-	if _, err := models.FindUsers(company.Key(ctx)).GetAll(ctx, &users); err != nil {
+	users, err := models.GetActiveUsers(ctx, company.Key(ctx))
+	if err != nil {
+		panic(err)
+	}
+
+	if group != nil {
+		users = groupMembers(users, group)
+	}
+
+	fields, err := models.GetProfileFields(ctx, company.Key(ctx))
+	if err != nil {
+		panic(err)
+	}
+
+	groups, err := models.GetGroups(ctx, company.Key(ctx))
+	if err != nil {
 		panic(err)
 	}
 
@@ -68,11 +116,15 @@ func dashboardHandler(res http.ResponseWriter, req *http.Request, _ httprouter.P
 	}
 
 	data, err := json.Marshal(dashboardPayload{
-		Suspended: company.Suspended(),
-		Company:   company,
-		User:      user,
-		Team:      users,
-		ChanToken: token,
+		Suspended:     company.Suspended(),
+		Company:       company,
+		User:          user,
+		Team:          teamView(users, user, fields, ""),
+		ProfileFields: fields,
+		Groups:        groups,
+		Group:         group,
+		ChanToken:     token,
+		CSRFToken:     csrfToken(req),
 		Integrations: integrationsPayload{
 			GCalendar: user.GCalendarToken != nil,
 		},
@@ -141,7 +193,7 @@ func teamSignUpHandler(res http.ResponseWriter, req *http.Request, ps httprouter
 		forms.Field{
 			Name:        "password",
 			Label:       "Password",
-			Validators:  []forms.Validator{forms.MinLength(6)},
+			Validators:  []forms.Validator{company.PasswordPolicy.Validate},
 			HideLabel:   true,
 			Placeholder: "Password",
 			Attributes:  map[string]string{"class": "input"},
@@ -153,6 +205,21 @@ func teamSignUpHandler(res http.ResponseWriter, req *http.Request, ps httprouter
 		},
 	}
 
+	if invite.BoundEmail() {
+		form.Email.Attributes["readonly"] = "readonly"
+	}
+
+	if invite.AllowedDomain != "" {
+		form.Email.Placeholder = "Email @" + invite.AllowedDomain
+		form.Email.Validators = append(form.Email.Validators, func(email string) error {
+			if !invite.AllowsEmail(email) {
+				return models.ErrInviteDomain
+			}
+
+			return nil
+		})
+	}
+
 	data := struct {
 		Company *models.Company
 		Form    *teamSignUpForm
@@ -164,32 +231,68 @@ func teamSignUpHandler(res http.ResponseWriter, req *http.Request, ps httprouter
 	}
 
 	if req.Method == http.MethodPost {
+		// The submitted address is ignored when the invite is bound
+		// to the one that it was sent to.
+		if invite.BoundEmail() {
+			req.ParseForm()
+			req.Form.Set("email", invite.Email)
+		}
+
 		if !forms.Bind(req, &form) {
 			renderer.HTML(res, http.StatusBadRequest, "team-sign-up", data)
 			return
 		}
 
-		if company.SeatsLeft(ctx) <= 0 {
+		// Timezones set by whoever sent the invite take precedence
+		// over the one detected by the browser.
+		if invite.Timezone != "" {
+			form.Timezone.Value = invite.Timezone
+		}
+
+		// An individual invite already holds on to the seat
+		// that it's about to fill.
+		seatsLeft := company.SeatsLeft(ctx)
+		if !invite.Bulk {
+			seatsLeft++
+		}
+
+		if seatsLeft <= 0 {
 			data.Error = "This team has reached its member limit. Please contact your account owner."
 			renderer.HTML(res, http.StatusBadRequest, "team-sign-up", data)
 			return
 		}
 
+		// Following an invite proves ownership of the address
+		// that it was sent to.
+		unverified := invite.Bulk || !strings.EqualFold(form.Email.Value, invite.Email)
+
 		ctx := appengine.NewContext(req)
-		u, err := models.CreateUser(
+		u, err := models.CreateInvitedUser(
 			ctx,
 			companyKey,
+			inviteID,
 			form.FirstName.Value,
 			form.LastName.Value,
 			form.Email.Value,
 			form.Password.Value,
 			form.Timezone.Value,
+			unverified,
 		)
 
 		switch err {
 		case nil:
-			if !invite.Bulk {
-				models.DeleteInvite(ctx, companyKey, inviteID)
+			if invite.Role != "" && invite.Role != models.RoleUser {
+				if _, err := models.SetRole(ctx, u.Key(ctx), invite.Role); err != nil {
+					log.Errorf(ctx, "failed to assign invited role: %v", err)
+				}
+			}
+
+			if err := models.AddGroupMembers(ctx, companyKey, invite.Groups, u.Email); err != nil {
+				log.Errorf(ctx, "failed to add invitee to groups: %v", err)
+			}
+
+			if unverified {
+				sendVerificationEmail.Call(ctx, companyKey, u.Email)
 			}
 
 			notifyMemberAdded.Call(ctx, companyKey, u.Key(ctx))
@@ -198,10 +301,21 @@ func teamSignUpHandler(res http.ResponseWriter, req *http.Request, ps httprouter
 				Build()
 			http.Redirect(res, req, location, http.StatusTemporaryRedirect)
 			return
-		case models.ErrUserExists:
+		case models.ErrUserExists, models.ErrInviteDomain:
 			form.Email.Errors = []string{err.Error()}
 			renderer.HTML(res, http.StatusBadRequest, "team-sign-up", data)
 			return
+		case models.ErrAccountExists:
+			form.Password.Errors = []string{err.Error()}
+			renderer.HTML(res, http.StatusBadRequest, "team-sign-up", data)
+			return
+		case models.ErrInviteExpired, models.ErrInviteUsedUp:
+			data.Error = err.Error()
+			renderer.HTML(res, http.StatusBadRequest, "team-sign-up", data)
+			return
+		case datastore.ErrNoSuchEntity:
+			notFound(res)
+			return
 		default:
 			log.Criticalf(ctx, "failed to create uesr: %v", err)
 		}
@@ -212,13 +326,13 @@ func teamSignUpHandler(res http.ResponseWriter, req *http.Request, ps httprouter
 }
 
 type signInForm struct {
-	Email    forms.Field
-	Password forms.Field
+	Email      forms.Field
+	Password   forms.Field
+	RememberMe forms.Field
 }
 
-func signInHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	company := context.Get(req, companyCtxKey).(*models.Company)
-	form := signInForm{
+func newSignInForm() *signInForm {
+	return &signInForm{
 		forms.Field{
 			Name:        "email",
 			Label:       "E-mail address",
@@ -234,39 +348,86 @@ func signInHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Para
 			HideLabel:   true,
 			Attributes:  map[string]string{"class": "input"},
 		},
+		forms.Field{
+			Name:     "remember-me",
+			Label:    "Keep me signed in",
+			Optional: true,
+		},
+	}
+}
+
+type signInTemplateContext struct {
+	Company *models.Company
+	Form    *signInForm
+	SSO     bool
+	Error   string
+}
+
+func newSignInTemplateContext(req *http.Request) *signInTemplateContext {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	_, err := models.GetSAMLProvider(ctx, company.Key(ctx))
+	return &signInTemplateContext{
+		Company: company,
+		Form:    newSignInForm(),
+		SSO:     err == nil,
 	}
+}
 
-	templateCtx := struct {
-		Company *models.Company
-		Form    *signInForm
-	}{company, &form}
+func signInHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	templateCtx := newSignInTemplateContext(req)
+	form := templateCtx.Form
 
 	if req.Method == http.MethodPost {
-		if !forms.Bind(req, &form) {
+		if !forms.Bind(req, form) {
 			renderer.HTML(res, http.StatusBadRequest, "sign-in", templateCtx)
 			return
 		}
 
-		ctx := appengine.NewContext(req)
+		if wait := signInWait(ctx, req, company, form.Email.Value); wait > 0 {
+			templateCtx.Error = lockedOutMessage(wait)
+			renderer.HTML(res, http.StatusTooManyRequests, "sign-in", templateCtx)
+			return
+		}
+
 		user, err := models.Authenticate(
 			ctx,
-			models.NewCompanyKey(ctx, company.Subdomain),
+			company.Key(ctx),
 			form.Email.Value,
 			form.Password.Value,
 		)
 
 		switch err {
 		case nil:
-			session := sessions.GetSession(req)
-			session.Set(uidSessionKey, user.Email)
-			path := req.FormValue("r")
-			if path == "" {
-				path = "/"
+			if user.Locked() {
+				templateCtx.Error = lockedOutMessage(user.LockedUntil.Sub(time.Now()))
+				renderer.HTML(res, http.StatusTooManyRequests, "sign-in", templateCtx)
+				return
+			}
+
+			if ssoEnforced(ctx, user) {
+				templateCtx.Error = ssoRequiredMessage
+				renderer.HTML(res, http.StatusBadRequest, "sign-in", templateCtx)
+				return
+			}
+
+			signInAccountLimiter.Reset(ctx, accountID(company, user.Email))
+			if user.PasswordResetRequired {
+				if !throttle(ctx, "forced-reset:"+accountID(company, user.Email), passwordResetEmailInterval) {
+					createRecoveryToken.Call(ctx, company.Key(ctx), user.Email)
+				}
+
+				templateCtx.Error = passwordResetRequiredMessage
+				renderer.HTML(res, http.StatusForbidden, "sign-in", templateCtx)
+				return
 			}
 
-			http.Redirect(res, req, path, http.StatusFound)
+			signIn(res, req, user, req.FormValue("r"), form.RememberMe.Value != "")
 			return
 		case models.ErrInvalidCredentials:
+			signInFailed(ctx, req, company, form.Email.Value)
 			renderer.HTML(res, http.StatusBadRequest, "sign-in", templateCtx)
 			return
 		default:
@@ -277,9 +438,92 @@ func signInHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Para
 	renderer.HTML(res, http.StatusOK, "sign-in", templateCtx)
 }
 
+func signInLinkHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	form := struct {
+		Email forms.Field
+	}{
+		forms.Field{
+			Name:        "email",
+			Label:       "Email",
+			Validators:  []forms.Validator{forms.Email},
+			Placeholder: "Email",
+			HideLabel:   true,
+			Attributes:  map[string]string{"class": "input"},
+		},
+	}
+
+	if req.Method == http.MethodPost {
+		if !forms.Bind(req, &form) {
+			renderer.HTML(res, http.StatusBadRequest, "sign-in-link", form)
+			return
+		}
+
+		ctx := appengine.NewContext(req)
+		company := context.Get(req, companyCtxKey).(*models.Company)
+		email := strings.ToLower(form.Email.Value)
+		if wait := recoveryWait(ctx, req, company, email); wait > 0 {
+			form.Email.Errors = []string{lockedOutMessage(wait)}
+			renderer.HTML(res, http.StatusTooManyRequests, "sign-in-link", form)
+			return
+		}
+
+		throttlingKey := fmt.Sprintf("sign-in-link:%s:%s", company.Subdomain, email)
+		if !throttle(ctx, throttlingKey, time.Minute) {
+			returnPath := req.FormValue("r")
+			if !isLocalPath(returnPath) {
+				returnPath = ""
+			}
+
+			sendSignInLink.Call(ctx, company.Key(ctx), email, returnPath)
+		}
+
+		// The same page is rendered regardless of whether or not a
+		// link was sent so as not to reveal who is a member.
+		renderer.HTML(res, http.StatusOK, "sign-in-link-success", nil)
+		return
+	}
+
+	renderer.HTML(res, http.StatusOK, "sign-in-link", form)
+}
+
+// consumeSignInLinkHandler asks for confirmation before signing the
+// user in since some mail clients follow links in order to scan them.
+func consumeSignInLinkHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	if req.Method != http.MethodPost {
+		renderer.HTML(res, http.StatusOK, "sign-in-link-confirm", nil)
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	templateCtx := newSignInTemplateContext(req)
+	token, err := models.ConsumeSignInToken(ctx, company.Key(ctx), params.ByName("token"))
+	if err == datastore.ErrNoSuchEntity || err == models.ErrSignInTokenExpired {
+		templateCtx.Error = "This sign in link is invalid or has expired."
+		renderer.HTML(res, http.StatusBadRequest, "sign-in", templateCtx)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	var user models.User
+	if err := nds.Get(ctx, token.User, &user); err != nil {
+		templateCtx.Error = "This sign in link is invalid or has expired."
+		renderer.HTML(res, http.StatusBadRequest, "sign-in", templateCtx)
+		return
+	}
+
+	if ssoEnforced(ctx, &user) {
+		templateCtx.Error = ssoRequiredMessage
+		renderer.HTML(res, http.StatusBadRequest, "sign-in", templateCtx)
+		return
+	}
+
+	signIn(res, req, &user, req.FormValue("r"), false)
+}
+
 func signOutHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
-	session := sessions.GetSession(req)
-	session.Delete(uidSessionKey)
+	endSession(req)
 	http.Redirect(res, req, ReverseSimple("team-sign-in"), http.StatusFound)
 }
 
@@ -305,6 +549,12 @@ func recoverPasswordHandler(res http.ResponseWriter, req *http.Request, _ httpro
 
 		ctx := appengine.NewContext(req)
 		company := context.Get(req, companyCtxKey).(*models.Company)
+		if wait := recoveryWait(ctx, req, company, form.Email.Value); wait > 0 {
+			form.Email.Errors = []string{lockedOutMessage(wait)}
+			renderer.HTML(res, http.StatusTooManyRequests, "recover-password", form)
+			return
+		}
+
 		companyKey := company.Key(ctx)
 		createRecoveryToken.Call(ctx, companyKey, form.Email.Value)
 		renderer.HTML(res, http.StatusOK, "recover-password-success", nil)
@@ -337,7 +587,7 @@ func resetPasswordHandler(res http.ResponseWriter, req *http.Request, params htt
 		forms.Field{
 			Name:        "password",
 			Label:       "Password",
-			Validators:  []forms.Validator{forms.MinLength(6)},
+			Validators:  []forms.Validator{company.PasswordPolicy.Validate},
 			Placeholder: "Password",
 			HideLabel:   true,
 			Attributes:  map[string]string{"class": "input"},
@@ -350,11 +600,22 @@ func resetPasswordHandler(res http.ResponseWriter, req *http.Request, params htt
 			return
 		}
 
-		user.SetPassword(form.Password.Value)
-		if _, err := user.Put(ctx); err != nil {
+		// Proving ownership of the e-mail address lifts lockouts.
+		user.LockedUntil = time.Time{}
+		user.PasswordResetRequired = false
+		if err := models.ResetPassword(ctx, &user, form.Password.Value); err != nil {
 			panic(err)
 		}
 
+		signInAccountLimiter.Unlock(ctx, accountID(company, user.Email))
+
+		// Sign out everywhere in case the old password was
+		// compromised.  The password is shared by every team
+		// that the User's Account is a member of.
+		if err := models.RevokeAccountSessions(ctx, &user); err != nil {
+			log.Errorf(ctx, "failed to revoke sessions: %v", err)
+		}
+
 		nds.Delete(ctx, models.NewRecoveryTokenKey(ctx, companyKey, tokenID))
 		location := ReverseRoute("team-sign-in").Build()
 		http.Redirect(res, req, location, http.StatusFound)
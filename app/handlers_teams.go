@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"net/http"
+	"teamzones/models"
+
+	"github.com/gorilla/context"
+	"github.com/qedus/nds"
+
+	netcontext "golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+func init() {
+	GET(appRouter, "teams", "/api/teams", teamsHandler)
+	POST(appRouter, "teams-switch", "/api/teams/:subdomain/switch", switchTeamHandler, Everyone)
+	ALL(appRouter, "team-sign-in-switch", "/sign-in/switch/:token", consumeSwitchTokenHandler, Everyone)
+}
+
+type teamResponse struct {
+	Name      string `json:"name"`
+	Subdomain string `json:"subdomain"`
+	Role      string `json:"role"`
+	Current   bool   `json:"current"`
+}
+
+// teamsHandler lists all the teams that the current user's e-mail
+// address is a member of.
+func teamsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	user := context.Get(req, userCtxKey).(*models.User)
+	memberships, err := models.GetMemberships(ctx, user.Email)
+	if err != nil {
+		log.Errorf(ctx, "failed to list memberships: %v", err)
+		serverError(res)
+		return
+	}
+
+	response := make([]teamResponse, len(memberships))
+	for i, membership := range memberships {
+		response[i] = teamResponse{
+			Name:      membership.Company.Name,
+			Subdomain: membership.Company.Subdomain,
+			Role:      membership.User.Role,
+			Current:   membership.Company.Subdomain == company.Subdomain,
+		}
+	}
+
+	renderer.JSON(res, http.StatusOK, response)
+}
+
+type switchTeamResponse struct {
+	Location string `json:"location"`
+}
+
+// switchNeedsSignIn returns true if user can't be handed over to
+// target without signing in.  Only Memberships of the same Account
+// are the same person, and locked Users and ones that have to choose
+// a new password must go through the sign in page regardless.
+func switchNeedsSignIn(user, target *models.User) bool {
+	return !models.SameAccount(user, target) || target.Locked() || target.PasswordResetRequired
+}
+
+// switchTeamHandler hands the current user over to one of their other
+// teams.  Memberships of the same Account share its credentials so
+// the user isn't asked for their password again.  The response
+// contains a URL on the other team's subdomain that signs them in
+// there once they confirm it.  Memberships that aren't linked to the
+// user's Account or that have to sign in using SSO get that team's
+// sign in page instead.
+func switchTeamHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	user := context.Get(req, userCtxKey).(*models.User)
+	subdomain := params.ByName("subdomain")
+	if subdomain == company.Subdomain {
+		badRequest(res, "You are already signed in to this team.")
+		return
+	}
+
+	membership, err := models.GetMembership(ctx, subdomain, user.Email)
+	if err == datastore.ErrNoSuchEntity {
+		notFound(res)
+		return
+	} else if err != nil {
+		log.Errorf(ctx, "failed to get membership: %v", err)
+		serverError(res)
+		return
+	}
+
+	target := membership.User
+	if switchNeedsSignIn(user, target) || ssoEnforced(ctx, target) {
+		renderer.JSON(res, http.StatusOK, switchTeamResponse{
+			Location: ReverseRoute("team-sign-in").
+				Subdomain(subdomain).
+				Build(),
+		})
+		return
+	}
+
+	token, _, err := models.CreateSwitchToken(ctx, target.Company, target.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to create switch token: %v", err)
+		serverError(res)
+		return
+	}
+
+	renderer.JSON(res, http.StatusOK, switchTeamResponse{
+		Location: ReverseRoute("team-sign-in-switch").
+			Param("token", token).
+			Subdomain(subdomain).
+			Build(),
+	})
+}
+
+// switchTokenUser returns the User that a switch token hands over to
+// if they can still be signed in using it.
+func switchTokenUser(ctx netcontext.Context, token *models.SignInToken) (*models.User, bool) {
+	if !token.Switch {
+		return nil, false
+	}
+
+	var user models.User
+	if err := nds.Get(ctx, token.User, &user); err != nil || user.Deactivated || user.Account == nil {
+		return nil, false
+	}
+
+	return &user, true
+}
+
+// consumeSwitchTokenHandler signs in a user that was handed over from
+// another Membership of their Account.  The link is only used up once
+// it's confirmed using a POST request so that link scanners can't use
+// it up and so that whoever follows a forwarded link can see whose
+// account it would sign them in to.  Two-factor authentication still
+// has to be completed separately for each team.
+func consumeSwitchTokenHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	templateCtx := newSignInTemplateContext(req)
+	invalid := func() {
+		templateCtx.Error = "This link is invalid or has expired."
+		renderer.HTML(res, http.StatusBadRequest, "sign-in", templateCtx)
+	}
+
+	consume := models.GetSignInToken
+	if req.Method == http.MethodPost {
+		consume = models.ConsumeSignInToken
+	}
+
+	token, err := consume(ctx, company.Key(ctx), params.ByName("token"))
+	if err == datastore.ErrNoSuchEntity || err == models.ErrSignInTokenExpired {
+		invalid()
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	user, ok := switchTokenUser(ctx, token)
+	if !ok {
+		invalid()
+		return
+	}
+
+	if req.Method != http.MethodPost {
+		renderer.HTML(res, http.StatusOK, "sign-in-switch-confirm", struct {
+			Company *models.Company
+			Email   string
+		}{company, user.Email})
+		return
+	}
+
+	signIn(res, req, user, "/", false)
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"teamzones/models"
+	"testing"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestSwitchNeedsSignIn(t *testing.T) {
+	t.Parallel()
+
+	account := new(datastore.Key)
+	user := &models.User{Account: account}
+	cases := []struct {
+		user     *models.User
+		target   *models.User
+		expected bool
+	}{
+		{user, &models.User{Account: account}, false},
+		{user, &models.User{Password: "hash"}, true},
+		{&models.User{Password: "hash"}, &models.User{Account: account}, true},
+		{user, &models.User{Account: account, LockedUntil: time.Now().Add(time.Hour)}, true},
+		{user, &models.User{Account: account, LockedUntil: time.Now().Add(-time.Hour)}, false},
+		{user, &models.User{Account: account, PasswordResetRequired: true}, true},
+	}
+
+	for i, test := range cases {
+		if switchNeedsSignIn(test.user, test.target) != test.expected {
+			t.Errorf("case %d: expected %v", i, test.expected)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"teamzones/forms"
+	"teamzones/models"
+	"time"
+
+	"github.com/gorilla/context"
+	"github.com/qedus/nds"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+const (
+	maxAPITokenDays = 365
+)
+
+// apiTokenScopePaths maps each scope to the API paths that it grants
+// access to.  Everything else, including account security settings
+// and token management itself, requires a browser session.
+var apiTokenScopePaths = map[string][]string{
+	models.ScopeProfile:  {"/api/profile", "/api/upload", "/api/avatar"},
+	models.ScopeTeam:     {"/api/users/", "/api/deactivated-users", "/api/team", "/api/profile-fields", "/api/groups"},
+	models.ScopeInvites:  {"/api/invites", "/api/bulk-invites", "/api/invite-jobs"},
+	models.ScopeMeetings: {"/api/integrations/gcalendar/"},
+}
+
+func init() {
+	GET(
+		appRouter,
+		"tokens", "/api/tokens",
+		apiTokensHandler,
+	)
+	POST(
+		appRouter,
+		"tokens-create", "/api/tokens",
+		createAPITokenHandler, Everyone,
+	)
+	DELETE(
+		appRouter,
+		"tokens-revoke", "/api/tokens/:id",
+		revokeAPITokenHandler, Everyone,
+	)
+}
+
+// bearerToken returns the token from the request's Authorization
+// header, if any.
+func bearerToken(req *http.Request) (string, bool) {
+	header := req.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+
+	return strings.TrimSpace(header[len("Bearer "):]), true
+}
+
+// isTokenRequest returns true if the current request was
+// authenticated using an APIToken rather than a browser session.
+func isTokenRequest(req *http.Request) bool {
+	_, ok := context.Get(req, apiTokenCtxKey).(*models.APIToken)
+	return ok
+}
+
+func apiTokenAllows(token *models.APIToken, path string) bool {
+	for _, scope := range token.Scopes {
+		if isSubpath(path, apiTokenScopePaths[scope]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticateToken is the part of Auth that handles requests that
+// carry an APIToken.  Session cookies are ignored for these requests.
+func authenticateToken(res http.ResponseWriter, req *http.Request, next http.HandlerFunc, plain string) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	token, err := models.GetAPIToken(ctx, company.Key(ctx), plain)
+	switch err {
+	case nil:
+	case datastore.ErrNoSuchEntity, models.ErrAPITokenExpired:
+		res.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(res, "invalid token", http.StatusUnauthorized)
+		return
+	default:
+		panic(err)
+	}
+
+	if !apiTokenAllows(token, req.URL.Path) {
+		res.Header().Set("WWW-Authenticate", `Bearer error="insufficient_scope"`)
+		forbidden(res)
+		return
+	}
+
+	var user models.User
+	if err := nds.Get(ctx, token.User, &user); err != nil {
+		if err == datastore.ErrNoSuchEntity {
+			http.Error(res, "invalid token", http.StatusUnauthorized)
+			return
+		}
+
+		panic(err)
+	} else if user.Deactivated {
+		http.Error(res, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	if token.Touch(time.Now()) {
+		if _, err := token.Put(ctx); err != nil {
+			log.Warningf(ctx, "failed to touch api token: %v", err)
+		}
+	}
+
+	context.Set(req, userCtxKey, &user)
+	context.Set(req, apiTokenCtxKey, token)
+	defer context.Clear(req)
+	next(res, req)
+}
+
+func apiTokensHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	tokens, err := models.GetAPITokens(ctx, user.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to list api tokens: %v", err)
+		serverError(res)
+		return
+	}
+
+	renderer.JSON(res, http.StatusOK, tokens)
+}
+
+type createAPITokenResponse struct {
+	*models.APIToken
+	Token string `json:"token"`
+}
+
+func createAPITokenHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		Name          string   `json:"name" validate:"MinLength:1,MaxLength:50"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expiresInDays"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	if len(data.Scopes) == 0 {
+		badRequest(res, "Scopes: Select at least one scope.")
+		return
+	}
+
+	if data.ExpiresInDays < 1 || data.ExpiresInDays > maxAPITokenDays {
+		badRequest(res, "ExpiresInDays: Tokens must expire within a year.")
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	ttl := time.Duration(data.ExpiresInDays) * 24 * time.Hour
+	plain, token, err := models.CreateAPIToken(ctx, user, data.Name, data.Scopes, ttl)
+	if err != nil {
+		if err == models.ErrInvalidScope {
+			badRequest(res, err.Error())
+			return
+		}
+
+		log.Errorf(ctx, "failed to create api token: %v", err)
+		serverError(res)
+		return
+	}
+
+	renderer.JSON(res, http.StatusCreated, createAPITokenResponse{token, plain})
+}
+
+func revokeAPITokenHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	err := models.RevokeAPIToken(ctx, user.Key(ctx), params.ByName("id"))
+	switch err {
+	case nil:
+		res.WriteHeader(http.StatusNoContent)
+	case datastore.ErrNoSuchEntity:
+		notFound(res)
+	default:
+		log.Errorf(ctx, "failed to revoke api token: %v", err)
+		serverError(res)
+	}
+}
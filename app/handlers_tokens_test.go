@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/http"
+	"teamzones/models"
+	"testing"
+)
+
+func TestBearerToken(t *testing.T) {
+	t.Parallel()
+
+	req, _ := http.NewRequest("GET", "/api/profile", nil)
+	if _, ok := bearerToken(req); ok {
+		t.Errorf("expected request without a token to be rejected")
+	}
+
+	req.Header.Set("Authorization", "Basic abc")
+	if _, ok := bearerToken(req); ok {
+		t.Errorf("expected basic auth to be ignored")
+	}
+
+	req.Header.Set("Authorization", "Bearer tz_abc")
+	if token, ok := bearerToken(req); !ok || token != "tz_abc" {
+		t.Errorf("expected bearer token to be parsed, got %q", token)
+	}
+}
+
+func TestAPITokenAllows(t *testing.T) {
+	t.Parallel()
+
+	token := &models.APIToken{Scopes: []string{models.ScopeInvites}}
+	cases := []struct {
+		path     string
+		expected bool
+	}{
+		{"/api/invites", true},
+		{"/api/bulk-invites/123", true},
+		{"/api/profile", false},
+		{"/api/tokens", false},
+		{"/api/two-factor/disable", false},
+		{"/settings/team", false},
+	}
+
+	for _, test := range cases {
+		if apiTokenAllows(token, test.path) != test.expected {
+			t.Errorf("expected access to %s to be %v", test.path, test.expected)
+		}
+	}
+}
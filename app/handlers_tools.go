@@ -14,6 +14,8 @@ import (
 
 func init() {
 	GET(siteRouter, "tools-provision", "/_tools/provision", provisionHandler)
+	GET(siteRouter, "tools-reindex-emails", "/_tools/reindex-emails", reindexEmailsHandler)
+	GET(siteRouter, "tools-delete-archives", "/_tools/delete-archives", deleteArchivesHandler)
 }
 
 func provisionHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
@@ -21,7 +23,7 @@ func provisionHandler(res http.ResponseWriter, req *http.Request, _ httprouter.P
 	company := models.NewCompany("demo", "demo")
 	user, err := models.CreateMainUser(
 		ctx, company,
-		"Peter", "Parker", "peter.parker@example.com", "password", "Europe/Bucharest",
+		"Peter", "Parker", "peter.parker@example.com", "password", "Europe/Bucharest", false,
 	)
 	if err == models.ErrSubdomainTaken {
 		user = company.LookupMainUser(ctx)
@@ -98,6 +100,10 @@ func provisionHandler(res http.ResponseWriter, req *http.Request, _ httprouter.P
 		u.Put(ctx)
 	}
 
+	if err := models.ReindexCompany(ctx, companyKey); err != nil {
+		panic(err)
+	}
+
 	meetings, err := models.FindUpcomingMeetings(user.Key(ctx)).KeysOnly().GetAll(ctx, nil)
 	if err != nil {
 		panic(err)
@@ -107,3 +113,18 @@ func provisionHandler(res http.ResponseWriter, req *http.Request, _ httprouter.P
 		panic(err)
 	}
 }
+
+// reindexEmailsHandler backfills the EmailIndex for every Company.
+func reindexEmailsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	reindexEmails.Call(ctx)
+	res.WriteHeader(http.StatusAccepted)
+}
+
+// deleteArchivesHandler deletes the invoices of closed Companies once
+// they no longer have to be retained.
+func deleteArchivesHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	deleteExpiredArchives.Call(ctx)
+	res.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,362 @@
+package handlers
+
+import (
+	"html/template"
+	"net/http"
+	"teamzones/forms"
+	"teamzones/models"
+	"teamzones/utils"
+	"time"
+
+	"github.com/goincremental/negroni-sessions"
+	"github.com/gorilla/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+const (
+	twoFactorUserSessionKey     = "2fa-user"
+	twoFactorStartedSessionKey  = "2fa-started"
+	twoFactorReturnSessionKey   = "2fa-return"
+	twoFactorRememberSessionKey = "2fa-remember"
+	totpSecretSessionKey        = "2fa-secret"
+
+	// twoFactorTimeout is the amount of time a User has to enter
+	// their code after entering their password.
+	twoFactorTimeout = 5 * time.Minute
+)
+
+var twoFactorPaths = []string{
+	"/two-factor/",
+	"/api/two-factor",
+	"/sign-out",
+}
+
+func init() {
+	ALL(appRouter, "team-sign-in-verify", "/sign-in/verify", signInVerifyHandler, Everyone)
+	ALL(appRouter, "team-two-factor-setup", "/two-factor/setup", twoFactorSetupHandler, Everyone)
+
+	GET(
+		appRouter,
+		"two-factor", "/api/two-factor",
+		twoFactorHandler,
+	)
+	POST(
+		appRouter,
+		"two-factor-disable", "/api/two-factor/disable",
+		disableTwoFactorHandler, Everyone,
+	)
+	POST(
+		appRouter,
+		"two-factor-recovery-codes", "/api/two-factor/recovery-codes",
+		resetRecoveryCodesHandler, Everyone,
+	)
+	POST(
+		appRouter,
+		"two-factor-policy", "/api/two-factor/policy",
+		twoFactorPolicyHandler, models.RoleMain,
+	)
+}
+
+// signIn starts a session for user and redirects them to location.
+// Users that have enrolled in two-factor authentication or that have
+// registered a security key are sent to the verification step instead
+// and the session is only started once they've passed it.
+func signIn(res http.ResponseWriter, req *http.Request, user *models.User, location string, rememberMe bool) {
+	if !isLocalPath(location) {
+		location = "/"
+	}
+
+	ctx := appengine.NewContext(req)
+	hasSecurityKeys, err := models.HasWebAuthnCredentials(ctx, user.Key(ctx))
+	if err != nil {
+		panic(err)
+	}
+
+	session := sessions.GetSession(req)
+	if user.TOTPEnabled || hasSecurityKeys {
+		session.Set(twoFactorUserSessionKey, user.Email)
+		session.Set(twoFactorStartedSessionKey, time.Now().Unix())
+		session.Set(twoFactorReturnSessionKey, location)
+		session.Set(twoFactorRememberSessionKey, rememberMe)
+		http.Redirect(res, req, ReverseSimple("team-sign-in-verify"), http.StatusFound)
+		return
+	}
+
+	startSession(req, user, rememberMe)
+	http.Redirect(res, req, location, http.StatusFound)
+}
+
+func clearTwoFactorSession(session sessions.Session) {
+	session.Delete(twoFactorUserSessionKey)
+	session.Delete(twoFactorStartedSessionKey)
+	session.Delete(twoFactorReturnSessionKey)
+	session.Delete(twoFactorRememberSessionKey)
+}
+
+type signInVerifyTemplateContext struct {
+	Form         *twoFactorCodeForm
+	TOTP         bool
+	SecurityKeys bool
+}
+
+type twoFactorCodeForm struct {
+	Code forms.Field
+}
+
+func newTwoFactorCodeForm() *twoFactorCodeForm {
+	return &twoFactorCodeForm{
+		Code: forms.Field{
+			Name:        "code",
+			Label:       "Authentication code",
+			Placeholder: "123456",
+			HideLabel:   true,
+			Attributes: map[string]string{
+				"class":        "input",
+				"autocomplete": "off",
+				"autofocus":    "autofocus",
+			},
+		},
+	}
+}
+
+func signInVerifyHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	session := sessions.GetSession(req)
+	email, _ := session.Get(twoFactorUserSessionKey).(string)
+	started, _ := session.Get(twoFactorStartedSessionKey).(int64)
+	if email == "" || time.Since(time.Unix(started, 0)) > twoFactorTimeout {
+		clearTwoFactorSession(session)
+		http.Redirect(res, req, ReverseSimple("team-sign-in"), http.StatusFound)
+		return
+	}
+
+	user, err := models.GetUser(ctx, company.Key(ctx), email)
+	if err == datastore.ErrNoSuchEntity {
+		clearTwoFactorSession(session)
+		http.Redirect(res, req, ReverseSimple("team-sign-in"), http.StatusFound)
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	hasSecurityKeys, err := models.HasWebAuthnCredentials(ctx, user.Key(ctx))
+	if err != nil {
+		panic(err)
+	}
+
+	templateCtx := signInVerifyTemplateContext{
+		Form:         newTwoFactorCodeForm(),
+		TOTP:         user.TOTPEnabled,
+		SecurityKeys: hasSecurityKeys,
+	}
+
+	if req.Method == http.MethodPost {
+		form := templateCtx.Form
+		if !forms.Bind(req, form) {
+			renderer.HTML(res, http.StatusBadRequest, "sign-in-verify", templateCtx)
+			return
+		}
+
+		if wait := signInWait(ctx, req, company, user.Email); wait > 0 {
+			form.Code.Errors = []string{lockedOutMessage(wait)}
+			renderer.HTML(res, http.StatusTooManyRequests, "sign-in-verify", templateCtx)
+			return
+		}
+
+		switch err := user.UseSecondFactor(ctx, form.Code.Value, nil); err {
+		case nil:
+		case models.ErrInvalidSecondFactor, models.ErrTOTPNotEnabled:
+			signInFailed(ctx, req, company, user.Email)
+			form.Code.Errors = []string{err.Error()}
+			renderer.HTML(res, http.StatusBadRequest, "sign-in-verify", templateCtx)
+			return
+		default:
+			panic(err)
+		}
+
+		signInAccountLimiter.Reset(ctx, accountID(company, user.Email))
+		location, _ := session.Get(twoFactorReturnSessionKey).(string)
+		rememberMe, _ := session.Get(twoFactorRememberSessionKey).(bool)
+		clearTwoFactorSession(session)
+		startSession(req, user, rememberMe)
+		http.Redirect(res, req, location, http.StatusFound)
+		return
+	}
+
+	renderer.HTML(res, http.StatusOK, "sign-in-verify", templateCtx)
+}
+
+type twoFactorSetupTemplateContext struct {
+	Form            *twoFactorCodeForm
+	Secret          string
+	ProvisioningURI template.URL
+	Required        bool
+	RecoveryCodes   []string
+}
+
+func twoFactorSetupHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	if user.TOTPEnabled {
+		http.Redirect(res, req, "/", http.StatusFound)
+		return
+	}
+
+	// The secret is kept in the session until the User proves that
+	// they've configured their authenticator.
+	session := sessions.GetSession(req)
+	secret, _ := session.Get(totpSecretSessionKey).(string)
+	if secret == "" {
+		var err error
+		if secret, err = utils.NewTOTPSecret(); err != nil {
+			log.Errorf(ctx, "failed to generate totp secret: %v", err)
+			serverError(res)
+			return
+		}
+
+		session.Set(totpSecretSessionKey, secret)
+	}
+
+	templateCtx := twoFactorSetupTemplateContext{
+		Form:            newTwoFactorCodeForm(),
+		Secret:          secret,
+		ProvisioningURI: template.URL(user.TOTPProvisioningURI(secret)),
+		Required:        company.RequireTwoFactor,
+	}
+
+	if req.Method == http.MethodPost {
+		if !forms.Bind(req, templateCtx.Form) {
+			renderer.HTML(res, http.StatusBadRequest, "two-factor-setup", templateCtx)
+			return
+		}
+
+		codes, err := user.EnableTOTP(secret, templateCtx.Form.Code.Value)
+		if err != nil {
+			templateCtx.Form.Code.Errors = []string{err.Error()}
+			renderer.HTML(res, http.StatusBadRequest, "two-factor-setup", templateCtx)
+			return
+		}
+
+		if _, err := user.Put(ctx); err != nil {
+			panic(err)
+		}
+
+		session.Delete(totpSecretSessionKey)
+		templateCtx.RecoveryCodes = codes
+		renderer.HTML(res, http.StatusOK, "two-factor-recovery-codes", templateCtx)
+		return
+	}
+
+	renderer.HTML(res, http.StatusOK, "two-factor-setup", templateCtx)
+}
+
+type twoFactorResponse struct {
+	Enabled           bool   `json:"enabled"`
+	Required          bool   `json:"required"`
+	RecoveryCodesLeft int    `json:"recoveryCodesLeft"`
+	SetupURL          string `json:"setupUrl"`
+}
+
+func twoFactorHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	user := context.Get(req, userCtxKey).(*models.User)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	renderer.JSON(res, http.StatusOK, twoFactorResponse{
+		Enabled:           user.TOTPEnabled,
+		Required:          company.RequireTwoFactor,
+		RecoveryCodesLeft: len(user.RecoveryCodes),
+		SetupURL:          ReverseSimple("team-two-factor-setup"),
+	})
+}
+
+type twoFactorCodeRequest struct {
+	Code string `json:"code" validate:"MinLength:6"`
+}
+
+func disableTwoFactorHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data twoFactorCodeRequest
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	if company.RequireTwoFactor {
+		badRequest(res, "Your team requires two-factor authentication.")
+		return
+	}
+
+	switch err := user.UseSecondFactor(ctx, data.Code, (*models.User).DisableTOTP); err {
+	case nil:
+	case models.ErrInvalidSecondFactor, models.ErrTOTPNotEnabled:
+		badRequest(res, err.Error())
+		return
+	default:
+		log.Errorf(ctx, "failed to disable two-factor authentication: %v", err)
+		serverError(res)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
+
+func resetRecoveryCodesHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data twoFactorCodeRequest
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	var codes []string
+	reset := func(user *models.User) {
+		codes = user.ResetRecoveryCodes()
+	}
+
+	switch err := user.UseSecondFactor(ctx, data.Code, reset); err {
+	case nil:
+	case models.ErrInvalidSecondFactor, models.ErrTOTPNotEnabled:
+		badRequest(res, err.Error())
+		return
+	default:
+		log.Errorf(ctx, "failed to reset recovery codes: %v", err)
+		serverError(res)
+		return
+	}
+
+	renderer.JSON(res, http.StatusOK, codes)
+}
+
+func twoFactorPolicyHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		Required bool `json:"required"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	previous := company.RequireTwoFactor
+	company.RequireTwoFactor = data.Required
+	if _, err := company.Put(ctx); err != nil {
+		log.Errorf(ctx, "failed to update two-factor policy: %v", err)
+		serverError(res)
+		return
+	}
+
+	audit(req, models.AuditTwoFactorPolicy, company.Subdomain, previous, data.Required)
+
+	res.WriteHeader(http.StatusOK)
+}
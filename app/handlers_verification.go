@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"teamzones/models"
+	"teamzones/utils"
+	"time"
+
+	"github.com/gorilla/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+const (
+	emailVerificationTTL = 48 * time.Hour
+
+	// emailVerificationInterval limits how often a User can request
+	// a new confirmation link.
+	emailVerificationInterval = 1 * time.Minute
+
+	emailVerificationFailedMessage = ("This confirmation link is invalid or has " +
+		"expired.  Sign in to request a new one.")
+)
+
+// verificationPaths are the paths that unverified Users may access.
+var verificationPaths = []string{
+	"/verify-email",
+	"/sign-out",
+}
+
+func init() {
+	ALL(appRouter, "team-verify-email", "/verify-email", verifyEmailHandler, Everyone)
+	GET(appRouter, "team-confirm-email", "/confirm-email/:token", confirmEmailHandler)
+}
+
+// emailVerificationKey derives the key that confirmation links are
+// signed with from the application secret so that the secret itself
+// is never used for more than one purpose.
+func emailVerificationKey() []byte {
+	mac := hmac.New(sha256.New, config.Secret.Authentication)
+	mac.Write([]byte("email-verification"))
+	return mac.Sum(nil)
+}
+
+func newEmailVerificationToken(company *models.Company, email string) string {
+	value := company.Subdomain + "\n" + strings.ToLower(email)
+	return utils.SignValue(emailVerificationKey(), value, time.Now().Add(emailVerificationTTL))
+}
+
+// parseEmailVerificationToken returns the e-mail address that a token
+// confirms if it is valid for company.
+func parseEmailVerificationToken(company *models.Company, token string) (string, bool) {
+	value, err := utils.VerifySignedValue(emailVerificationKey(), token, time.Now())
+	if err != nil {
+		return "", false
+	}
+
+	parts := strings.SplitN(value, "\n", 2)
+	if len(parts) != 2 || parts[0] != company.Subdomain {
+		return "", false
+	}
+
+	return parts[1], true
+}
+
+func verifyEmailHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	user := context.Get(req, userCtxKey).(*models.User)
+	if !user.Unverified {
+		http.Redirect(res, req, ReverseSimple("dashboard"), http.StatusFound)
+		return
+	}
+
+	data := struct {
+		User *models.User
+		Sent bool
+	}{user, false}
+
+	if req.Method == http.MethodPost {
+		ctx := appengine.NewContext(req)
+		company := context.Get(req, companyCtxKey).(*models.Company)
+		if !throttle(ctx, "verify-email:"+accountID(company, user.Email), emailVerificationInterval) {
+			sendVerificationEmail.Call(ctx, company.Key(ctx), user.Email)
+		}
+
+		data.Sent = true
+	}
+
+	renderer.HTML(res, http.StatusOK, "verify-email", data)
+}
+
+func confirmEmailHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	email, ok := parseEmailVerificationToken(company, params.ByName("token"))
+	if !ok {
+		renderer.HTML(res, http.StatusBadRequest, "verify-email-failed", emailVerificationFailedMessage)
+		return
+	}
+
+	user, err := models.GetUser(ctx, company.Key(ctx), email)
+	if err != nil {
+		renderer.HTML(res, http.StatusBadRequest, "verify-email-failed", emailVerificationFailedMessage)
+		return
+	}
+
+	if user.Unverified {
+		if _, err := models.VerifyUser(ctx, user.Key(ctx)); err != nil {
+			log.Errorf(ctx, "failed to verify user: %v", err)
+			serverError(res)
+			return
+		}
+	}
+
+	http.Redirect(res, req, ReverseSimple("dashboard"), http.StatusFound)
+}
@@ -0,0 +1,24 @@
+package handlers
+
+import (
+	"teamzones/models"
+	"testing"
+)
+
+func TestEmailVerificationTokens(t *testing.T) {
+	t.Parallel()
+
+	acme := &models.Company{Subdomain: "acme"}
+	token := newEmailVerificationToken(acme, "Jim@Acme.com")
+	if email, ok := parseEmailVerificationToken(acme, token); !ok || email != "jim@acme.com" {
+		t.Errorf("expected token to confirm jim@acme.com, got %q", email)
+	}
+
+	if _, ok := parseEmailVerificationToken(&models.Company{Subdomain: "evil"}, token); ok {
+		t.Errorf("expected token to be bound to its company")
+	}
+
+	if _, ok := parseEmailVerificationToken(acme, token+"x"); ok {
+		t.Errorf("expected tampered token to be rejected")
+	}
+}
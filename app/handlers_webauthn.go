@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"teamzones/forms"
+	"teamzones/integrations"
+	"teamzones/models"
+	"time"
+
+	"github.com/goincremental/negroni-sessions"
+	"github.com/gorilla/context"
+	"github.com/qedus/nds"
+
+	netcontext "golang.org/x/net/context"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
+
+const (
+	webAuthnChallengeSessionKey = "webauthn-challenge"
+)
+
+func init() {
+	POST(appRouter, "team-sign-in-webauthn-begin", "/sign-in/webauthn/begin", webAuthnSignInBeginHandler, Everyone)
+	POST(appRouter, "team-sign-in-webauthn", "/sign-in/webauthn", webAuthnSignInHandler, Everyone)
+
+	GET(
+		appRouter,
+		"webauthn-credentials", "/api/webauthn/credentials",
+		webAuthnCredentialsHandler,
+	)
+	POST(
+		appRouter,
+		"webauthn-register-begin", "/api/webauthn/register/begin",
+		webAuthnRegisterBeginHandler, Everyone,
+	)
+	POST(
+		appRouter,
+		"webauthn-register", "/api/webauthn/register",
+		webAuthnRegisterHandler, Everyone,
+	)
+	DELETE(
+		appRouter,
+		"webauthn-credential-delete", "/api/webauthn/credentials/:id",
+		deleteWebAuthnCredentialHandler, Everyone,
+	)
+}
+
+// webAuthnRelyingParty returns the relying party for a Company's
+// subdomain.  Credentials are scoped to the subdomain so they can't
+// be used to sign into other teams.
+func webAuthnRelyingParty(company *models.Company) *integrations.WebAuthnRelyingParty {
+	origin := strings.TrimSuffix(ReverseRoute("dashboard").Subdomain(company.Subdomain).Build(), "/")
+	host := strings.SplitN(config.Host(), ":", 2)[0]
+	return &integrations.WebAuthnRelyingParty{
+		ID:     company.Subdomain + "." + host,
+		Name:   "Teamzones",
+		Origin: origin,
+	}
+}
+
+// popWebAuthnChallenge returns the challenge stored in the session,
+// ensuring that it can only be used once.
+func popWebAuthnChallenge(req *http.Request) string {
+	session := sessions.GetSession(req)
+	challenge, _ := session.Get(webAuthnChallengeSessionKey).(string)
+	session.Delete(webAuthnChallengeSessionKey)
+	return challenge
+}
+
+func webAuthnCredentialIDs(ctx netcontext.Context, user *datastore.Key) ([][]byte, error) {
+	var credentials []models.WebAuthnCredential
+	if _, err := models.FindWebAuthnCredentials(user).GetAll(ctx, &credentials); err != nil {
+		return nil, err
+	}
+
+	ids := make([][]byte, 0, len(credentials))
+	for _, credential := range credentials {
+		id, err := integrations.DecodeWebAuthnID(credential.CredentialID)
+		if err != nil {
+			return nil, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// webAuthnSignInBeginHandler starts an assertion ceremony.  Users
+// that have already entered their password are asked for one of
+// their own credentials as a second factor.  Everyone else may use
+// any discoverable credential (i.e. a passkey) to sign in.
+func webAuthnSignInBeginHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	session := sessions.GetSession(req)
+
+	var allow [][]byte
+	if email, ok := session.Get(twoFactorUserSessionKey).(string); ok {
+		ids, err := webAuthnCredentialIDs(ctx, models.NewUserKey(ctx, company.Key(ctx), email))
+		if err != nil {
+			log.Errorf(ctx, "failed to look up webauthn credentials: %v", err)
+			serverError(res)
+			return
+		}
+
+		allow = ids
+	}
+
+	challenge := integrations.NewWebAuthnChallenge()
+	session.Set(webAuthnChallengeSessionKey, challenge)
+	renderer.JSON(res, http.StatusOK, webAuthnRelyingParty(company).RequestOptions(challenge, allow))
+}
+
+type webAuthnAssertionRequest struct {
+	CredentialID      string `json:"id" validate:"MinLength:1"`
+	ClientDataJSON    string `json:"clientDataJSON" validate:"MinLength:1"`
+	AuthenticatorData string `json:"authenticatorData" validate:"MinLength:1"`
+	Signature         string `json:"signature" validate:"MinLength:1"`
+}
+
+type webAuthnSignInResponse struct {
+	Location string `json:"location"`
+}
+
+func webAuthnSignInHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data webAuthnAssertionRequest
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	challenge := popWebAuthnChallenge(req)
+	session := sessions.GetSession(req)
+	pending, isSecondFactor := session.Get(twoFactorUserSessionKey).(string)
+
+	stored, err := models.GetWebAuthnCredential(ctx, company.Key(ctx), data.CredentialID)
+	if err == datastore.ErrNoSuchEntity {
+		badRequest(res, "This security key is not registered.")
+		return
+	} else if err != nil {
+		panic(err)
+	}
+
+	if isSecondFactor && stored.User.StringID() != strings.ToLower(pending) {
+		badRequest(res, "This security key belongs to another account.")
+		return
+	}
+
+	credential, err := stored.Credential()
+	if err != nil {
+		panic(err)
+	}
+
+	var clientData, authData, signature []byte
+	for _, field := range []struct {
+		value string
+		dest  *[]byte
+	}{
+		{data.ClientDataJSON, &clientData},
+		{data.AuthenticatorData, &authData},
+		{data.Signature, &signature},
+	} {
+		if *field.dest, err = integrations.DecodeWebAuthnID(field.value); err != nil {
+			badRequest(res, "Malformed security key response.")
+			return
+		}
+	}
+
+	// Passkeys replace both the password and the second factor so
+	// the authenticator has to verify the user in that case.
+	signCount, err := webAuthnRelyingParty(company).VerifyAssertion(
+		challenge, credential, clientData, authData, signature, !isSecondFactor,
+	)
+	if err != nil {
+		log.Warningf(ctx, "rejected webauthn assertion: %v", err)
+		badRequest(res, "We couldn't verify your security key. Please try again.")
+		return
+	}
+
+	var user models.User
+	if err := nds.Get(ctx, stored.User, &user); err != nil {
+		badRequest(res, "This security key is not registered.")
+		return
+	}
+
+	if !isSecondFactor && ssoEnforced(ctx, &user) {
+		badRequest(res, ssoRequiredMessage)
+		return
+	}
+
+	stored.SignCount = int64(signCount)
+	stored.LastUsedAt = time.Now()
+	if _, err := stored.Put(ctx); err != nil {
+		panic(err)
+	}
+
+	location, _ := session.Get(twoFactorReturnSessionKey).(string)
+	if !isLocalPath(location) {
+		location = req.FormValue("r")
+	}
+
+	if !isLocalPath(location) {
+		location = "/"
+	}
+
+	rememberMe, _ := session.Get(twoFactorRememberSessionKey).(bool)
+	clearTwoFactorSession(session)
+	startSession(req, &user, rememberMe)
+	renderer.JSON(res, http.StatusOK, webAuthnSignInResponse{location})
+}
+
+func webAuthnCredentialsHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var credentials []models.WebAuthnCredential
+
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	if _, err := models.FindWebAuthnCredentials(user.Key(ctx)).GetAll(ctx, &credentials); err != nil {
+		panic(err)
+	}
+
+	if credentials == nil {
+		credentials = []models.WebAuthnCredential{}
+	}
+
+	renderer.JSON(res, http.StatusOK, credentials)
+}
+
+func webAuthnRegisterBeginHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	exclude, err := webAuthnCredentialIDs(ctx, user.Key(ctx))
+	if err != nil {
+		log.Errorf(ctx, "failed to look up webauthn credentials: %v", err)
+		serverError(res)
+		return
+	}
+
+	challenge := integrations.NewWebAuthnChallenge()
+	session := sessions.GetSession(req)
+	session.Set(webAuthnChallengeSessionKey, challenge)
+	renderer.JSON(res, http.StatusOK, webAuthnRelyingParty(company).CreationOptions(
+		challenge, user.WebAuthnUserHandle(ctx), user.Email, user.FullName(), exclude,
+	))
+}
+
+func webAuthnRegisterHandler(res http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	var data struct {
+		Name              string `json:"name" validate:"MinLength:1,MaxLength:50"`
+		ClientDataJSON    string `json:"clientDataJSON" validate:"MinLength:1"`
+		AttestationObject string `json:"attestationObject" validate:"MinLength:1"`
+	}
+
+	if err := forms.BindJSON(req, &data); err != nil {
+		badRequest(res, err.Error())
+		return
+	}
+
+	clientData, err := integrations.DecodeWebAuthnID(data.ClientDataJSON)
+	if err != nil {
+		badRequest(res, "Malformed security key response.")
+		return
+	}
+
+	attestation, err := integrations.DecodeWebAuthnID(data.AttestationObject)
+	if err != nil {
+		badRequest(res, "Malformed security key response.")
+		return
+	}
+
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	company := context.Get(req, companyCtxKey).(*models.Company)
+	credential, err := webAuthnRelyingParty(company).VerifyRegistration(
+		popWebAuthnChallenge(req), clientData, attestation,
+	)
+	if err != nil {
+		log.Warningf(ctx, "rejected webauthn registration: %v", err)
+		badRequest(res, "We couldn't verify your security key. Please try again.")
+		return
+	}
+
+	id := integrations.EncodeWebAuthnID(credential.ID)
+	if _, err := models.GetWebAuthnCredential(ctx, company.Key(ctx), id); err == nil {
+		badRequest(res, "This security key is already registered.")
+		return
+	}
+
+	stored, err := models.CreateWebAuthnCredential(ctx, user, data.Name, credential)
+	if err != nil {
+		log.Errorf(ctx, "failed to store webauthn credential: %v", err)
+		serverError(res)
+		return
+	}
+
+	renderer.JSON(res, http.StatusCreated, stored)
+}
+
+func deleteWebAuthnCredentialHandler(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+	ctx := appengine.NewContext(req)
+	user := context.Get(req, userCtxKey).(*models.User)
+	key := models.NewWebAuthnCredentialKey(ctx, user.Key(ctx), params.ByName("id"))
+	if err := nds.Delete(ctx, key); err != nil {
+		log.Errorf(ctx, "failed to delete webauthn credential: %v", err)
+		serverError(res)
+		return
+	}
+
+	res.WriteHeader(http.StatusOK)
+}
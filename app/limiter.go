@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"teamzones/models"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/memcache"
+)
+
+// attemptLimiter slows down and eventually locks out clients that
+// keep failing at something (e.g. guessing passwords).  State lives
+// in memcache so it is best-effort: if an entry is evicted the client
+// simply gets a clean slate, the limiter never fails closed.
+// Counters are bucketed by window so that stale ones don't need to
+// be cleaned up explicitly.
+type attemptLimiter struct {
+	name string
+
+	// window is the period over which failures are counted.
+	window time.Duration
+	// freeFailures is the number of failures that are allowed
+	// before delays kick in.
+	freeFailures uint64
+	// maxFailures is the number of failures after which the client
+	// is locked out.
+	maxFailures uint64
+	// maxDelay caps the delay between failed attempts.
+	maxDelay time.Duration
+	// lockout is the amount of time a client is locked out for.
+	lockout time.Duration
+}
+
+var (
+	signInIPLimiter = &attemptLimiter{
+		name:         "sign-in-ip",
+		window:       1 * time.Hour,
+		freeFailures: 10,
+		maxFailures:  50,
+		maxDelay:     30 * time.Second,
+		lockout:      1 * time.Hour,
+	}
+
+	signInAccountLimiter = &attemptLimiter{
+		name:         "sign-in-account",
+		window:       1 * time.Hour,
+		freeFailures: 3,
+		maxFailures:  10,
+		maxDelay:     30 * time.Second,
+		lockout:      15 * time.Minute,
+	}
+
+	recoveryIPLimiter = &attemptLimiter{
+		name:         "recovery-ip",
+		window:       1 * time.Hour,
+		freeFailures: 10,
+		maxFailures:  30,
+		maxDelay:     1 * time.Minute,
+		lockout:      1 * time.Hour,
+	}
+
+	recoveryAccountLimiter = &attemptLimiter{
+		name:         "recovery-account",
+		window:       1 * time.Hour,
+		freeFailures: 2,
+		maxFailures:  5,
+		maxDelay:     5 * time.Minute,
+		lockout:      1 * time.Hour,
+	}
+)
+
+// delay returns how long a client has to wait after its last
+// failure.  The delay doubles with every failure past the free ones.
+func (l *attemptLimiter) delay(failures uint64) time.Duration {
+	if failures < l.freeFailures {
+		return 0
+	}
+
+	delay := time.Second
+	for i := l.freeFailures; i < failures && delay < l.maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > l.maxDelay {
+		return l.maxDelay
+	}
+
+	return delay
+}
+
+func (l *attemptLimiter) counterKey(id string, now time.Time) string {
+	bucket := now.UnixNano() / int64(l.window)
+	return fmt.Sprintf("limiter:%s:%s:%d", l.name, id, bucket)
+}
+
+func (l *attemptLimiter) lastFailureKey(id string) string {
+	return fmt.Sprintf("limiter:%s:%s:last", l.name, id)
+}
+
+func (l *attemptLimiter) lockKey(id string) string {
+	return fmt.Sprintf("limiter:%s:%s:lock", l.name, id)
+}
+
+func getUnix(ctx context.Context, key string) (time.Time, bool) {
+	item, err := memcache.Get(ctx, key)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	seconds, err := strconv.ParseInt(string(item.Value), 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(seconds, 0), true
+}
+
+// Wait returns the amount of time the client identified by id must
+// wait before its next attempt.  Zero means that it may go ahead.
+func (l *attemptLimiter) Wait(ctx context.Context, id string) time.Duration {
+	now := time.Now()
+	if until, ok := getUnix(ctx, l.lockKey(id)); ok && until.After(now) {
+		return until.Sub(now)
+	}
+
+	item, err := memcache.Get(ctx, l.counterKey(id, now))
+	if err != nil {
+		return 0
+	}
+
+	failures, err := strconv.ParseUint(string(item.Value), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	last, ok := getUnix(ctx, l.lastFailureKey(id))
+	if !ok {
+		return 0
+	}
+
+	if wait := last.Add(l.delay(failures)).Sub(now); wait > 0 {
+		return wait
+	}
+
+	return 0
+}
+
+// Fail records a failed attempt.  It returns true if this failure
+// caused the client to become locked out.
+func (l *attemptLimiter) Fail(ctx context.Context, id string) bool {
+	now := time.Now()
+	failures, err := memcache.Increment(ctx, l.counterKey(id, now), 1, 0)
+	if err != nil {
+		log.Warningf(ctx, "failed to record attempt for %q: %v", id, err)
+		return false
+	}
+
+	memcache.Set(ctx, &memcache.Item{
+		Key:        l.lastFailureKey(id),
+		Value:      []byte(strconv.FormatInt(now.Unix(), 10)),
+		Expiration: l.window,
+	})
+
+	if failures < l.maxFailures {
+		return false
+	}
+
+	// Add ensures that only one request reports the lockout.
+	err = memcache.Add(ctx, &memcache.Item{
+		Key:        l.lockKey(id),
+		Value:      []byte(strconv.FormatInt(now.Add(l.lockout).Unix(), 10)),
+		Expiration: l.lockout,
+	})
+	return err == nil
+}
+
+// Unlock clears the client's failures and lifts its lockout.
+func (l *attemptLimiter) Unlock(ctx context.Context, id string) {
+	memcache.DeleteMulti(ctx, []string{
+		l.counterKey(id, time.Now()),
+		l.lastFailureKey(id),
+		l.lockKey(id),
+	})
+}
+
+// Reset clears the client's failures.  Lockouts are left alone.
+func (l *attemptLimiter) Reset(ctx context.Context, id string) {
+	memcache.DeleteMulti(ctx, []string{
+		l.counterKey(id, time.Now()),
+		l.lastFailureKey(id),
+	})
+}
+
+// accountID identifies a User across limiters.
+func accountID(company *models.Company, email string) string {
+	return company.Subdomain + ":" + strings.ToLower(email)
+}
+
+// signInWait returns how long a client must wait before it may try
+// to sign into the given account again.
+func signInWait(ctx context.Context, req *http.Request, company *models.Company, email string) time.Duration {
+	wait := signInIPLimiter.Wait(ctx, clientIP(req))
+	if accountWait := signInAccountLimiter.Wait(ctx, accountID(company, email)); accountWait > wait {
+		return accountWait
+	}
+
+	return wait
+}
+
+// signInFailed records a failed sign in attempt against both the
+// client and the account.  Accounts that become locked out are
+// flagged in datastore as well so that the lockout survives memcache
+// evictions.
+func signInFailed(ctx context.Context, req *http.Request, company *models.Company, email string) {
+	ip := clientIP(req)
+	signInIPLimiter.Fail(ctx, ip)
+	if signInAccountLimiter.Fail(ctx, accountID(company, email)) {
+		lockAccount.Call(
+			ctx, company.Key(ctx), email, ip,
+			time.Now().Add(signInAccountLimiter.lockout),
+		)
+	}
+}
+
+// recoveryWait records a password recovery or sign in link request
+// and returns how long the client must wait if it's been making too
+// many of them.  Every request counts since they can't fail.
+func recoveryWait(ctx context.Context, req *http.Request, company *models.Company, email string) time.Duration {
+	ip, account := clientIP(req), accountID(company, email)
+	wait := recoveryIPLimiter.Wait(ctx, ip)
+	if accountWait := recoveryAccountLimiter.Wait(ctx, account); accountWait > wait {
+		wait = accountWait
+	}
+
+	if wait > 0 {
+		return wait
+	}
+
+	recoveryIPLimiter.Fail(ctx, ip)
+	recoveryAccountLimiter.Fail(ctx, account)
+	return 0
+}
+
+// lockedOutMessage is shown to clients that have to wait before they
+// can try again.
+func lockedOutMessage(wait time.Duration) string {
+	return fmt.Sprintf("Too many failed attempts. Please try again in %s.", formatWait(wait))
+}
+
+// clientIP returns the IP address of the client making req.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// formatWait renders a wait duration for humans.
+func formatWait(d time.Duration) string {
+	if d > time.Minute {
+		minutes := int((d + time.Minute - 1) / time.Minute)
+		return fmt.Sprintf("%d minutes", minutes)
+	}
+
+	seconds := int((d + time.Second - 1) / time.Second)
+	if seconds == 1 {
+		return "1 second"
+	}
+
+	return fmt.Sprintf("%d seconds", seconds)
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAttemptLimiterDelay(t *testing.T) {
+	t.Parallel()
+
+	l := &attemptLimiter{freeFailures: 3, maxDelay: 30 * time.Second}
+	cases := []struct {
+		failures uint64
+		expected time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, 1 * time.Second},
+		{4, 2 * time.Second},
+		{7, 16 * time.Second},
+		{8, 30 * time.Second},
+		{100, 30 * time.Second},
+	}
+
+	for _, test := range cases {
+		if delay := l.delay(test.failures); delay != test.expected {
+			t.Errorf("expected delay of %v after %d failures, got %v", test.expected, test.failures, delay)
+		}
+	}
+}
+
+func TestAttemptLimiterBucketsCounters(t *testing.T) {
+	t.Parallel()
+
+	l := &attemptLimiter{name: "test", window: time.Hour}
+	now := time.Unix(1500000000, 0).Truncate(time.Hour)
+	if l.counterKey("a", now) != l.counterKey("a", now.Add(59*time.Minute)) {
+		t.Errorf("expected counters within a window to share a key")
+	}
+
+	if l.counterKey("a", now) == l.counterKey("a", now.Add(time.Hour)) {
+		t.Errorf("expected counters in different windows to have different keys")
+	}
+}
+
+func TestFormatWait(t *testing.T) {
+	t.Parallel()
+
+	cases := map[time.Duration]string{
+		500 * time.Millisecond:       "1 second",
+		30 * time.Second:             "30 seconds",
+		14*time.Minute + time.Second: "15 minutes",
+	}
+
+	for d, expected := range cases {
+		if s := formatWait(d); s != expected {
+			t.Errorf("expected %v to be formatted as %q, got %q", d, expected, s)
+		}
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"strings"
 	"teamzones/models"
+	"time"
 
 	"github.com/codegangsta/negroni"
 	"github.com/goincremental/negroni-sessions"
@@ -13,6 +14,7 @@ import (
 	"github.com/qedus/nds"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
 )
 
 var (
@@ -21,24 +23,49 @@ var (
 		"/sign-up",
 		"/recover-password",
 		"/reset-password",
+		"/sso/",
+		"/join",
 	}
 
 	sharedPaths = []string{
 		"/api/location",
+		"/sso/saml/metadata",
+		"/confirm-email/",
 	}
 
 	billingPaths = []string{
 		"/api/billing",
+		"/api/closure",
 		"/settings/billing",
 		"/sign-out",
 	}
 
+	closedPaths = []string{
+		"/closed",
+		"/sign-out",
+	}
+
 	demoPaths = []string{
 		"/integrations/connect",
 		"/api/integrations/refresh",
 		"/api/integrations/disconnect",
 		"/api/upload",
 		"/api/users/",
+		"/api/sso/",
+		"/api/two-factor",
+		"/api/webauthn/",
+		"/api/sessions",
+		"/api/privacy/",
+		"/api/closure",
+		"/api/tokens",
+		"/api/roles",
+		"/api/ownership",
+		"/api/password-policy",
+		"/api/password-resets",
+		"/api/invite-settings",
+		"/api/domains",
+		"/api/domain-settings",
+		"/two-factor/",
 	}
 )
 
@@ -52,9 +79,9 @@ func isSubpath(path string, paths []string) bool {
 	return false
 }
 
-// Access restricts access to paths based on their ACL and on the
-// current Company's billing status.  The ACLs only apply to static
-// paths!
+// Access restricts access to paths based on the current Company's
+// billing status and security policies.  Per-route ACLs are enforced
+// once the router has matched the request, see restrict.
 func Access(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
 	if isSubpath(req.URL.Path, guestPaths) || isSubpath(req.URL.Path, sharedPaths) {
 		next(res, req)
@@ -68,8 +95,23 @@ func Access(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
 		return
 	}
 
+	if company.Closed() && !isSubpath(req.URL.Path, closedPaths) {
+		if isTokenRequest(req) || strings.HasPrefix(req.URL.Path, "/api/") {
+			forbidden(res)
+			return
+		}
+
+		http.Redirect(res, req, ReverseSimple("team-closed"), http.StatusFound)
+		return
+	}
+
 	if company.Suspended() {
-		if user.Role != models.RoleMain {
+		if isTokenRequest(req) {
+			forbidden(res)
+			return
+		}
+
+		if !user.CanManageBilling() {
 			ctx := appengine.NewContext(req)
 			main := company.LookupMainUser(ctx)
 			renderer.HTML(res, http.StatusOK, "suspended", main)
@@ -82,21 +124,45 @@ func Access(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
 		}
 	}
 
-	if roles, ok := sitemapACL[req.URL.Path]; ok {
-		for _, role := range roles {
-			if role == user.Role {
-				next(res, req)
-				return
-			}
+	if user.Unverified && !isSubpath(req.URL.Path, verificationPaths) {
+		if strings.HasPrefix(req.URL.Path, "/api/") {
+			forbidden(res)
+			return
 		}
 
-		forbidden(res)
+		http.Redirect(res, req, ReverseSimple("team-verify-email"), http.StatusFound)
 		return
 	}
 
+	// Tokens can only be created from a browser session so the
+	// two-factor policy has already been enforced.
+	if company.RequireTwoFactor && !user.TOTPEnabled && !isTokenRequest(req) && !isSubpath(req.URL.Path, twoFactorPaths) {
+		ctx := appengine.NewContext(req)
+		hasSecurityKeys, err := models.HasWebAuthnCredentials(ctx, user.Key(ctx))
+		if err != nil {
+			panic(err)
+		}
+
+		if !twoFactorEnrolled(user, hasSecurityKeys) {
+			if strings.HasPrefix(req.URL.Path, "/api/") {
+				forbidden(res)
+				return
+			}
+
+			http.Redirect(res, req, ReverseSimple("team-two-factor-setup"), http.StatusFound)
+			return
+		}
+	}
+
 	next(res, req)
 }
 
+// twoFactorEnrolled returns true if user has a second factor that
+// signIn asks for: either TOTP or at least one security key.
+func twoFactorEnrolled(user *models.User, hasSecurityKeys bool) bool {
+	return user.TOTPEnabled || hasSecurityKeys
+}
+
 func redirectAuth(res http.ResponseWriter, req *http.Request, r string) {
 	path := ReverseRoute("team-sign-in").
 		Query("r", r).
@@ -107,6 +173,11 @@ func redirectAuth(res http.ResponseWriter, req *http.Request, r string) {
 // Auth ensures that the user is authenticated before they can access
 // a resource.  It also injects the User into the context.
 func Auth(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
+	if plain, ok := bearerToken(req); ok {
+		authenticateToken(res, req, next, plain)
+		return
+	}
+
 	isGuestPath := isSubpath(req.URL.Path, guestPaths)
 	isSharedPath := isSubpath(req.URL.Path, sharedPaths)
 	session := sessions.GetSession(req)
@@ -131,19 +202,36 @@ func Auth(res http.ResponseWriter, req *http.Request, next http.HandlerFunc) {
 	}
 
 	var user models.User
+	var record *models.Session
 
 	company := context.Get(req, companyCtxKey).(*models.Company)
 	ctx := appengine.NewContext(req)
 	key := models.NewUserKey(ctx, company.Key(ctx), email.(string))
 	err := nds.Get(ctx, key, &user)
+	if err == nil && user.Deactivated {
+		err = datastore.ErrNoSuchEntity
+	}
+
+	if err == nil {
+		sid, _ := session.Get(sidSessionKey).(string)
+		record, err = models.GetSession(ctx, key, sid)
+	}
 
 	switch err {
 	case nil:
+		if record.Touch(time.Now(), clientIP(req)) {
+			if _, err := record.Put(ctx); err != nil {
+				log.Warningf(ctx, "failed to touch session: %v", err)
+			}
+		}
+
 		context.Set(req, userCtxKey, &user)
+		context.Set(req, sessionCtxKey, record)
 		defer context.Clear(req)
 		next(res, req)
 	case datastore.ErrNoSuchEntity:
 		session.Delete(uidSessionKey)
+		session.Delete(sidSessionKey)
 		redirectAuth(res, req, req.URL.String())
 	default:
 		panic(err)
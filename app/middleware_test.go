@@ -0,0 +1,27 @@
+package handlers
+
+import (
+	"teamzones/models"
+	"testing"
+)
+
+func TestTwoFactorEnrolled(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		user            *models.User
+		hasSecurityKeys bool
+		expected        bool
+	}{
+		{&models.User{}, false, false},
+		{&models.User{TOTPEnabled: true}, false, true},
+		{&models.User{}, true, true},
+		{&models.User{TOTPEnabled: true}, true, true},
+	}
+
+	for i, test := range cases {
+		if twoFactorEnrolled(test.user, test.hasSecurityKeys) != test.expected {
+			t.Errorf("case %d: expected %v", i, test.expected)
+		}
+	}
+}
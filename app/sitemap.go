@@ -6,6 +6,9 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"teamzones/models"
+
+	"github.com/gorilla/context"
 
 	"gopkg.in/julienschmidt/httprouter.v1"
 )
@@ -13,8 +16,19 @@ import (
 // Route is the type of route identifiers.
 type Route string
 
+// Everyone is a pseudo-role that grants access to a route to anyone
+// that makes it past the middleware.  Routes that change state must
+// either list the roles that may use them or explicitly allow
+// Everyone.
+const Everyone = "*"
+
+type routeMethod struct {
+	name   Route
+	method string
+}
+
 var sitemap = make(map[Route]RouteBuilder)
-var sitemapACL = make(map[string][]string) // path -> list of roles
+var sitemapACL = make(map[routeMethod][]string) // route, method -> list of roles (nil when unrestricted)
 
 const (
 	segmentStatic  = iota
@@ -198,13 +212,40 @@ func register(
 
 	sitemap[name] = newBuilder(path)
 
-	if len(roles) > 0 {
-		sitemapACL[path] = roles
+	for _, method := range methods {
+		sitemapACL[routeMethod{name, method}] = roles
+		router.Handle(method, path, restrict(roles, handler))
 	}
+}
 
-	for _, method := range methods {
-		router.Handle(method, path, handler)
+// restrict wraps a handler so that it can only be accessed by Users
+// with one of the given roles.  Since the check happens after the
+// router has matched the request it also applies to routes with
+// dynamic segments.
+func restrict(roles []string, handler httprouter.Handle) httprouter.Handle {
+	if len(roles) == 0 {
+		return handler
+	}
+
+	return func(res http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if !hasRole(req, roles) {
+			forbidden(res)
+			return
+		}
+
+		handler(res, req, params)
+	}
+}
+
+func hasRole(req *http.Request, roles []string) bool {
+	user, _ := context.Get(req, userCtxKey).(*models.User)
+	for _, role := range roles {
+		if role == Everyone || (user != nil && role == user.Role) {
+			return true
+		}
 	}
+
+	return false
 }
 
 // GET creates an HTTP GET route handler.
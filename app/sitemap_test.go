@@ -1,6 +1,15 @@
 package handlers
 
-import "testing"
+import (
+	"net/http"
+	"net/http/httptest"
+	"teamzones/models"
+	"testing"
+
+	"github.com/gorilla/context"
+
+	"gopkg.in/julienschmidt/httprouter.v1"
+)
 
 func TestBuilderStaticParsing(t *testing.T) {
 	t.Parallel()
@@ -57,3 +66,49 @@ func TestBuildersAreSafe(t *testing.T) {
 		t.Error("builders are not safe")
 	}
 }
+
+func TestMutatingRoutesHavePolicies(t *testing.T) {
+	t.Parallel()
+
+	for route, roles := range sitemapACL {
+		if isSafeMethod(route.method) {
+			continue
+		}
+
+		if len(roles) == 0 {
+			t.Errorf("%s %q has no access policy, list its roles or allow Everyone", route.method, route.name)
+		}
+	}
+}
+
+// TestRestrict registers a route so it can't run in parallel with
+// tests that inspect the sitemap.
+func TestRestrict(t *testing.T) {
+	router := httprouter.New()
+	DELETE(router, "test-restrict", "/test-restrict/:id", func(res http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+		res.WriteHeader(http.StatusNoContent)
+	}, models.RoleMain)
+
+	cases := []struct {
+		user     *models.User
+		expected int
+	}{
+		{nil, http.StatusForbidden},
+		{&models.User{Role: models.RoleUser}, http.StatusForbidden},
+		{&models.User{Role: models.RoleMain}, http.StatusNoContent},
+	}
+
+	for _, test := range cases {
+		req, _ := http.NewRequest("DELETE", "/test-restrict/1", nil)
+		if test.user != nil {
+			context.Set(req, userCtxKey, test.user)
+		}
+
+		res := httptest.NewRecorder()
+		router.ServeHTTP(res, req)
+		context.Clear(req)
+		if res.Code != test.expected {
+			t.Errorf("expected %v to get %d, got %d", test.user, test.expected, res.Code)
+		}
+	}
+}
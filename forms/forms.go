@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"teamzones/utils"
+	"time"
 )
 
 // Validator is an alias for functions from string to error.  They are
@@ -81,6 +82,8 @@ var dynValidators = map[string](func(interface{}, []string) error){
 	"Email":     dynEmail,
 	"MinLength": dynMinLength,
 	"MaxLength": dynMaxLength,
+	"Phone":     dynPhone,
+	"Timezone":  dynTimezone,
 }
 
 // BindJSON binds JSON request data to a struct, validating each field.
@@ -90,6 +93,12 @@ func BindJSON(req *http.Request, data interface{}) error {
 		return err
 	}
 
+	return Validate(data)
+}
+
+// Validate validates each field of a struct pointer according to its
+// validate tag.
+func Validate(data interface{}) error {
 	sv := reflect.ValueOf(data).Elem()
 	st := reflect.TypeOf(data).Elem()
 	for i := 0; i < sv.NumField(); i++ {
@@ -132,6 +141,53 @@ func dynEmail(value interface{}, _ []string) error {
 	return Email(value.(string))
 }
 
+// Timezone validates that the Field's value is an IANA timezone name.
+// Empty values are allowed.
+func Timezone(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	if _, err := time.LoadLocation(value); err != nil || value == "Local" {
+		return errors.New("Please enter a valid timezone.")
+	}
+
+	return nil
+}
+
+func dynTimezone(value interface{}, _ []string) error {
+	return Timezone(value.(string))
+}
+
+// Phone validates that the Field's value looks like a phone number.
+// Empty values are allowed.
+func Phone(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	digits := 0
+	for _, char := range value {
+		switch {
+		case char >= '0' && char <= '9':
+			digits++
+		case strings.ContainsRune("+-(). ", char):
+		default:
+			return errors.New("Please enter a valid phone number.")
+		}
+	}
+
+	if digits < 5 || digits > 15 {
+		return errors.New("Please enter a valid phone number.")
+	}
+
+	return nil
+}
+
+func dynPhone(value interface{}, _ []string) error {
+	return Phone(value.(string))
+}
+
 var reservedSubdomains = []string{
 	"admin",
 	"support",
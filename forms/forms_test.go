@@ -60,3 +60,53 @@ func TestSubdomainValidator(t *testing.T) {
 		}
 	}
 }
+
+func TestTimezone(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		value string
+		pass  bool
+	}{
+		{"", true},
+		{"UTC", true},
+		{"Europe/Bucharest", true},
+		{"America/New_York", true},
+		{"Local", false},
+		{"Mars/Olympus_Mons", false},
+	}
+
+	for _, test := range cases {
+		err := Timezone(test.value)
+		if test.pass && err != nil {
+			t.Errorf("expected %q to be a valid timezone: %v", test.value, err)
+		} else if !test.pass && err == nil {
+			t.Errorf("expected %q to be rejected", test.value)
+		}
+	}
+}
+
+func TestPhone(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		value string
+		pass  bool
+	}{
+		{"", true},
+		{"+40 721 123 456", true},
+		{"(555) 123-4567", true},
+		{"1234", false},
+		{"call me", false},
+		{"+1 234 567 890 123 456 789", false},
+	}
+
+	for _, test := range cases {
+		err := Phone(test.value)
+		if test.pass && err != nil {
+			t.Errorf("expected %q to be a valid phone number: %v", test.value, err)
+		} else if !test.pass && err == nil {
+			t.Errorf("expected %q to be rejected", test.value)
+		}
+	}
+}
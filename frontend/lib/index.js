@@ -1,6 +1,7 @@
 import moment from "moment-timezone";
 
 import Checkout from "./checkout";
+import * as WebAuthn from "./webauthn";
 import {fetchLocation} from "./service";
 
 function now() {
@@ -22,7 +23,24 @@ window.loadTimezone = function(el) {
 
 window.moment = moment;
 window.Checkout = Checkout;
+window.WebAuthn = WebAuthn;
+// Attaches the CSRF token to every state-changing API request made
+// by the Elm app.
+function protectRequests(token) {
+  const open = XMLHttpRequest.prototype.open;
+
+  XMLHttpRequest.prototype.open = function(method, url) {
+    open.apply(this, arguments);
+
+    if (!/^(GET|HEAD|OPTIONS)$/i.test(method) && url.indexOf("/") === 0) {
+      this.setRequestHeader("X-CSRF-Token", token);
+    }
+  };
+}
+
 window.init = function(Elm, goog, el, context) {
+  protectRequests(context.csrfToken);
+
   context.viewportWidth = window.innerWidth;
   context.now = now();
   context.user.integrations = context.integrations;
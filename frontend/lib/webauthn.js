@@ -0,0 +1,98 @@
+function decode(value) {
+  const padded = value.replace(/-/g, "+").replace(/_/g, "/");
+  const binary = atob(padded + "===".slice((padded.length + 3) % 4));
+  return Uint8Array.from(binary, c => c.charCodeAt(0));
+}
+
+function encode(buffer) {
+  const binary = String.fromCharCode.apply(null, new Uint8Array(buffer));
+  return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+}
+
+function csrfToken() {
+  const meta = document.querySelector("meta[name=csrf-token]");
+  return meta ? meta.getAttribute("content") : "";
+}
+
+function post(path, data) {
+  return fetch(path, {
+    method: "POST",
+    credentials: "same-origin",
+    headers: {
+      "Content-Type": "application/json",
+      "X-CSRF-Token": csrfToken()
+    },
+    body: JSON.stringify(data || {})
+  }).then(response => {
+    return response.json().then(data => {
+      if (response.status < 400) {
+        return data;
+      }
+
+      const error = new Error(data.errors ? data.errors[0] : response.statusText);
+      error.response = response;
+      throw error;
+    });
+  });
+}
+
+export function supported() {
+  return typeof window.PublicKeyCredential !== "undefined";
+}
+
+export function signIn() {
+  const returnTo = new URLSearchParams(window.location.search).get("r") || "";
+
+  return post("/sign-in/webauthn/begin").then(options => {
+    options.challenge = decode(options.challenge);
+    options.allowCredentials = options.allowCredentials.map(c => {
+      return {type: c.type, id: decode(c.id)};
+    });
+
+    return navigator.credentials.get({publicKey: options});
+  }).then(credential => {
+    return post(`/sign-in/webauthn?r=${encodeURIComponent(returnTo)}`, {
+      id: encode(credential.rawId),
+      clientDataJSON: encode(credential.response.clientDataJSON),
+      authenticatorData: encode(credential.response.authenticatorData),
+      signature: encode(credential.response.signature)
+    });
+  }).then(response => {
+    window.location = response.location;
+  });
+}
+
+export function register(name) {
+  return post("/api/webauthn/register/begin").then(options => {
+    options.challenge = decode(options.challenge);
+    options.user.id = decode(options.user.id);
+    options.excludeCredentials = options.excludeCredentials.map(c => {
+      return {type: c.type, id: decode(c.id)};
+    });
+
+    return navigator.credentials.create({publicKey: options});
+  }).then(credential => {
+    return post("/api/webauthn/register", {
+      name: name,
+      clientDataJSON: encode(credential.response.clientDataJSON),
+      attestationObject: encode(credential.response.attestationObject)
+    });
+  });
+}
+
+export function bindSignIn(button, errorEl) {
+  if (!supported()) {
+    return;
+  }
+
+  button.style.display = "";
+  button.addEventListener("click", e => {
+    e.preventDefault();
+    errorEl.style.display = "none";
+
+    signIn().catch(error => {
+      errorEl.innerText = error.message;
+      errorEl.style.display = "block";
+    });
+  });
+}
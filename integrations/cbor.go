@@ -0,0 +1,152 @@
+package integrations
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// errCBORTruncated is returned when a CBOR item extends past the end
+// of its input.
+var errCBORTruncated = errors.New("cbor: unexpected end of input")
+
+// cborMaxDepth bounds the nesting of arrays and maps so that hostile
+// input can't exhaust the stack.
+const cborMaxDepth = 16
+
+// decodeCBOR decodes the first CBOR data item in data and returns it
+// along with the remaining bytes.  Only the subset of CBOR that is
+// used by WebAuthn is supported: integers, byte and text strings,
+// arrays, maps and the simple values false, true and null.  Integers
+// are decoded as int64, byte strings as []byte, text strings as
+// string, arrays as []interface{} and maps as
+// map[interface{}]interface{}.
+func decodeCBOR(data []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(data, 0)
+}
+
+func decodeCBORHead(data []byte) (byte, uint64, []byte, error) {
+	if len(data) < 1 {
+		return 0, 0, nil, errCBORTruncated
+	}
+
+	major, info := data[0]>>5, data[0]&0x1f
+	data = data[1:]
+
+	switch {
+	case info < 24:
+		return major, uint64(info), data, nil
+	case info == 24:
+		if len(data) < 1 {
+			return 0, 0, nil, errCBORTruncated
+		}
+		return major, uint64(data[0]), data[1:], nil
+	case info == 25:
+		if len(data) < 2 {
+			return 0, 0, nil, errCBORTruncated
+		}
+		return major, uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26:
+		if len(data) < 4 {
+			return 0, 0, nil, errCBORTruncated
+		}
+		return major, uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27:
+		if len(data) < 8 {
+			return 0, 0, nil, errCBORTruncated
+		}
+		return major, binary.BigEndian.Uint64(data), data[8:], nil
+	}
+
+	return 0, 0, nil, errors.Errorf("cbor: unsupported additional information %d", info)
+}
+
+func decodeCBORItem(data []byte, depth int) (interface{}, []byte, error) {
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: maximum nesting depth exceeded")
+	}
+
+	major, arg, rest, err := decodeCBORHead(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return int64(arg), rest, nil
+
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, nil, errors.New("cbor: integer overflow")
+		}
+		return -1 - int64(arg), rest, nil
+
+	case 2, 3:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+
+		if major == 2 {
+			return rest[:arg], rest[arg:], nil
+		}
+		return string(rest[:arg]), rest[arg:], nil
+
+	case 4:
+		// Every item takes at least one byte.
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+
+		items := make([]interface{}, arg)
+		for i := range items {
+			items[i], rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		return items, rest, nil
+
+	case 5:
+		if arg > uint64(len(rest)) {
+			return nil, nil, errCBORTruncated
+		}
+
+		items := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			key, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("cbor: unsupported map key type")
+			}
+
+			value, rest, err = decodeCBORItem(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			items[key] = value
+		}
+		return items, rest, nil
+
+	case 7:
+		switch arg {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22:
+			return nil, rest, nil
+		}
+	}
+
+	return nil, nil, errors.Errorf("cbor: unsupported major type %d", major)
+}
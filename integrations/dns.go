@@ -0,0 +1,95 @@
+package integrations
+
+import (
+	"encoding/json"
+	"io"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"golang.org/x/net/context"
+
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	dnsOverHTTPSURL = "https://dns.google.com/resolve"
+	dnsTypeTXT      = 16
+
+	// DomainVerificationPrefix prefixes the value of the TXT record
+	// that proves ownership of a domain.
+	DomainVerificationPrefix = "teamzones-verification="
+)
+
+// TXTResolver looks up the TXT records of a domain.  It is an
+// interface so that DNS can be faked in tests.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, domain string) ([]string, error)
+}
+
+// HTTPSResolver looks up records using Google's DNS-over-HTTPS API
+// since App Engine apps can't make DNS queries directly.
+type HTTPSResolver struct{}
+
+// LookupTXT returns the TXT records of domain.
+func (HTTPSResolver) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	query := url.Values{"name": {domain}, "type": {"TXT"}}
+	res, err := urlfetch.Client(ctx).Get(dnsOverHTTPSURL + "?" + query.Encode())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to resolve txt records")
+	}
+	defer res.Body.Close()
+
+	return parseTXTResponse(res.Body)
+}
+
+// parseTXTResponse extracts TXT records from a DNS-over-HTTPS JSON
+// response.  Records longer than 255 characters are split into quoted
+// strings that have to be joined back together.
+func parseTXTResponse(r io.Reader) ([]string, error) {
+	var response struct {
+		Status int
+		Answer []struct {
+			Type int    `json:"type"`
+			Data string `json:"data"`
+		}
+	}
+
+	if err := json.NewDecoder(r).Decode(&response); err != nil {
+		return nil, errors.Wrap(err, "failed to decode txt records")
+	}
+
+	var records []string
+	for _, answer := range response.Answer {
+		if answer.Type != dnsTypeTXT {
+			continue
+		}
+
+		data := strings.TrimSpace(answer.Data)
+		if strings.HasPrefix(data, `"`) && strings.HasSuffix(data, `"`) {
+			data = strings.Join(strings.Split(data[1:len(data)-1], `" "`), "")
+		}
+
+		records = append(records, data)
+	}
+
+	return records, nil
+}
+
+// VerifyDomain returns true if one of domain's TXT records carries
+// the given verification token.
+func VerifyDomain(ctx context.Context, resolver TXTResolver, domain, token string) (bool, error) {
+	records, err := resolver.LookupTXT(ctx, domain)
+	if err != nil {
+		return false, err
+	}
+
+	for _, record := range records {
+		if strings.TrimSpace(record) == DomainVerificationPrefix+token {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
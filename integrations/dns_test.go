@@ -0,0 +1,68 @@
+package integrations
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupTXT(ctx context.Context, domain string) ([]string, error) {
+	records, found := r[domain]
+	if !found {
+		return nil, errors.New("no such host")
+	}
+
+	return records, nil
+}
+
+func TestParseTXTResponse(t *testing.T) {
+	t.Parallel()
+
+	response := `{
+	  "Status": 0,
+	  "Answer": [
+	    {"name": "example.com.", "type": 16, "data": "\"v=spf1 -all\""},
+	    {"name": "example.com.", "type": 16, "data": "\"teamzones-verification=\" \"abc\""},
+	    {"name": "example.com.", "type": 5, "data": "other.example.com."}
+	  ]
+	}`
+
+	records, err := parseTXTResponse(strings.NewReader(response))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 2 || records[0] != "v=spf1 -all" || records[1] != "teamzones-verification=abc" {
+		t.Errorf("unexpected records: %q", records)
+	}
+}
+
+func TestVerifyDomain(t *testing.T) {
+	t.Parallel()
+
+	resolver := fakeResolver{
+		"example.com": {"v=spf1 -all", "teamzones-verification=abc"},
+		"example.org": {"teamzones-verification=xyz"},
+	}
+
+	cases := []struct {
+		domain   string
+		expected bool
+		err      bool
+	}{
+		{"example.com", true, false},
+		{"example.org", false, false},
+		{"example.net", false, true},
+	}
+
+	for _, test := range cases {
+		verified, err := VerifyDomain(context.Background(), resolver, test.domain, "abc")
+		if (err != nil) != test.err || verified != test.expected {
+			t.Errorf("unexpected result for %s: %v %v", test.domain, verified, err)
+		}
+	}
+}
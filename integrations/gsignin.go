@@ -0,0 +1,250 @@
+package integrations
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/jws"
+
+	"google.golang.org/appengine/memcache"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	googleCertsURL      = "https://www.googleapis.com/oauth2/v3/certs"
+	googleCertsCacheKey = "google-oidc-certs"
+	googleCertsTTL      = 1 * time.Hour
+
+	// idTokenClockSkew is the amount of clock drift that is
+	// tolerated when checking an ID token's expiry.
+	idTokenClockSkew = 5 * time.Minute
+)
+
+var signInConfig = loadDefaultSignInConfig()
+
+// Sign in with Google uses the same OAuth2 client as the calendar
+// integration, it only requests different scopes.
+func loadSignInConfigFromFile(filename string) *oauth2.Config {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		panic(err)
+	}
+
+	config, err := google.ConfigFromJSON(data, "openid", "email", "profile")
+	if err != nil {
+		panic(err)
+	}
+
+	return config
+}
+
+func loadDefaultSignInConfig() *oauth2.Config {
+	return loadSignInConfigFromFile("credentials/calendar.json")
+}
+
+// SetSignInRedirectURL should be called to update the Sign in with
+// Google redirect URL on app initialization.
+func SetSignInRedirectURL(URL string) {
+	signInConfig.RedirectURL = URL
+}
+
+// GetSignInAuthURL returns an OpenID Connect authorization URL.  If
+// hostedDomain is not empty then Google will only offer accounts
+// belonging to that G Suite domain.
+func GetSignInAuthURL(state, nonce, hostedDomain string) string {
+	opts := []oauth2.AuthCodeOption{
+		oauth2.AccessTypeOnline,
+		oauth2.SetAuthURLParam("nonce", nonce),
+		oauth2.SetAuthURLParam("prompt", "select_account"),
+	}
+
+	if hostedDomain != "" {
+		opts = append(opts, oauth2.SetAuthURLParam("hd", hostedDomain))
+	}
+
+	return signInConfig.AuthCodeURL(state, opts...)
+}
+
+// ExchangeSignInCode exchanges an authorization code for a raw ID
+// token.  The ID token must be verified before it is used.
+func ExchangeSignInCode(ctx context.Context, code string) (string, error) {
+	tok, err := signInConfig.Exchange(ctx, code)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to exchange sign in code")
+	}
+
+	idToken, ok := tok.Extra("id_token").(string)
+	if !ok || idToken == "" {
+		return "", errors.New("token response does not contain an id token")
+	}
+
+	return idToken, nil
+}
+
+// flexibleBool decodes JSON booleans that are sometimes represented
+// as strings.
+type flexibleBool bool
+
+func (b *flexibleBool) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	*b = flexibleBool(s == "true")
+	return nil
+}
+
+// GoogleIDToken is the set of claims that we use from Google's ID
+// tokens.
+type GoogleIDToken struct {
+	Issuer        string       `json:"iss"`
+	Audience      string       `json:"aud"`
+	Subject       string       `json:"sub"`
+	Expiry        int64        `json:"exp"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	HostedDomain  string       `json:"hd"`
+	GivenName     string       `json:"given_name"`
+	FamilyName    string       `json:"family_name"`
+}
+
+type googleCerts struct {
+	Keys []struct {
+		Kid string `json:"kid"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func (c *googleCerts) publicKeys() (map[string]*rsa.PublicKey, error) {
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range c.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid key modulus")
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid key exponent")
+		}
+
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	return keys, nil
+}
+
+// fetchGoogleKeys retrieves Google's current signing keys.  Keys are
+// rotated daily-ish so they are cached in memcache for an hour.
+func fetchGoogleKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	var certs googleCerts
+	if _, err := memcache.JSON.Get(ctx, googleCertsCacheKey, &certs); err == nil {
+		return certs.publicKeys()
+	}
+
+	res, err := urlfetch.Client(ctx).Get(googleCertsURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to fetch google certs")
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(&certs); err != nil {
+		return nil, errors.Wrap(err, "failed to decode google certs")
+	}
+
+	memcache.JSON.Set(ctx, &memcache.Item{
+		Key:        googleCertsCacheKey,
+		Object:     certs,
+		Expiration: googleCertsTTL,
+	})
+
+	return certs.publicKeys()
+}
+
+// VerifyGoogleIDToken validates a raw ID token's signature and
+// claims.  The nonce must be the one that was sent along with the
+// authorization request.
+func VerifyGoogleIDToken(ctx context.Context, rawToken, nonce string) (*GoogleIDToken, error) {
+	keys, err := fetchGoogleKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return verifyIDToken(rawToken, keys, signInConfig.ClientID, nonce, time.Now())
+}
+
+func verifyIDToken(
+	rawToken string, keys map[string]*rsa.PublicKey,
+	clientID, nonce string, now time.Time,
+) (*GoogleIDToken, error) {
+
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed id token header")
+	}
+
+	if err := json.Unmarshal(data, &header); err != nil {
+		return nil, errors.Wrap(err, "malformed id token header")
+	}
+
+	key, ok := keys[header.Kid]
+	if header.Alg != "RS256" || !ok {
+		return nil, errors.Errorf("id token signed with unknown key %q", header.Kid)
+	}
+
+	if err := jws.Verify(rawToken, key); err != nil {
+		return nil, errors.Wrap(err, "invalid id token signature")
+	}
+
+	var token GoogleIDToken
+	data, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed id token claims")
+	}
+
+	if err := json.Unmarshal(data, &token); err != nil {
+		return nil, errors.Wrap(err, "malformed id token claims")
+	}
+
+	switch {
+	case token.Issuer != "accounts.google.com" && token.Issuer != "https://accounts.google.com":
+		return nil, errors.Errorf("unexpected id token issuer %q", token.Issuer)
+	case token.Audience != clientID:
+		return nil, errors.New("id token was not issued for this client")
+	case now.Add(-idTokenClockSkew).Unix() >= token.Expiry:
+		return nil, errors.New("id token has expired")
+	case nonce == "" || token.Nonce != nonce:
+		return nil, errors.New("id token nonce mismatch")
+	case !bool(token.EmailVerified) || token.Email == "":
+		return nil, errors.New("id token e-mail address is not verified")
+	}
+
+	return &token, nil
+}
@@ -0,0 +1,85 @@
+package integrations
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func signTestIDToken(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": kid})
+	payload, _ := json.Marshal(claims)
+	content := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+
+	hashed := sha256.Sum256([]byte(content))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return content + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	t.Parallel()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	keys := map[string]*rsa.PublicKey{"k1": &key.PublicKey}
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":            "https://accounts.google.com",
+			"aud":            "client-id",
+			"sub":            "1234",
+			"exp":            now.Add(time.Hour).Unix(),
+			"nonce":          "nonce",
+			"email":          "jim@acme.com",
+			"email_verified": true,
+			"hd":             "acme.com",
+		}
+
+		for k, v := range overrides {
+			c[k] = v
+		}
+
+		return c
+	}
+
+	token, err := verifyIDToken(signTestIDToken(t, key, "k1", claims(nil)), keys, "client-id", "nonce", now)
+	if err != nil {
+		t.Fatalf("expected token to be valid: %v", err)
+	}
+
+	if token.Email != "jim@acme.com" || token.HostedDomain != "acme.com" {
+		t.Errorf("unexpected token contents: %+v", token)
+	}
+
+	cases := []struct {
+		name  string
+		token string
+	}{
+		{"unknown key", signTestIDToken(t, key, "k2", claims(nil))},
+		{"issuer", signTestIDToken(t, key, "k1", claims(map[string]interface{}{"iss": "https://evil.example.com"}))},
+		{"audience", signTestIDToken(t, key, "k1", claims(map[string]interface{}{"aud": "other-client"}))},
+		{"expired", signTestIDToken(t, key, "k1", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}))},
+		{"nonce", signTestIDToken(t, key, "k1", claims(map[string]interface{}{"nonce": "other"}))},
+		{"unverified", signTestIDToken(t, key, "k1", claims(map[string]interface{}{"email_verified": "false"}))},
+		{"malformed", "a.b"},
+	}
+
+	for _, test := range cases {
+		if _, err := verifyIDToken(test.token, keys, "client-id", "nonce", now); err == nil {
+			t.Errorf("expected %s check to fail", test.name)
+		}
+	}
+}
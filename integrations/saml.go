@@ -0,0 +1,466 @@
+package integrations
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	samlAssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+
+	samlBindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlBindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlNameIDEmail     = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	samlBearer          = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+
+	// samlClockSkew is the amount of clock drift that is tolerated
+	// between us and Identity Providers.
+	samlClockSkew = 3 * time.Minute
+)
+
+var (
+	// ErrSAMLEncryptedAssertion is returned when an IdP sends an
+	// encrypted assertion.  We don't publish an encryption key so
+	// these are not supported.
+	ErrSAMLEncryptedAssertion = errors.New("encrypted assertions are not supported")
+)
+
+// SAMLServiceProvider describes our end of a SAML integration for a
+// specific Company.
+type SAMLServiceProvider struct {
+	EntityID string
+	ACSURL   string
+}
+
+// SAMLIdentityProvider is the subset of an IdP's metadata that is
+// required in order to authenticate users against it.
+type SAMLIdentityProvider struct {
+	EntityID     string
+	SSOURL       string
+	Certificates []*x509.Certificate
+}
+
+// SAMLAssertion contains the information that we extract from a
+// verified SAML Response.
+type SAMLAssertion struct {
+	ID           string
+	InResponseTo string
+	NameID       string
+	NotOnOrAfter time.Time
+	Attributes   map[string][]string
+}
+
+type samlMetadata struct {
+	XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID    string   `xml:"entityID,attr"`
+	Descriptors []struct {
+		Keys []struct {
+			Use          string   `xml:"use,attr"`
+			Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
+		Services []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleSignOnService"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
+}
+
+// ParseSAMLMetadata reads an IdP's EntityDescriptor.  Only the
+// HTTP-Redirect binding is supported for sending AuthnRequests.
+func ParseSAMLMetadata(data []byte) (*SAMLIdentityProvider, error) {
+	var m samlMetadata
+	if err := xml.Unmarshal(data, &m); err != nil {
+		return nil, errors.Wrap(err, "failed to parse saml metadata")
+	}
+
+	if m.EntityID == "" || len(m.Descriptors) == 0 {
+		return nil, errors.New("metadata does not describe an identity provider")
+	}
+
+	idp := &SAMLIdentityProvider{EntityID: m.EntityID}
+	for _, d := range m.Descriptors {
+		for _, s := range d.Services {
+			if s.Binding == samlBindingRedirect && idp.SSOURL == "" {
+				idp.SSOURL = s.Location
+			}
+		}
+
+		for _, k := range d.Keys {
+			if k.Use != "" && k.Use != "signing" {
+				continue
+			}
+
+			for _, c := range k.Certificates {
+				der, err := decodeBase64(c)
+				if err != nil {
+					return nil, errors.Wrap(err, "failed to decode certificate")
+				}
+
+				cert, err := x509.ParseCertificate(der)
+				if err != nil {
+					return nil, errors.Wrap(err, "failed to parse certificate")
+				}
+
+				idp.Certificates = append(idp.Certificates, cert)
+			}
+		}
+	}
+
+	if idp.SSOURL == "" {
+		return nil, errors.New("metadata does not contain an HTTP-Redirect sign-on service")
+	}
+
+	if len(idp.Certificates) == 0 {
+		return nil, errors.New("metadata does not contain a signing certificate")
+	}
+
+	return idp, nil
+}
+
+type samlSPMetadata struct {
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID   string   `xml:"entityID,attr"`
+	Descriptor struct {
+		AuthnRequestsSigned  bool   `xml:"AuthnRequestsSigned,attr"`
+		WantAssertionsSigned bool   `xml:"WantAssertionsSigned,attr"`
+		Protocols            string `xml:"protocolSupportEnumeration,attr"`
+		NameIDFormat         string `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
+		ACS                  struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+			Index    int    `xml:"index,attr"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:metadata AssertionConsumerService"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor"`
+}
+
+// Metadata renders the Service Provider's metadata so that it can be
+// imported into an IdP.
+func (sp *SAMLServiceProvider) Metadata() ([]byte, error) {
+	m := samlSPMetadata{EntityID: sp.EntityID}
+	m.Descriptor.WantAssertionsSigned = true
+	m.Descriptor.Protocols = samlProtocolNamespace
+	m.Descriptor.NameIDFormat = samlNameIDEmail
+	m.Descriptor.ACS.Binding = samlBindingPOST
+	m.Descriptor.ACS.Location = sp.ACSURL
+
+	data, err := xml.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal saml metadata")
+	}
+
+	return append([]byte(xml.Header), data...), nil
+}
+
+func newSAMLID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	// xs:ID values may not start with a digit.
+	return "_" + hex.EncodeToString(b)
+}
+
+// AuthnRequestURL builds the URL that users need to be redirected to
+// in order to authenticate with the IdP.  The request id is returned
+// so that it can be matched against the Response later on.
+func (sp *SAMLServiceProvider) AuthnRequestURL(
+	idp *SAMLIdentityProvider, relayState string,
+) (string, string, error) {
+
+	id := newSAMLID()
+	request := fmt.Sprintf(
+		`<samlp:AuthnRequest xmlns:samlp="%s" xmlns:saml="%s" ID="%s" Version="2.0" IssueInstant="%s" Destination="%s" AssertionConsumerServiceURL="%s" ProtocolBinding="%s">`+
+			`<saml:Issuer>%s</saml:Issuer>`+
+			`<samlp:NameIDPolicy Format="%s" AllowCreate="true"/>`+
+			`</samlp:AuthnRequest>`,
+		samlProtocolNamespace, samlAssertionNamespace, id,
+		time.Now().UTC().Format(time.RFC3339),
+		escapeXML(idp.SSOURL), escapeXML(sp.ACSURL), samlBindingPOST,
+		escapeXML(sp.EntityID), samlNameIDEmail,
+	)
+
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	if _, err := w.Write([]byte(request)); err != nil {
+		return "", "", errors.Wrap(err, "failed to deflate authn request")
+	}
+
+	if err := w.Close(); err != nil {
+		return "", "", errors.Wrap(err, "failed to deflate authn request")
+	}
+
+	location, err := url.Parse(idp.SSOURL)
+	if err != nil {
+		return "", "", errors.Wrap(err, "invalid sso url")
+	}
+
+	query := location.Query()
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+
+	location.RawQuery = query.Encode()
+	return location.String(), id, nil
+}
+
+func escapeXML(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// sameURL compares two URLs ignoring their schemes.  We sit behind
+// App Engine's SSL termination so the scheme we generate URLs with
+// isn't necessarily the one the IdP was configured with.
+func sameURL(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(ua.Host, ub.Host) && ua.Path == ub.Path
+}
+
+func parseSAMLTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// ParseResponse decodes and verifies a base64-encoded SAML Response
+// that was POSTed to our ACS.  Either the Response or its Assertion
+// must be signed by one of the IdP's certificates.
+func (sp *SAMLServiceProvider) ParseResponse(
+	idp *SAMLIdentityProvider, encoded string, now time.Time,
+) (*SAMLAssertion, error) {
+
+	data, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode saml response")
+	}
+
+	response, err := parseXMLElement(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if !response.is(samlProtocolNamespace, "Response") {
+		return nil, errors.New("document is not a saml response")
+	}
+
+	if destination := response.attr("Destination"); destination != "" && !sameURL(destination, sp.ACSURL) {
+		return nil, errors.Errorf("unexpected destination %q", destination)
+	}
+
+	status := response.child(samlProtocolNamespace, "Status")
+	if status == nil {
+		return nil, errors.New("response has no status")
+	}
+
+	code := status.child(samlProtocolNamespace, "StatusCode")
+	if code == nil || code.attr("Value") != samlStatusSuccess {
+		return nil, errors.New("authentication failed at the identity provider")
+	}
+
+	if len(response.children(samlAssertionNamespace, "EncryptedAssertion")) > 0 {
+		return nil, ErrSAMLEncryptedAssertion
+	}
+
+	assertions := response.children(samlAssertionNamespace, "Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.New("response must contain exactly one assertion")
+	}
+
+	assertion := assertions[0]
+	signed := false
+	for _, el := range []*xmlElement{response, assertion} {
+		err := verifyXMLSignature(el, idp.Certificates)
+		if err == nil {
+			signed = true
+		} else if err != ErrXMLSignatureMissing {
+			return nil, err
+		}
+	}
+
+	if !signed {
+		return nil, ErrXMLSignatureMissing
+	}
+
+	return sp.readAssertion(idp, assertion, now)
+}
+
+func (sp *SAMLServiceProvider) readAssertion(
+	idp *SAMLIdentityProvider, assertion *xmlElement, now time.Time,
+) (*SAMLAssertion, error) {
+
+	issuer := assertion.child(samlAssertionNamespace, "Issuer")
+	if issuer == nil || issuer.text() != idp.EntityID {
+		return nil, errors.New("assertion was not issued by the identity provider")
+	}
+
+	conditions := assertion.child(samlAssertionNamespace, "Conditions")
+	if conditions == nil {
+		return nil, errors.New("assertion has no conditions")
+	}
+
+	if s := conditions.attr("NotBefore"); s != "" {
+		t, err := parseSAMLTime(s)
+		if err != nil || now.Add(samlClockSkew).Before(t) {
+			return nil, errors.New("assertion is not valid yet")
+		}
+	}
+
+	if s := conditions.attr("NotOnOrAfter"); s != "" {
+		t, err := parseSAMLTime(s)
+		if err != nil || !now.Add(-samlClockSkew).Before(t) {
+			return nil, errors.New("assertion has expired")
+		}
+	}
+
+	audience := false
+	for _, r := range conditions.children(samlAssertionNamespace, "AudienceRestriction") {
+		for _, a := range r.children(samlAssertionNamespace, "Audience") {
+			if a.text() == sp.EntityID {
+				audience = true
+			}
+		}
+	}
+
+	if !audience {
+		return nil, errors.New("assertion is not intended for this service provider")
+	}
+
+	subject := assertion.child(samlAssertionNamespace, "Subject")
+	if subject == nil {
+		return nil, errors.New("assertion has no subject")
+	}
+
+	nameID := subject.child(samlAssertionNamespace, "NameID")
+	if nameID == nil || nameID.text() == "" {
+		return nil, errors.New("assertion has no name id")
+	}
+
+	result := &SAMLAssertion{
+		ID:         assertion.attr("ID"),
+		NameID:     nameID.text(),
+		Attributes: make(map[string][]string),
+	}
+
+	confirmed := false
+	for _, c := range subject.children(samlAssertionNamespace, "SubjectConfirmation") {
+		if c.attr("Method") != samlBearer {
+			continue
+		}
+
+		data := c.child(samlAssertionNamespace, "SubjectConfirmationData")
+		if data == nil || !sameURL(data.attr("Recipient"), sp.ACSURL) {
+			continue
+		}
+
+		t, err := parseSAMLTime(data.attr("NotOnOrAfter"))
+		if err != nil || !now.Add(-samlClockSkew).Before(t) {
+			continue
+		}
+
+		confirmed = true
+		result.InResponseTo = data.attr("InResponseTo")
+		result.NotOnOrAfter = t
+		break
+	}
+
+	if !confirmed {
+		return nil, errors.New("assertion subject could not be confirmed")
+	}
+
+	for _, s := range assertion.children(samlAssertionNamespace, "AttributeStatement") {
+		for _, a := range s.children(samlAssertionNamespace, "Attribute") {
+			var values []string
+			for _, v := range a.children(samlAssertionNamespace, "AttributeValue") {
+				values = append(values, v.text())
+			}
+
+			result.Attributes[a.attr("Name")] = values
+			if friendly := a.attr("FriendlyName"); friendly != "" {
+				result.Attributes[friendly] = values
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// ReplayWindow returns how long the assertion must be remembered in
+// order to detect replays.  ParseResponse accepts assertions until
+// samlClockSkew after they expire so the window always covers at least
+// that much time, plus a safety margin.
+func (a *SAMLAssertion) ReplayWindow(now time.Time) time.Duration {
+	window := a.NotOnOrAfter.Sub(now)
+	if window < 0 {
+		window = 0
+	}
+
+	return window + samlClockSkew + time.Minute
+}
+
+func (a *SAMLAssertion) lookup(names ...string) string {
+	for _, name := range names {
+		if values := a.Attributes[name]; len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+	}
+
+	return ""
+}
+
+// Email returns the e-mail address of the authenticated user.  The
+// NameID is preferred but common attribute names are used as a
+// fallback for IdPs that use opaque identifiers.
+func (a *SAMLAssertion) Email() string {
+	if strings.Contains(a.NameID, "@") {
+		return a.NameID
+	}
+
+	return a.lookup(
+		"email", "mail", "Email",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+		"urn:oid:0.9.2342.19200300.100.1.3",
+	)
+}
+
+// FirstName returns the given name of the authenticated user if the
+// IdP provided one.
+func (a *SAMLAssertion) FirstName() string {
+	return a.lookup(
+		"givenName", "firstName", "FirstName",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/givenname",
+		"urn:oid:2.5.4.42",
+	)
+}
+
+// LastName returns the surname of the authenticated user if the IdP
+// provided one.
+func (a *SAMLAssertion) LastName() string {
+	return a.lookup(
+		"sn", "surname", "lastName", "LastName",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/surname",
+		"urn:oid:2.5.4.4",
+	)
+}
@@ -0,0 +1,362 @@
+package integrations
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIdPEntityID = "https://idp.example.com/metadata"
+	testSPEntityID  = "http://acme.teamzones.io/sso/saml/metadata"
+	testACSURL      = "http://acme.teamzones.io/sso/saml/acs"
+)
+
+func newTestIdP(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key, cert
+}
+
+func findElementByID(el *xmlElement, id string) *xmlElement {
+	if el.attr("ID") == id {
+		return el
+	}
+
+	for _, c := range el.Children {
+		if child, ok := c.(*xmlElement); ok {
+			if found := findElementByID(child, id); found != nil {
+				return found
+			}
+		}
+	}
+
+	return nil
+}
+
+// signTestDocument replaces the <!--signature--> placeholder inside
+// the element with the given id with an enveloped signature.
+func signTestDocument(t *testing.T, key *rsa.PrivateKey, doc, id string) string {
+	root, err := parseXMLElement(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := sha256.Sum256(findElementByID(root, id).canonicalize(nil, nil))
+	signature := fmt.Sprintf(
+		`<ds:Signature xmlns:ds="%s"><ds:SignedInfo>`+
+			`<ds:CanonicalizationMethod Algorithm="%s"/>`+
+			`<ds:SignatureMethod Algorithm="%s"/>`+
+			`<ds:Reference URI="#%s"><ds:Transforms>`+
+			`<ds:Transform Algorithm="%s"/><ds:Transform Algorithm="%s"/>`+
+			`</ds:Transforms><ds:DigestMethod Algorithm="%s"/>`+
+			`<ds:DigestValue>%s</ds:DigestValue></ds:Reference>`+
+			`</ds:SignedInfo><ds:SignatureValue>SIGNATURE</ds:SignatureValue></ds:Signature>`,
+		xmldsigNamespace, excC14NAlgorithm, rsaSHA256Algorithm, id,
+		envelopedSigAlgo, excC14NAlgorithm, sha256Algorithm,
+		base64.StdEncoding.EncodeToString(digest[:]),
+	)
+
+	doc = strings.Replace(doc, "<!--signature-->", signature, 1)
+	root, err = parseXMLElement(strings.NewReader(doc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signedInfo := findElementByID(root, id).
+		child(xmldsigNamespace, "Signature").
+		child(xmldsigNamespace, "SignedInfo")
+	hashed := sha256.Sum256(signedInfo.canonicalize(nil, nil))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.Replace(doc, "SIGNATURE", base64.StdEncoding.EncodeToString(sig), 1)
+}
+
+func buildTestResponse(audience string, notOnOrAfter time.Time) string {
+	return fmt.Sprintf(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_response" Version="2.0" Destination="%[4]s">
+  <saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">%[1]s</saml:Issuer>
+  <samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>
+  <saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_assertion" Version="2.0">
+    <saml:Issuer>%[1]s</saml:Issuer><!--signature-->
+    <saml:Subject>
+      <saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">jim@acme.com</saml:NameID>
+      <saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">
+        <saml:SubjectConfirmationData InResponseTo="_request" NotOnOrAfter="%[3]s" Recipient="%[4]s"/>
+      </saml:SubjectConfirmation>
+    </saml:Subject>
+    <saml:Conditions NotOnOrAfter="%[3]s">
+      <saml:AudienceRestriction><saml:Audience>%[2]s</saml:Audience></saml:AudienceRestriction>
+    </saml:Conditions>
+    <saml:AttributeStatement>
+      <saml:Attribute Name="givenName"><saml:AttributeValue>Jim</saml:AttributeValue></saml:Attribute>
+      <saml:Attribute Name="sn"><saml:AttributeValue>Halpert &amp; Co</saml:AttributeValue></saml:Attribute>
+    </saml:AttributeStatement>
+  </saml:Assertion>
+</samlp:Response>`, testIdPEntityID, audience, notOnOrAfter.UTC().Format(time.RFC3339), testACSURL)
+}
+
+func TestSAMLResponseVerification(t *testing.T) {
+	t.Parallel()
+
+	key, cert := newTestIdP(t)
+	_, otherCert := newTestIdP(t)
+	sp := &SAMLServiceProvider{EntityID: testSPEntityID, ACSURL: testACSURL}
+	idp := &SAMLIdentityProvider{
+		EntityID:     testIdPEntityID,
+		Certificates: []*x509.Certificate{cert},
+	}
+
+	now := time.Now()
+	valid := signTestDocument(t, key, buildTestResponse(testSPEntityID, now.Add(5*time.Minute)), "_assertion")
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	assertion, err := sp.ParseResponse(idp, encode(valid), now)
+	if err != nil {
+		t.Fatalf("expected valid response to pass: %v", err)
+	}
+
+	if assertion.Email() != "jim@acme.com" || assertion.FirstName() != "Jim" || assertion.LastName() != "Halpert & Co" {
+		t.Errorf("unexpected assertion contents: %+v", assertion)
+	}
+
+	if assertion.InResponseTo != "_request" {
+		t.Errorf("expected InResponseTo to be _request, got %q", assertion.InResponseTo)
+	}
+
+	cases := []struct {
+		name     string
+		response string
+		idp      *SAMLIdentityProvider
+		now      time.Time
+	}{
+		{"tampered", strings.Replace(valid, "jim@acme.com", "michael@acme.com", 1), idp, now},
+		{"unsigned", buildTestResponse(testSPEntityID, now.Add(5*time.Minute)), idp, now},
+		{"expired", valid, idp, now.Add(time.Hour)},
+		{"untrusted", valid, &SAMLIdentityProvider{EntityID: testIdPEntityID, Certificates: []*x509.Certificate{otherCert}}, now},
+		{"audience", signTestDocument(t, key, buildTestResponse("http://evil.example.com", now.Add(5*time.Minute)), "_assertion"), idp, now},
+	}
+
+	for _, test := range cases {
+		if _, err := sp.ParseResponse(test.idp, encode(test.response), test.now); err == nil {
+			t.Errorf("expected %s response to fail", test.name)
+		}
+	}
+}
+
+func TestSAMLAssertionReplayWindow(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	cases := []struct {
+		notOnOrAfter time.Time
+		expected     time.Duration
+	}{
+		{now.Add(5 * time.Minute), 5*time.Minute + samlClockSkew + time.Minute},
+		{now, samlClockSkew + time.Minute},
+		{now.Add(-2 * time.Minute), samlClockSkew + time.Minute},
+	}
+
+	for _, test := range cases {
+		assertion := &SAMLAssertion{NotOnOrAfter: test.notOnOrAfter}
+		if window := assertion.ReplayWindow(now); window != test.expected {
+			t.Errorf("expected window of %v for %v, got %v", test.expected, test.notOnOrAfter, window)
+		}
+	}
+}
+
+func TestSAMLSignedResponse(t *testing.T) {
+	t.Parallel()
+
+	key, cert := newTestIdP(t)
+	sp := &SAMLServiceProvider{EntityID: testSPEntityID, ACSURL: testACSURL}
+	idp := &SAMLIdentityProvider{
+		EntityID:     testIdPEntityID,
+		Certificates: []*x509.Certificate{cert},
+	}
+
+	now := time.Now()
+	response := buildTestResponse(testSPEntityID, now.Add(5*time.Minute))
+	response = strings.Replace(response, "<!--signature-->", "", 1)
+	response = strings.Replace(response, "</saml:Issuer>\n  <samlp:Status>", "</saml:Issuer><!--signature-->\n  <samlp:Status>", 1)
+	response = signTestDocument(t, key, response, "_response")
+
+	encoded := base64.StdEncoding.EncodeToString([]byte(response))
+	if _, err := sp.ParseResponse(idp, encoded, now); err != nil {
+		t.Fatalf("expected signed response to pass: %v", err)
+	}
+}
+
+func TestParseSAMLMetadata(t *testing.T) {
+	t.Parallel()
+
+	_, cert := newTestIdP(t)
+	metadata := fmt.Sprintf(`<?xml version="1.0"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="%s">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+        <ds:X509Data><ds:X509Certificate>%s</ds:X509Certificate></ds:X509Data>
+      </ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://idp.example.com/post"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://idp.example.com/redirect"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`, testIdPEntityID, base64.StdEncoding.EncodeToString(cert.Raw))
+
+	idp, err := ParseSAMLMetadata([]byte(metadata))
+	if err != nil {
+		t.Fatalf("failed to parse metadata: %v", err)
+	}
+
+	if idp.EntityID != testIdPEntityID || idp.SSOURL != "https://idp.example.com/redirect" || len(idp.Certificates) != 1 {
+		t.Errorf("unexpected identity provider: %+v", idp)
+	}
+
+	sp := &SAMLServiceProvider{EntityID: testSPEntityID, ACSURL: testACSURL}
+	location, id, err := sp.AuthnRequestURL(idp, "/meetings/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(location, "https://idp.example.com/redirect?") || !strings.HasPrefix(id, "_") {
+		t.Errorf("unexpected authn request url %q (id %q)", location, id)
+	}
+}
+
+// loadSAMLFixture reads an identity provider's metadata and a base64
+// encoded response from fixtures/saml.  Some of the metadata files only
+// advertise an HTTP-POST sign-on service, which is irrelevant to
+// verifying responses, so it's treated as if it were HTTP-Redirect.
+func loadSAMLFixture(t *testing.T, metadataFile, responseFile string) (*SAMLIdentityProvider, string) {
+	metadata, err := ioutil.ReadFile("fixtures/saml/" + metadataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metadata = []byte(strings.Replace(string(metadata), "bindings:HTTP-POST", "bindings:HTTP-Redirect", 1))
+	idp, err := ParseSAMLMetadata(metadata)
+	if err != nil {
+		t.Fatalf("failed to parse %s: %v", metadataFile, err)
+	}
+
+	response, err := ioutil.ReadFile("fixtures/saml/" + responseFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return idp, strings.TrimSpace(string(response))
+}
+
+func TestSAMLRealWorldResponses(t *testing.T) {
+	t.Parallel()
+
+	cases := []struct {
+		metadata string
+		response string
+		sp       *SAMLServiceProvider
+		now      string
+		nameID   string
+	}{
+		{
+			"onelogin_metadata.xml", "onelogin_response.b64",
+			&SAMLServiceProvider{EntityID: "https://29ee6d2e.ngrok.io/saml/metadata", ACSURL: "https://29ee6d2e.ngrok.io/saml/acs"},
+			"2016-01-05T17:53:12Z", "ross@kndr.org",
+		},
+		{
+			"signed_assertion_metadata.xml", "signed_assertion_response.b64",
+			&SAMLServiceProvider{EntityID: "http://sp.example.com/demo1/metadata.php", ACSURL: "http://sp.example.com/demo1/index.php?acs"},
+			"2014-07-17T01:02:59Z", "_ce3d2948b4cf20146dee0a0b3dd6f69b6cf86f62d7",
+		},
+		{
+			"secureworks_metadata.xml", "secureworks_response.b64",
+			&SAMLServiceProvider{EntityID: "https://preview.docrocket-ross.test.octolabs.io/saml/metadata", ACSURL: "https://preview.docrocket-ross.test.octolabs.io/saml/acs"},
+			"2017-04-21T13:12:51Z", "rkinder@secureworks.com",
+		},
+	}
+
+	for _, test := range cases {
+		idp, response := loadSAMLFixture(t, test.metadata, test.response)
+		now, _ := time.Parse(time.RFC3339, test.now)
+		assertion, err := test.sp.ParseResponse(idp, response, now)
+		if err != nil {
+			t.Errorf("expected %s to pass: %v", test.response, err)
+			continue
+		}
+
+		if assertion.NameID != test.nameID {
+			t.Errorf("%s: expected NameID %q, got %q", test.response, test.nameID, assertion.NameID)
+		}
+
+		tampered, _ := base64.StdEncoding.DecodeString(response)
+		tampered = []byte(strings.Replace(string(tampered), test.nameID, "michael@acme.com", 1))
+		if _, err := test.sp.ParseResponse(idp, base64.StdEncoding.EncodeToString(tampered), now); err == nil {
+			t.Errorf("expected tampered %s to fail", test.response)
+		}
+	}
+}
+
+func TestSAMLSignatureWrappingIsRejected(t *testing.T) {
+	t.Parallel()
+
+	onelogin := &SAMLServiceProvider{EntityID: "https://29ee6d2e.ngrok.io/saml/metadata", ACSURL: "https://29ee6d2e.ngrok.io/saml/acs"}
+	example := &SAMLServiceProvider{EntityID: "http://sp.example.com/demo1/metadata.php", ACSURL: "http://sp.example.com/demo1/index.php?acs"}
+	cases := []struct {
+		metadata string
+		response string
+		sp       *SAMLServiceProvider
+		now      string
+	}{
+		{"onelogin_metadata.xml", "onelogin_xsw1.b64", onelogin, "2016-01-05T17:53:12Z"},
+		{"onelogin_metadata.xml", "onelogin_xsw2.b64", onelogin, "2016-01-05T17:53:12Z"},
+		{"signed_assertion_metadata.xml", "signed_assertion_xsw3.b64", example, "2014-07-17T01:02:59Z"},
+		{"signed_assertion_metadata.xml", "signed_assertion_xsw4.b64", example, "2014-07-17T01:02:59Z"},
+		{"signed_assertion_metadata.xml", "signed_assertion_xsw5.b64", example, "2014-07-17T01:02:59Z"},
+		{"signed_assertion_metadata.xml", "signed_assertion_xsw6.b64", example, "2014-07-17T01:02:59Z"},
+		{"signed_assertion_metadata.xml", "signed_assertion_xsw7.b64", example, "2014-07-17T01:02:59Z"},
+		{"signed_assertion_metadata.xml", "signed_assertion_xsw8.b64", example, "2014-07-17T01:02:59Z"},
+		{"signed_assertion_metadata.xml", "signed_assertion_xsw9.b64", example, "2014-07-17T01:02:59Z"},
+	}
+
+	for _, test := range cases {
+		idp, response := loadSAMLFixture(t, test.metadata, test.response)
+		now, _ := time.Parse(time.RFC3339, test.now)
+		if assertion, err := test.sp.ParseResponse(idp, response, now); err == nil {
+			t.Errorf("expected %s to fail, got %+v", test.response, assertion)
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package integrations
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	webAuthnFlagUserPresent  = 0x01
+	webAuthnFlagUserVerified = 0x04
+	webAuthnFlagAttested     = 0x40
+
+	coseKeyType     = 1
+	coseAlgorithm   = 3
+	coseKeyTypeEC2  = 2
+	coseKeyTypeRSA  = 3
+	coseAlgES256    = -7
+	coseAlgRS256    = -257
+	coseCurveP256   = 1
+	coseEC2Curve    = -1
+	coseEC2X        = -2
+	coseEC2Y        = -3
+	coseRSAModulus  = -1
+	coseRSAExponent = -2
+
+	webAuthnTimeout = 60000
+)
+
+var (
+	// ErrWebAuthnInvalid is returned when a registration or
+	// assertion response fails verification.
+	ErrWebAuthnInvalid = errors.New("invalid webauthn response")
+
+	webAuthnEncoding = base64.RawURLEncoding
+)
+
+// WebAuthnRelyingParty verifies WebAuthn ceremonies on behalf of a
+// single origin.  ID is the effective domain of Origin.
+type WebAuthnRelyingParty struct {
+	ID     string
+	Name   string
+	Origin string
+}
+
+// WebAuthnCredential is a public key credential that was created by
+// an authenticator during registration.
+type WebAuthnCredential struct {
+	ID        []byte
+	PublicKey []byte // COSE_Key
+	SignCount uint32
+}
+
+// NewWebAuthnChallenge returns a random, base64url-encoded challenge.
+func NewWebAuthnChallenge() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return webAuthnEncoding.EncodeToString(b)
+}
+
+// EncodeWebAuthnID base64url-encodes credential ids and user handles.
+func EncodeWebAuthnID(id []byte) string {
+	return webAuthnEncoding.EncodeToString(id)
+}
+
+// DecodeWebAuthnID decodes base64url-encoded values.  Padding is
+// optional.
+func DecodeWebAuthnID(id string) ([]byte, error) {
+	return webAuthnEncoding.DecodeString(string(bytes.TrimRight([]byte(id), "=")))
+}
+
+type webAuthnEntity struct {
+	ID          string `json:"id,omitempty"`
+	Name        string `json:"name"`
+	DisplayName string `json:"displayName,omitempty"`
+}
+
+type webAuthnParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type webAuthnDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// WebAuthnCreationOptions is serialized and passed to
+// navigator.credentials.create().  Binary values are base64url
+// encoded and must be decoded client-side.
+type WebAuthnCreationOptions struct {
+	Challenge          string               `json:"challenge"`
+	RP                 webAuthnEntity       `json:"rp"`
+	User               webAuthnEntity       `json:"user"`
+	PubKeyCredParams   []webAuthnParameter  `json:"pubKeyCredParams"`
+	Timeout            int                  `json:"timeout"`
+	ExcludeCredentials []webAuthnDescriptor `json:"excludeCredentials"`
+	Attestation        string               `json:"attestation"`
+	ResidentKey        string               `json:"residentKey"`
+}
+
+// WebAuthnRequestOptions is serialized and passed to
+// navigator.credentials.get().
+type WebAuthnRequestOptions struct {
+	Challenge        string               `json:"challenge"`
+	RPID             string               `json:"rpId"`
+	Timeout          int                  `json:"timeout"`
+	AllowCredentials []webAuthnDescriptor `json:"allowCredentials"`
+	UserVerification string               `json:"userVerification"`
+}
+
+func webAuthnDescriptors(ids [][]byte) []webAuthnDescriptor {
+	descriptors := make([]webAuthnDescriptor, len(ids))
+	for i, id := range ids {
+		descriptors[i] = webAuthnDescriptor{"public-key", EncodeWebAuthnID(id)}
+	}
+
+	return descriptors
+}
+
+// CreationOptions builds the options for registering a new
+// credential.  Existing credentials are excluded so that the same
+// authenticator can't be registered twice.
+func (rp *WebAuthnRelyingParty) CreationOptions(
+	challenge string, userHandle []byte, userName, displayName string,
+	exclude [][]byte,
+) *WebAuthnCreationOptions {
+
+	return &WebAuthnCreationOptions{
+		Challenge: challenge,
+		RP:        webAuthnEntity{ID: rp.ID, Name: rp.Name},
+		User: webAuthnEntity{
+			ID:          EncodeWebAuthnID(userHandle),
+			Name:        userName,
+			DisplayName: displayName,
+		},
+		PubKeyCredParams: []webAuthnParameter{
+			{"public-key", coseAlgES256},
+			{"public-key", coseAlgRS256},
+		},
+		Timeout:            webAuthnTimeout,
+		ExcludeCredentials: webAuthnDescriptors(exclude),
+		Attestation:        "none",
+		ResidentKey:        "preferred",
+	}
+}
+
+// RequestOptions builds the options for asserting a credential.  An
+// empty allow list lets the authenticator pick a discoverable
+// credential (i.e. a passkey).
+func (rp *WebAuthnRelyingParty) RequestOptions(challenge string, allow [][]byte) *WebAuthnRequestOptions {
+	return &WebAuthnRequestOptions{
+		Challenge:        challenge,
+		RPID:             rp.ID,
+		Timeout:          webAuthnTimeout,
+		AllowCredentials: webAuthnDescriptors(allow),
+		UserVerification: "preferred",
+	}
+}
+
+type webAuthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+func (rp *WebAuthnRelyingParty) verifyClientData(data []byte, kind, challenge string) error {
+	var clientData webAuthnClientData
+	if err := json.Unmarshal(data, &clientData); err != nil {
+		return errors.Wrap(err, "malformed client data")
+	}
+
+	switch {
+	case clientData.Type != kind:
+		return errors.Errorf("unexpected client data type %q", clientData.Type)
+	case challenge == "" || subtle.ConstantTimeCompare([]byte(clientData.Challenge), []byte(challenge)) != 1:
+		return errors.New("challenge mismatch")
+	case clientData.Origin != rp.Origin:
+		return errors.Errorf("unexpected origin %q", clientData.Origin)
+	}
+
+	return nil
+}
+
+type webAuthnAuthenticatorData struct {
+	RPIDHash  []byte
+	Flags     byte
+	SignCount uint32
+
+	CredentialID []byte
+	PublicKey    []byte
+}
+
+func parseAuthenticatorData(data []byte) (*webAuthnAuthenticatorData, error) {
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+
+	authData := webAuthnAuthenticatorData{
+		RPIDHash:  data[:32],
+		Flags:     data[32],
+		SignCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	if authData.Flags&webAuthnFlagAttested == 0 {
+		return &authData, nil
+	}
+
+	rest := data[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data is too short")
+	}
+
+	// Skip the AAGUID.
+	n := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < n {
+		return nil, errors.New("credential id is truncated")
+	}
+
+	authData.CredentialID = rest[:n]
+	rest = rest[n:]
+
+	_, remaining, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, errors.Wrap(err, "malformed credential public key")
+	}
+
+	authData.PublicKey = rest[:len(rest)-len(remaining)]
+	return &authData, nil
+}
+
+func (rp *WebAuthnRelyingParty) verifyAuthenticatorData(authData *webAuthnAuthenticatorData) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if subtle.ConstantTimeCompare(authData.RPIDHash, rpIDHash[:]) != 1 {
+		return errors.New("relying party id mismatch")
+	}
+
+	if authData.Flags&webAuthnFlagUserPresent == 0 {
+		return errors.New("user was not present")
+	}
+
+	return nil
+}
+
+// VerifyRegistration validates the response to a
+// navigator.credentials.create() call.  Attestation statements are
+// not verified since we request "none" attestation.
+func (rp *WebAuthnRelyingParty) VerifyRegistration(
+	challenge string, clientDataJSON, attestationObject []byte,
+) (*WebAuthnCredential, error) {
+
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.create", challenge); err != nil {
+		return nil, errors.Wrap(ErrWebAuthnInvalid, err.Error())
+	}
+
+	decoded, _, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, errors.Wrap(ErrWebAuthnInvalid, err.Error())
+	}
+
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.Wrap(ErrWebAuthnInvalid, "attestation object is not a map")
+	}
+
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return nil, errors.Wrap(ErrWebAuthnInvalid, "attestation object has no authenticator data")
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, errors.Wrap(ErrWebAuthnInvalid, err.Error())
+	}
+
+	if err := rp.verifyAuthenticatorData(authData); err != nil {
+		return nil, errors.Wrap(ErrWebAuthnInvalid, err.Error())
+	}
+
+	if authData.CredentialID == nil {
+		return nil, errors.Wrap(ErrWebAuthnInvalid, "no attested credential data")
+	}
+
+	if _, err := parseCOSEKey(authData.PublicKey); err != nil {
+		return nil, errors.Wrap(ErrWebAuthnInvalid, err.Error())
+	}
+
+	return &WebAuthnCredential{
+		ID:        authData.CredentialID,
+		PublicKey: authData.PublicKey,
+		SignCount: authData.SignCount,
+	}, nil
+}
+
+// VerifyAssertion validates the response to a
+// navigator.credentials.get() call against a stored credential and
+// returns the authenticator's new signature counter.  If
+// userVerification is true then the authenticator must have verified
+// the user (e.g. via biometrics or a PIN).
+func (rp *WebAuthnRelyingParty) VerifyAssertion(
+	challenge string, credential *WebAuthnCredential,
+	clientDataJSON, authenticatorData, signature []byte,
+	userVerification bool,
+) (uint32, error) {
+
+	if err := rp.verifyClientData(clientDataJSON, "webauthn.get", challenge); err != nil {
+		return 0, errors.Wrap(ErrWebAuthnInvalid, err.Error())
+	}
+
+	authData, err := parseAuthenticatorData(authenticatorData)
+	if err != nil {
+		return 0, errors.Wrap(ErrWebAuthnInvalid, err.Error())
+	}
+
+	if err := rp.verifyAuthenticatorData(authData); err != nil {
+		return 0, errors.Wrap(ErrWebAuthnInvalid, err.Error())
+	}
+
+	if userVerification && authData.Flags&webAuthnFlagUserVerified == 0 {
+		return 0, errors.Wrap(ErrWebAuthnInvalid, "user was not verified")
+	}
+
+	key, err := parseCOSEKey(credential.PublicKey)
+	if err != nil {
+		return 0, errors.Wrap(ErrWebAuthnInvalid, err.Error())
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signed := append(append([]byte{}, authenticatorData...), clientDataHash[:]...)
+	if err := verifyCOSESignature(key, signed, signature); err != nil {
+		return 0, errors.Wrap(ErrWebAuthnInvalid, err.Error())
+	}
+
+	// Authenticators that support counters must always increase
+	// them.  A counter that goes backwards indicates a cloned
+	// authenticator.
+	if (authData.SignCount != 0 || credential.SignCount != 0) && authData.SignCount <= credential.SignCount {
+		return 0, errors.Wrap(ErrWebAuthnInvalid, "signature counter did not increase")
+	}
+
+	return authData.SignCount, nil
+}
+
+func parseCOSEKey(data []byte) (crypto.PublicKey, error) {
+	decoded, _, err := decodeCBOR(data)
+	if err != nil {
+		return nil, err
+	}
+
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("public key is not a map")
+	}
+
+	bytesParam := func(label int64) []byte {
+		b, _ := key[label].([]byte)
+		return b
+	}
+
+	kty, _ := key[int64(coseKeyType)].(int64)
+	alg, _ := key[int64(coseAlgorithm)].(int64)
+	switch {
+	case kty == coseKeyTypeEC2 && alg == coseAlgES256:
+		crv, _ := key[int64(coseEC2Curve)].(int64)
+		x, y := bytesParam(coseEC2X), bytesParam(coseEC2Y)
+		if crv != coseCurveP256 || len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("unsupported elliptic curve key")
+		}
+
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("public key is not on the curve")
+		}
+
+		return pub, nil
+
+	case kty == coseKeyTypeRSA && alg == coseAlgRS256:
+		n, e := bytesParam(coseRSAModulus), bytesParam(coseRSAExponent)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("unsupported rsa key")
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	}
+
+	return nil, errors.Errorf("unsupported public key type %d with algorithm %d", kty, alg)
+}
+
+func verifyCOSESignature(key crypto.PublicKey, signed, signature []byte) error {
+	hashed := sha256.Sum256(signed)
+
+	switch pub := key.(type) {
+	case *ecdsa.PublicKey:
+		var sig struct {
+			R, S *big.Int
+		}
+
+		if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) != 0 {
+			return errors.New("malformed signature")
+		}
+
+		if !ecdsa.Verify(pub, hashed[:], sig.R, sig.S) {
+			return errors.New("signature mismatch")
+		}
+
+		return nil
+
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, hashed[:], signature)
+	}
+
+	return errors.New("unsupported public key")
+}
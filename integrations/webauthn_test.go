@@ -0,0 +1,245 @@
+package integrations
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+// cborPair is a map entry for encodeTestCBOR.  Entries are encoded in
+// the given order.
+type cborPair struct {
+	key, value interface{}
+}
+
+func encodeTestCBORHead(buf *bytes.Buffer, major byte, arg uint64) {
+	switch {
+	case arg < 24:
+		buf.WriteByte(major<<5 | byte(arg))
+	case arg <= 0xff:
+		buf.WriteByte(major<<5 | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= 0xffff:
+		buf.WriteByte(major<<5 | 25)
+		binary.Write(buf, binary.BigEndian, uint16(arg))
+	default:
+		buf.WriteByte(major<<5 | 26)
+		binary.Write(buf, binary.BigEndian, uint32(arg))
+	}
+}
+
+func encodeTestCBOR(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case int:
+		if v >= 0 {
+			encodeTestCBORHead(buf, 0, uint64(v))
+		} else {
+			encodeTestCBORHead(buf, 1, uint64(-1-v))
+		}
+	case []byte:
+		encodeTestCBORHead(buf, 2, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		encodeTestCBORHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case []cborPair:
+		encodeTestCBORHead(buf, 5, uint64(len(v)))
+		for _, pair := range v {
+			encodeTestCBOR(buf, pair.key)
+			encodeTestCBOR(buf, pair.value)
+		}
+	default:
+		panic("unsupported test cbor value")
+	}
+}
+
+// softwareAuthenticator emulates a platform authenticator with a
+// single ES256 credential.
+type softwareAuthenticator struct {
+	rpID      string
+	origin    string
+	id        []byte
+	key       *ecdsa.PrivateKey
+	signCount uint32
+	flags     byte
+}
+
+func newSoftwareAuthenticator(t *testing.T, rpID, origin string) *softwareAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &softwareAuthenticator{
+		rpID:   rpID,
+		origin: origin,
+		id:     []byte("credential-1"),
+		key:    key,
+		flags:  webAuthnFlagUserPresent | webAuthnFlagUserVerified,
+	}
+}
+
+func (a *softwareAuthenticator) clientData(kind, challenge string) []byte {
+	data, _ := json.Marshal(webAuthnClientData{kind, challenge, a.origin})
+	return data
+}
+
+func (a *softwareAuthenticator) publicKey() []byte {
+	var buf bytes.Buffer
+	pad := func(b []byte) []byte {
+		return append(make([]byte, 32-len(b)), b...)
+	}
+
+	encodeTestCBOR(&buf, []cborPair{
+		{coseKeyType, coseKeyTypeEC2},
+		{coseAlgorithm, coseAlgES256},
+		{coseEC2Curve, coseCurveP256},
+		{coseEC2X, pad(a.key.X.Bytes())},
+		{coseEC2Y, pad(a.key.Y.Bytes())},
+	})
+	return buf.Bytes()
+}
+
+func (a *softwareAuthenticator) authenticatorData(attested bool) []byte {
+	var buf bytes.Buffer
+	rpIDHash := sha256.Sum256([]byte(a.rpID))
+	buf.Write(rpIDHash[:])
+
+	flags := a.flags
+	if attested {
+		flags |= webAuthnFlagAttested
+	}
+
+	buf.WriteByte(flags)
+	binary.Write(&buf, binary.BigEndian, a.signCount)
+	if attested {
+		buf.Write(make([]byte, 16))
+		binary.Write(&buf, binary.BigEndian, uint16(len(a.id)))
+		buf.Write(a.id)
+		buf.Write(a.publicKey())
+	}
+
+	return buf.Bytes()
+}
+
+func (a *softwareAuthenticator) create(challenge string) ([]byte, []byte) {
+	var buf bytes.Buffer
+	encodeTestCBOR(&buf, []cborPair{
+		{"fmt", "none"},
+		{"attStmt", []cborPair{}},
+		{"authData", a.authenticatorData(true)},
+	})
+
+	return a.clientData("webauthn.create", challenge), buf.Bytes()
+}
+
+func (a *softwareAuthenticator) get(t *testing.T, challenge string) ([]byte, []byte, []byte) {
+	a.signCount++
+	clientData := a.clientData("webauthn.get", challenge)
+	authData := a.authenticatorData(false)
+	clientDataHash := sha256.Sum256(clientData)
+	hashed := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := asn1.Marshal(struct{ R, S interface{} }{r, s})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return clientData, authData, signature
+}
+
+func TestWebAuthnCeremonies(t *testing.T) {
+	t.Parallel()
+
+	rp := &WebAuthnRelyingParty{
+		ID:     "acme.teamzones.io",
+		Name:   "Teamzones",
+		Origin: "https://acme.teamzones.io",
+	}
+
+	authenticator := newSoftwareAuthenticator(t, rp.ID, rp.Origin)
+	challenge := NewWebAuthnChallenge()
+	clientData, attestation := authenticator.create(challenge)
+	credential, err := rp.VerifyRegistration(challenge, clientData, attestation)
+	if err != nil {
+		t.Fatalf("expected registration to succeed: %v", err)
+	}
+
+	if !bytes.Equal(credential.ID, authenticator.id) {
+		t.Errorf("unexpected credential id %q", credential.ID)
+	}
+
+	if _, err := rp.VerifyRegistration(NewWebAuthnChallenge(), clientData, attestation); err == nil {
+		t.Errorf("expected registration with the wrong challenge to fail")
+	}
+
+	challenge = NewWebAuthnChallenge()
+	clientData, authData, signature := authenticator.get(t, challenge)
+	signCount, err := rp.VerifyAssertion(challenge, credential, clientData, authData, signature, true)
+	if err != nil {
+		t.Fatalf("expected assertion to succeed: %v", err)
+	}
+
+	if signCount != 1 {
+		t.Errorf("expected sign count to be 1, got %d", signCount)
+	}
+
+	credential.SignCount = signCount
+	if _, err := rp.VerifyAssertion(challenge, credential, clientData, authData, signature, true); err == nil {
+		t.Errorf("expected replayed assertion to fail")
+	}
+
+	challenge = NewWebAuthnChallenge()
+	clientData, authData, signature = authenticator.get(t, challenge)
+	signature[len(signature)-1] ^= 0xff
+	if _, err := rp.VerifyAssertion(challenge, credential, clientData, authData, signature, true); err == nil {
+		t.Errorf("expected tampered signature to fail")
+	}
+
+	other := &WebAuthnRelyingParty{ID: "evil.example.com", Origin: rp.Origin}
+	challenge = NewWebAuthnChallenge()
+	clientData, authData, signature = authenticator.get(t, challenge)
+	if _, err := other.VerifyAssertion(challenge, credential, clientData, authData, signature, true); err == nil {
+		t.Errorf("expected assertion for another relying party to fail")
+	}
+
+	authenticator.flags = webAuthnFlagUserPresent
+	challenge = NewWebAuthnChallenge()
+	clientData, authData, signature = authenticator.get(t, challenge)
+	if _, err := rp.VerifyAssertion(challenge, credential, clientData, authData, signature, true); err == nil {
+		t.Errorf("expected assertion without user verification to fail")
+	}
+
+	if _, err := rp.VerifyAssertion(challenge, credential, clientData, authData, signature, false); err != nil {
+		t.Errorf("expected assertion with user presence to succeed: %v", err)
+	}
+}
+
+func TestDecodeCBORRejectsTruncatedInput(t *testing.T) {
+	t.Parallel()
+
+	inputs := [][]byte{
+		{},
+		{0x58},
+		{0x42, 0x01},
+		{0xa1, 0x01},
+		{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+	}
+
+	for _, input := range inputs {
+		if _, _, err := decodeCBOR(input); err == nil {
+			t.Errorf("expected %x to fail to decode", input)
+		}
+	}
+}
@@ -0,0 +1,485 @@
+package integrations
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	xmlNamespace       = "http://www.w3.org/XML/1998/namespace"
+	xmldsigNamespace   = "http://www.w3.org/2000/09/xmldsig#"
+	excC14NAlgorithm   = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSigAlgo   = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	rsaSHA1Algorithm   = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	rsaSHA256Algorithm = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	sha1Algorithm      = "http://www.w3.org/2000/09/xmldsig#sha1"
+	sha256Algorithm    = "http://www.w3.org/2001/04/xmlenc#sha256"
+)
+
+var (
+	// ErrXMLSignatureMissing is returned when a document that must be
+	// signed does not contain an enveloped signature.
+	ErrXMLSignatureMissing = errors.New("xml document is not signed")
+	// ErrXMLSignatureInvalid is returned when a signature does not
+	// match its document or any of the trusted certificates.
+	ErrXMLSignatureInvalid = errors.New("xml signature is invalid")
+)
+
+// xmlElement is a minimal XML DOM node.  Names and attributes are
+// kept exactly as they appear in the source document (ie. with their
+// prefixes) so that the element can be canonicalized later on.
+type xmlElement struct {
+	Name     xml.Name
+	Attr     []xml.Attr
+	Children []interface{} // *xmlElement or xmlText
+
+	parent *xmlElement
+}
+
+type xmlText string
+
+// parseXMLElement reads an XML document into a tree of xmlElements
+// and returns its root.  Comments and processing instructions are
+// dropped and DTDs are rejected outright.
+func parseXMLElement(r io.Reader) (*xmlElement, error) {
+	var root, current *xmlElement
+
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "failed to parse xml")
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			el := &xmlElement{
+				Name:   t.Name,
+				Attr:   append([]xml.Attr{}, t.Attr...),
+				parent: current,
+			}
+
+			if current == nil {
+				if root != nil {
+					return nil, errors.New("xml document has multiple roots")
+				}
+
+				root = el
+			} else {
+				current.Children = append(current.Children, el)
+			}
+
+			current = el
+		case xml.EndElement:
+			if current == nil {
+				return nil, errors.New("unbalanced xml document")
+			}
+
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.Children = append(current.Children, xmlText(t))
+			}
+		case xml.Directive:
+			return nil, errors.New("xml directives are not supported")
+		}
+	}
+
+	if root == nil || current != nil {
+		return nil, errors.New("incomplete xml document")
+	}
+
+	return root, nil
+}
+
+// lookupNamespace resolves a prefix to a namespace URI using the
+// declarations in scope for the element.
+func (e *xmlElement) lookupNamespace(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return xmlNamespace, true
+	}
+
+	for el := e; el != nil; el = el.parent {
+		for _, a := range el.Attr {
+			if (prefix == "" && a.Name.Space == "" && a.Name.Local == "xmlns") ||
+				(prefix != "" && a.Name.Space == "xmlns" && a.Name.Local == prefix) {
+				return a.Value, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// namespace returns the namespace URI of the element.
+func (e *xmlElement) namespace() string {
+	uri, _ := e.lookupNamespace(e.Name.Space)
+	return uri
+}
+
+// is returns true when the element has the given namespace and local name.
+func (e *xmlElement) is(namespace, local string) bool {
+	return e.Name.Local == local && e.namespace() == namespace
+}
+
+// attr returns the value of an unqualified attribute.
+func (e *xmlElement) attr(name string) string {
+	for _, a := range e.Attr {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+
+	return ""
+}
+
+// children returns all the direct children of the element with the
+// given namespace and local name.
+func (e *xmlElement) children(namespace, local string) []*xmlElement {
+	var els []*xmlElement
+	for _, c := range e.Children {
+		if el, ok := c.(*xmlElement); ok && el.is(namespace, local) {
+			els = append(els, el)
+		}
+	}
+
+	return els
+}
+
+// child returns the first direct child of the element with the given
+// namespace and local name or nil.
+func (e *xmlElement) child(namespace, local string) *xmlElement {
+	els := e.children(namespace, local)
+	if len(els) == 0 {
+		return nil
+	}
+
+	return els[0]
+}
+
+// text returns the concatenated character data of the element's
+// direct children.
+func (e *xmlElement) text() string {
+	var buf bytes.Buffer
+	for _, c := range e.Children {
+		if t, ok := c.(xmlText); ok {
+			buf.WriteString(string(t))
+		}
+	}
+
+	return strings.TrimSpace(buf.String())
+}
+
+// canonicalize serializes the element according to Exclusive XML
+// Canonicalization (without comments).  The exclude element and its
+// descendants are omitted from the output, which is how the
+// enveloped signature transform is implemented.
+func (e *xmlElement) canonicalize(inclusive []string, exclude *xmlElement) []byte {
+	var buf bytes.Buffer
+
+	prefixes := make(map[string]bool)
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+
+		prefixes[p] = true
+	}
+
+	e.writeCanonical(&buf, map[string]string{}, prefixes, exclude)
+	return buf.Bytes()
+}
+
+func (e *xmlElement) writeCanonical(
+	buf *bytes.Buffer,
+	rendered map[string]string, inclusive map[string]bool,
+	exclude *xmlElement,
+) {
+
+	// Namespaces are only rendered if they are visibly utilized by
+	// the element or one of its attributes or if they are part of
+	// the inclusive prefix list.
+	utilized := map[string]bool{e.Name.Space: true}
+	for _, a := range e.Attr {
+		if a.Name.Space != "" && a.Name.Space != "xmlns" && a.Name.Space != "xml" {
+			utilized[a.Name.Space] = true
+		}
+	}
+
+	for p := range inclusive {
+		if _, ok := e.lookupNamespace(p); ok {
+			utilized[p] = true
+		}
+	}
+
+	var prefixes []string
+	scope := make(map[string]string, len(rendered))
+	for p, uri := range rendered {
+		scope[p] = uri
+	}
+
+	for p := range utilized {
+		uri, _ := e.lookupNamespace(p)
+		if current, ok := rendered[p]; ok && current == uri {
+			continue
+		} else if !ok && p == "" && uri == "" {
+			continue
+		}
+
+		scope[p] = uri
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	attrs := canonicalAttrs{el: e}
+	for _, a := range e.Attr {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+
+		attrs.attrs = append(attrs.attrs, a)
+	}
+	sort.Sort(attrs)
+
+	name := qualifiedName(e.Name)
+	buf.WriteString("<" + name)
+	for _, p := range prefixes {
+		if p == "" {
+			buf.WriteString(` xmlns="`)
+		} else {
+			buf.WriteString(` xmlns:` + p + `="`)
+		}
+
+		buf.WriteString(escapeCanonicalAttr(scope[p]) + `"`)
+	}
+
+	for _, a := range attrs.attrs {
+		buf.WriteString(" " + qualifiedName(a.Name) + `="` + escapeCanonicalAttr(a.Value) + `"`)
+	}
+	buf.WriteString(">")
+
+	for _, c := range e.Children {
+		switch child := c.(type) {
+		case *xmlElement:
+			if child != exclude {
+				child.writeCanonical(buf, scope, inclusive, exclude)
+			}
+		case xmlText:
+			buf.WriteString(escapeCanonicalText(string(child)))
+		}
+	}
+
+	buf.WriteString("</" + name + ">")
+}
+
+// canonicalAttrs sorts attributes by namespace URI and then by local
+// name as required by the canonicalization spec.
+type canonicalAttrs struct {
+	el    *xmlElement
+	attrs []xml.Attr
+}
+
+func (a canonicalAttrs) namespace(i int) string {
+	if a.attrs[i].Name.Space == "" {
+		return ""
+	}
+
+	uri, _ := a.el.lookupNamespace(a.attrs[i].Name.Space)
+	return uri
+}
+
+func (a canonicalAttrs) Len() int      { return len(a.attrs) }
+func (a canonicalAttrs) Swap(i, j int) { a.attrs[i], a.attrs[j] = a.attrs[j], a.attrs[i] }
+func (a canonicalAttrs) Less(i, j int) bool {
+	ni, nj := a.namespace(i), a.namespace(j)
+	if ni != nj {
+		return ni < nj
+	}
+
+	return a.attrs[i].Name.Local < a.attrs[j].Name.Local
+}
+
+func qualifiedName(name xml.Name) string {
+	if name.Space == "" {
+		return name.Local
+	}
+
+	return name.Space + ":" + name.Local
+}
+
+var (
+	canonicalTextReplacer = strings.NewReplacer(
+		"&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;",
+	)
+	canonicalAttrReplacer = strings.NewReplacer(
+		"&", "&amp;", "<", "&lt;", `"`, "&quot;",
+		"\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;",
+	)
+)
+
+func escapeCanonicalText(s string) string {
+	return canonicalTextReplacer.Replace(s)
+}
+
+func escapeCanonicalAttr(s string) string {
+	return canonicalAttrReplacer.Replace(s)
+}
+
+func inclusivePrefixes(el *xmlElement) []string {
+	if el == nil {
+		return nil
+	}
+
+	for _, c := range el.Children {
+		if child, ok := c.(*xmlElement); ok && child.Name.Local == "InclusiveNamespaces" {
+			return strings.Fields(child.attr("PrefixList"))
+		}
+	}
+
+	return nil
+}
+
+func lookupDigest(algorithm string) (crypto.Hash, error) {
+	switch algorithm {
+	case sha1Algorithm:
+		return crypto.SHA1, nil
+	case sha256Algorithm:
+		return crypto.SHA256, nil
+	default:
+		return 0, errors.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+}
+
+func computeDigest(hash crypto.Hash, data []byte) []byte {
+	switch hash {
+	case crypto.SHA1:
+		sum := sha1.Sum(data)
+		return sum[:]
+	default:
+		sum := sha256.Sum256(data)
+		return sum[:]
+	}
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// verifyXMLSignature validates the enveloped signature on an element
+// against a set of trusted certificates.  Only signatures whose
+// single Reference points at the element itself are accepted so that
+// signature wrapping isn't possible.
+func verifyXMLSignature(el *xmlElement, certs []*x509.Certificate) error {
+	signature := el.child(xmldsigNamespace, "Signature")
+	if signature == nil {
+		return ErrXMLSignatureMissing
+	}
+
+	signedInfo := signature.child(xmldsigNamespace, "SignedInfo")
+	if signedInfo == nil {
+		return ErrXMLSignatureInvalid
+	}
+
+	c14n := signedInfo.child(xmldsigNamespace, "CanonicalizationMethod")
+	if c14n == nil || c14n.attr("Algorithm") != excC14NAlgorithm {
+		return errors.New("unsupported canonicalization method")
+	}
+
+	method := signedInfo.child(xmldsigNamespace, "SignatureMethod")
+	if method == nil {
+		return ErrXMLSignatureInvalid
+	}
+
+	var signatureHash crypto.Hash
+	switch method.attr("Algorithm") {
+	case rsaSHA1Algorithm:
+		signatureHash = crypto.SHA1
+	case rsaSHA256Algorithm:
+		signatureHash = crypto.SHA256
+	default:
+		return errors.Errorf("unsupported signature method %q", method.attr("Algorithm"))
+	}
+
+	references := signedInfo.children(xmldsigNamespace, "Reference")
+	if len(references) != 1 {
+		return ErrXMLSignatureInvalid
+	}
+
+	reference := references[0]
+	id := el.attr("ID")
+	if id == "" || reference.attr("URI") != "#"+id {
+		return ErrXMLSignatureInvalid
+	}
+
+	var inclusive []string
+	if transforms := reference.child(xmldsigNamespace, "Transforms"); transforms != nil {
+		for _, t := range transforms.children(xmldsigNamespace, "Transform") {
+			switch t.attr("Algorithm") {
+			case envelopedSigAlgo:
+			case excC14NAlgorithm:
+				inclusive = inclusivePrefixes(t)
+			default:
+				return errors.Errorf("unsupported transform %q", t.attr("Algorithm"))
+			}
+		}
+	}
+
+	digestMethod := reference.child(xmldsigNamespace, "DigestMethod")
+	digestValue := reference.child(xmldsigNamespace, "DigestValue")
+	if digestMethod == nil || digestValue == nil {
+		return ErrXMLSignatureInvalid
+	}
+
+	digestHash, err := lookupDigest(digestMethod.attr("Algorithm"))
+	if err != nil {
+		return err
+	}
+
+	expected, err := decodeBase64(digestValue.text())
+	if err != nil {
+		return ErrXMLSignatureInvalid
+	}
+
+	digest := computeDigest(digestHash, el.canonicalize(inclusive, signature))
+	if subtle.ConstantTimeCompare(digest, expected) != 1 {
+		return ErrXMLSignatureInvalid
+	}
+
+	signatureValue := signature.child(xmldsigNamespace, "SignatureValue")
+	if signatureValue == nil {
+		return ErrXMLSignatureInvalid
+	}
+
+	sig, err := decodeBase64(signatureValue.text())
+	if err != nil {
+		return ErrXMLSignatureInvalid
+	}
+
+	hashed := computeDigest(signatureHash, signedInfo.canonicalize(inclusivePrefixes(c14n), nil))
+	for _, cert := range certs {
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			continue
+		}
+
+		if rsa.VerifyPKCS1v15(key, signatureHash, hashed, sig) == nil {
+			return nil
+		}
+	}
+
+	return ErrXMLSignatureInvalid
+}
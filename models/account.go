@@ -0,0 +1,318 @@
+package models
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	accountKind = "Account"
+)
+
+// ErrAccountExists is returned when joining a Company with an e-mail
+// address whose Account has a different password.
+var ErrAccountExists = errors.New("This e-mail address already has an account. Please use its password.")
+
+// Account is the global identity of a verified e-mail address.  It
+// holds the credentials that the address signs in to each of its
+// Memberships with.  Accounts are root entities keyed by the
+// lowercased address.  They are only created and linked to once a
+// User has proven that they own the address so that signing up to a
+// Company with someone else's address never gives access to their
+// other teams.
+type Account struct {
+	Email    string `json:"email"`
+	Password string `json:"-" datastore:",noindex"`
+
+	Times
+}
+
+// Membership is one of the Companies that an e-mail address belongs
+// to along with the User that represents it there.  Per-company data
+// such as roles, workdays and second factors stays on each
+// membership's User.  Users that share an Account are the same
+// person and can switch between their teams without signing in again.
+type Membership struct {
+	Company *Company
+	User    *User
+}
+
+// NewAccountKey creates fully-qualified datastore keys for Accounts.
+func NewAccountKey(ctx context.Context, email string) *datastore.Key {
+	return datastore.NewKey(ctx, accountKind, strings.ToLower(email), 0, nil)
+}
+
+// CheckPassword compares the Account's hashed password against a
+// given password.  If nil is returned, the passwords are the same.
+func (a *Account) CheckPassword(password string) error {
+	return checkPassword(a.Password, password)
+}
+
+// Load tells datastore how to deserialize Accounts.
+func (a *Account) Load(p []datastore.Property) error {
+	return datastore.LoadStruct(a, p)
+}
+
+// Save tells datastore how to serialize Accounts.
+func (a *Account) Save() ([]datastore.Property, error) {
+	a.updateTimes()
+
+	return datastore.SaveStruct(a)
+}
+
+// linkAccount links a verified User to the Account for their address
+// without storing the User.  Missing Accounts are created using the
+// User's own password.  Existing ones are only linked to when password
+// matches theirs.  The boolean return value is true when the User was
+// linked.  It must be called from within a cross-group transaction.
+func linkAccount(ctx context.Context, user *User, password string) (bool, error) {
+	var account Account
+	key := NewAccountKey(ctx, user.Email)
+	err := nds.Get(ctx, key, &account)
+	switch {
+	case err == datastore.ErrNoSuchEntity:
+		if user.Password == "" {
+			return false, nil
+		}
+
+		account.Email = user.Email
+		account.Password = user.Password
+		account.initTimes()
+		if _, err := nds.Put(ctx, key, &account); err != nil {
+			return false, err
+		}
+	case err != nil:
+		return false, err
+	case password == "" || account.CheckPassword(password) != nil:
+		return false, nil
+	}
+
+	user.Account = key
+	user.Password = ""
+	return true, nil
+}
+
+// LinkAccount links a verified User that isn't linked to an Account
+// yet to the one for their address.  This is how Users created before
+// Accounts existed are migrated.  password is the User's plain text
+// password, if known, and is used to prove that they own an existing
+// Account.  The returned User reflects the stored one.
+func LinkAccount(ctx context.Context, userKey *datastore.Key, password string) (*User, error) {
+	var user User
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		user = User{}
+		if err := nds.Get(ctx, userKey, &user); err != nil {
+			return err
+		}
+
+		if user.Account != nil || user.Unverified {
+			return nil
+		}
+
+		linked, err := linkAccount(ctx, &user, password)
+		if err != nil || !linked {
+			return err
+		}
+
+		_, err = nds.Put(ctx, userKey, &user)
+		return err
+	}, xgTransaction)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// VerifyUser marks a User as the owner of their e-mail address and
+// links them to its Account.
+func VerifyUser(ctx context.Context, userKey *datastore.Key) (*User, error) {
+	var user User
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		user = User{}
+		if err := nds.Get(ctx, userKey, &user); err != nil {
+			return err
+		}
+
+		user.Unverified = false
+		if user.Account == nil {
+			if _, err := linkAccount(ctx, &user, ""); err != nil {
+				return err
+			}
+		}
+
+		_, err := nds.Put(ctx, userKey, &user)
+		return err
+	}, xgTransaction)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// ResetPassword changes a User's password and stores them.  Verified
+// Users have just proven that they own their address again so the
+// password is set on its Account, which is created or linked to as
+// needed, and applies to all of the Account's Memberships.
+func ResetPassword(ctx context.Context, user *User, password string) error {
+	hashed, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		if user.Unverified {
+			user.Password = hashed
+			_, err := user.Put(ctx)
+			return err
+		}
+
+		var account Account
+		key := NewAccountKey(ctx, user.Email)
+		if err := nds.Get(ctx, key, &account); err == datastore.ErrNoSuchEntity {
+			account.Email = user.Email
+			account.initTimes()
+		} else if err != nil {
+			return err
+		}
+
+		account.Password = hashed
+		if _, err := nds.Put(ctx, key, &account); err != nil {
+			return err
+		}
+
+		user.Account = key
+		user.Password = ""
+		_, err := user.Put(ctx)
+		return err
+	}, xgTransaction)
+}
+
+// SameAccount returns true if both Users are linked to the same
+// Account, meaning that they are Memberships of the same person.
+func SameAccount(a, b *User) bool {
+	return a.Account != nil && b.Account != nil && a.Account.Equal(b.Account)
+}
+
+// RevokeAccountSessions signs a User out everywhere, including from
+// every other Membership of their Account.
+func RevokeAccountSessions(ctx context.Context, user *User) error {
+	if err := RevokeSessions(ctx, user.Key(ctx)); err != nil {
+		return err
+	}
+
+	if user.Account == nil {
+		return nil
+	}
+
+	memberships, err := GetMemberships(ctx, user.Email)
+	if err != nil {
+		return err
+	}
+
+	for _, membership := range memberships {
+		if !SameAccount(user, membership.User) {
+			continue
+		}
+
+		if err := RevokeSessions(ctx, membership.User.Key(ctx)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// GetMemberships returns all of an e-mail address' Memberships.
+// Companies and Users that have gone missing since they were indexed
+// are skipped, as are deactivated Users.
+func GetMemberships(ctx context.Context, email string) ([]*Membership, error) {
+	companyKeys, err := LookupEmailCompanies(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	userKeys := make([]*datastore.Key, len(companyKeys))
+	for i, companyKey := range companyKeys {
+		userKeys[i] = NewUserKey(ctx, companyKey, email)
+	}
+
+	companies := make([]Company, len(companyKeys))
+	companyErrs, err := missingEntities(nds.GetMulti(ctx, companyKeys, companies))
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]User, len(userKeys))
+	userErrs, err := missingEntities(nds.GetMulti(ctx, userKeys, users))
+	if err != nil {
+		return nil, err
+	}
+
+	memberships := []*Membership{}
+	for i := range companyKeys {
+		if companyErrs[i] || userErrs[i] || users[i].Deactivated {
+			continue
+		}
+
+		memberships = append(memberships, &Membership{
+			Company: &companies[i],
+			User:    &users[i],
+		})
+	}
+
+	return memberships, nil
+}
+
+// GetMembership returns the Membership of an e-mail address in the
+// Company with the given subdomain.  datastore.ErrNoSuchEntity is
+// returned if the address isn't an active member of that Company.
+func GetMembership(ctx context.Context, subdomain, email string) (*Membership, error) {
+	var company Company
+	if err := nds.Get(ctx, NewCompanyKey(ctx, subdomain), &company); err != nil {
+		return nil, err
+	}
+
+	user, err := GetUser(ctx, company.Key(ctx), email)
+	if err != nil {
+		return nil, err
+	} else if user.Deactivated {
+		return nil, datastore.ErrNoSuchEntity
+	}
+
+	return &Membership{&company, user}, nil
+}
+
+// missingEntities converts the result of a GetMulti call into the set
+// of indexes of the entities that don't exist.  Any other error is
+// returned as is.
+func missingEntities(err error) (map[int]bool, error) {
+	missing := make(map[int]bool)
+	if err == nil {
+		return missing, nil
+	}
+
+	errs, ok := err.(appengine.MultiError)
+	if !ok {
+		return nil, err
+	}
+
+	for i, err := range errs {
+		switch err {
+		case nil:
+		case datastore.ErrNoSuchEntity:
+			missing[i] = true
+		default:
+			return nil, err
+		}
+	}
+
+	return missing, nil
+}
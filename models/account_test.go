@@ -0,0 +1,182 @@
+package models
+
+import (
+	"errors"
+	"reflect"
+	"teamzones/testutils"
+	"testing"
+
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+)
+
+func TestMissingEntities(t *testing.T) {
+	t.Parallel()
+
+	failed := errors.New("failed")
+	cases := []struct {
+		err      error
+		missing  map[int]bool
+		expected error
+	}{
+		{nil, map[int]bool{}, nil},
+		{appengine.MultiError{nil, nil}, map[int]bool{}, nil},
+		{appengine.MultiError{datastore.ErrNoSuchEntity, nil, datastore.ErrNoSuchEntity}, map[int]bool{0: true, 2: true}, nil},
+		{appengine.MultiError{datastore.ErrNoSuchEntity, failed}, nil, failed},
+		{failed, nil, failed},
+	}
+
+	for i, test := range cases {
+		missing, err := missingEntities(test.err)
+		if err != test.expected {
+			t.Errorf("case %d: expected error %v, got %v", i, test.expected, err)
+		}
+
+		if !reflect.DeepEqual(missing, test.missing) {
+			t.Errorf("case %d: expected %v, got %v", i, test.missing, missing)
+		}
+	}
+}
+
+func TestSameAccount(t *testing.T) {
+	t.Parallel()
+
+	account := new(datastore.Key)
+	cases := []struct {
+		a, b     *User
+		expected bool
+	}{
+		{&User{Account: account}, &User{Account: account}, true},
+		{&User{Account: account}, &User{}, false},
+		{&User{}, &User{Account: account}, false},
+		{&User{}, &User{}, false},
+	}
+
+	for i, test := range cases {
+		if SameAccount(test.a, test.b) != test.expected {
+			t.Errorf("case %d: expected %v", i, test.expected)
+		}
+	}
+}
+
+func TestAccounts(t *testing.T) {
+	ctx, done, err := testutils.AEContext()
+	if err != nil {
+		t.Skipf("appengine test environment is unavailable: %v", err)
+	}
+	defer done()
+
+	email := "pam@example.com"
+	dunder := &Company{Name: "dunder", Subdomain: "dunder"}
+	pam, err := CreateMainUser(ctx, dunder, "Pam", "Beesly", email, "password", "UTC", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if pam.Account == nil || pam.Password != "" {
+		t.Fatalf("expected verified user to be linked to an account: %+v", pam)
+	}
+
+	athlead := &Company{Name: "athlead", Subdomain: "athlead"}
+	if _, err := CreateMainUser(ctx, athlead, "Pam", "Beesly", email, "other", "UTC", false); err != ErrAccountExists {
+		t.Fatalf("expected ErrAccountExists, got %v", err)
+	}
+
+	other, err := CreateMainUser(ctx, athlead, "Pam", "Beesly", email, "password", "UTC", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !SameAccount(pam, other) {
+		t.Errorf("expected both memberships to share an account")
+	}
+
+	if err := ResetPassword(ctx, other, "new password"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Authenticate(ctx, dunder.Key(ctx), email, "new password"); err != nil {
+		t.Errorf("expected the new password to apply to every membership, got %v", err)
+	}
+
+	// Unverified users keep their own password until they verify
+	// their address.
+	sabre := &Company{Name: "sabre", Subdomain: "sabre"}
+	unverified, err := CreateMainUser(ctx, sabre, "Pam", "Beesly", email, "unverified", "UTC", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if unverified.Account != nil {
+		t.Errorf("expected unverified user not to be linked")
+	}
+
+	if _, err := Authenticate(ctx, sabre.Key(ctx), email, "unverified"); err != nil {
+		t.Errorf("expected unverified user to sign in with their own password, got %v", err)
+	}
+
+	verified, err := VerifyUser(ctx, unverified.Key(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verified.Unverified || verified.Account != nil {
+		t.Errorf("expected user with a different password to stay unlinked: %+v", verified)
+	}
+
+	linked, err := Authenticate(ctx, sabre.Key(ctx), email, "unverified")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if linked.Account != nil {
+		t.Errorf("expected user with a different password to stay unlinked")
+	}
+}
+
+func TestGetMemberships(t *testing.T) {
+	ctx, done, err := testutils.AEContext()
+	if err != nil {
+		t.Skipf("appengine test environment is unavailable: %v", err)
+	}
+	defer done()
+
+	email := "jim@example.com"
+	for _, subdomain := range []string{"dunder", "athlead", "sabre"} {
+		company := &Company{Name: subdomain, Subdomain: subdomain}
+		if _, err := CreateMainUser(ctx, company, "Jim", "Halpert", email, "password", "UTC", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := DeactivateUser(ctx, NewUserKey(ctx, NewCompanyKey(ctx, "sabre"), email), "david@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	memberships, err := GetMemberships(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subdomains := make(map[string]bool)
+	for _, membership := range memberships {
+		if membership.User.Email != email {
+			t.Errorf("unexpected membership user %q", membership.User.Email)
+		}
+
+		subdomains[membership.Company.Subdomain] = true
+	}
+
+	expected := map[string]bool{"dunder": true, "athlead": true}
+	if !reflect.DeepEqual(subdomains, expected) {
+		t.Errorf("expected memberships in %v, got %v", expected, subdomains)
+	}
+
+	if _, err := GetMembership(ctx, "sabre", email); err != datastore.ErrNoSuchEntity {
+		t.Errorf("expected deactivated membership to be missing, got %v", err)
+	}
+
+	if memberships, err := GetMemberships(ctx, "nobody@example.com"); err != nil || len(memberships) != 0 {
+		t.Errorf("expected no memberships, got %v (%v)", memberships, err)
+	}
+}
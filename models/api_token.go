@@ -0,0 +1,238 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"teamzones/utils"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	apiTokenKind   = "APIToken"
+	apiTokenPrefix = "tz_"
+
+	// apiTokenTouchInterval limits how often LastUsedAt is updated
+	// so that scripts don't result in a write per request.
+	apiTokenTouchInterval = 5 * time.Minute
+)
+
+const (
+	// ScopeProfile grants access to the token owner's profile.
+	ScopeProfile = "profile"
+	// ScopeTeam grants access to the team's members.
+	ScopeTeam = "team"
+	// ScopeInvites grants access to sending invites.
+	ScopeInvites = "invites"
+	// ScopeMeetings grants access to scheduling meetings.
+	ScopeMeetings = "meetings"
+)
+
+// APIScopes is the list of scopes that APITokens can be granted.
+var APIScopes = []string{
+	ScopeProfile,
+	ScopeTeam,
+	ScopeInvites,
+	ScopeMeetings,
+}
+
+var (
+	// ErrAPITokenExpired is returned when an APIToken has expired.
+	ErrAPITokenExpired = errors.New("API token has expired.")
+	// ErrInvalidScope is returned when creating an APIToken with an
+	// unknown scope.
+	ErrInvalidScope = errors.New("Invalid scope.")
+)
+
+// APIToken is a personal access token that can be used to call the
+// JSON API without a browser session.  Only a hash of the token is
+// stored and it doubles as the key name.  Every APIToken has a
+// Company as an ancestor in its Key so that it can be looked up from
+// the token alone.
+type APIToken struct {
+	Company *datastore.Key `json:"-"`
+	User    *datastore.Key `json:"-"`
+
+	ID         string    `json:"id" datastore:"-"`
+	Name       string    `json:"name" datastore:",noindex"`
+	Prefix     string    `json:"prefix" datastore:",noindex"`
+	Scopes     []string  `json:"scopes" datastore:",noindex"`
+	ExpiresAt  time.Time `json:"expiresAt" datastore:",noindex"`
+	LastUsedAt time.Time `json:"lastUsedAt" datastore:",noindex"`
+
+	Times
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewAPITokenKey creates fully-qualified datastore keys for
+// APITokens from the hashed token.
+func NewAPITokenKey(ctx context.Context, company *datastore.Key, hashedID string) *datastore.Key {
+	return datastore.NewKey(ctx, apiTokenKind, hashedID, 0, company)
+}
+
+// CreateAPIToken stores a new APIToken for the given User and returns
+// the plain text token.  The plain text token can't be recovered
+// afterwards.
+func CreateAPIToken(
+	ctx context.Context, user *User,
+	name string, scopes []string, ttl time.Duration,
+) (string, *APIToken, error) {
+
+	for _, scope := range scopes {
+		if !isAPIScope(scope) {
+			return "", nil, ErrInvalidScope
+		}
+	}
+
+	plain := apiTokenPrefix + strings.Replace(utils.UUID4(), "-", "", -1)
+	token := APIToken{
+		Company: user.Company,
+		User:    user.Key(ctx),
+		ID:      hashAPIToken(plain),
+		Name:    name,
+		Prefix:  plain[:len(apiTokenPrefix)+4],
+		Scopes:  scopes,
+	}
+	token.initTimes()
+	token.ExpiresAt = token.CreatedAt.Add(ttl)
+	if _, err := token.Put(ctx); err != nil {
+		return "", nil, err
+	}
+
+	return plain, &token, nil
+}
+
+// GetAPIToken looks up an APIToken belonging to the given Company by
+// its plain text value.
+func GetAPIToken(ctx context.Context, company *datastore.Key, plain string) (*APIToken, error) {
+	var token APIToken
+	id := hashAPIToken(plain)
+	if err := nds.Get(ctx, NewAPITokenKey(ctx, company, id), &token); err != nil {
+		return nil, err
+	}
+
+	if !time.Now().Before(token.ExpiresAt) {
+		return nil, ErrAPITokenExpired
+	}
+
+	token.ID = id
+	return &token, nil
+}
+
+// GetAPITokens returns all of a User's APITokens, including expired
+// ones.
+func GetAPITokens(ctx context.Context, user *datastore.Key) ([]*APIToken, error) {
+	tokens := []*APIToken{}
+	keys, err := FindAPITokens(user).GetAll(ctx, &tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, token := range tokens {
+		token.ID = keys[i].StringID()
+	}
+
+	return tokens, nil
+}
+
+// FindAPITokens returns a query that will retrieve all of a User's
+// APITokens.
+func FindAPITokens(user *datastore.Key) *datastore.Query {
+	return datastore.NewQuery(apiTokenKind).
+		Ancestor(user.Parent()).
+		Filter("User=", user)
+}
+
+// RevokeAPIToken deletes one of a User's APITokens by its hashed id.
+// datastore.ErrNoSuchEntity is returned if the token belongs to
+// someone else.
+func RevokeAPIToken(ctx context.Context, user *datastore.Key, hashedID string) error {
+	key := NewAPITokenKey(ctx, user.Parent(), hashedID)
+	return nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		var token APIToken
+		if err := nds.Get(ctx, key, &token); err != nil {
+			return err
+		}
+
+		if !token.User.Equal(user) {
+			return datastore.ErrNoSuchEntity
+		}
+
+		return nds.Delete(ctx, key)
+	}, nil)
+}
+
+// RevokeAPITokens deletes all of a User's APITokens.
+func RevokeAPITokens(ctx context.Context, user *datastore.Key) error {
+	keys, err := FindAPITokens(user).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	return nds.DeleteMulti(ctx, keys)
+}
+
+func isAPIScope(scope string) bool {
+	for _, s := range APIScopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasScope returns true if the APIToken was granted scope.
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Touch records that the APIToken was used.  It returns true when the
+// APIToken needs to be saved.
+func (t *APIToken) Touch(now time.Time) bool {
+	if now.Sub(t.LastUsedAt) < apiTokenTouchInterval {
+		return false
+	}
+
+	t.LastUsedAt = now
+	return true
+}
+
+// Key is a helper function for building an APIToken's key.
+func (t *APIToken) Key(ctx context.Context) *datastore.Key {
+	return NewAPITokenKey(ctx, t.Company, t.ID)
+}
+
+// Load tells datastore how to deserialize APITokens.  The id is the
+// key name so it has to be set by the caller.
+func (t *APIToken) Load(p []datastore.Property) error {
+	return datastore.LoadStruct(t, p)
+}
+
+// Save tells datastore how to serialize APITokens.
+func (t *APIToken) Save() ([]datastore.Property, error) {
+	t.updateTimes()
+
+	return datastore.SaveStruct(t)
+}
+
+// Put saves the APIToken to Datastore.
+func (t *APIToken) Put(ctx context.Context) (*datastore.Key, error) {
+	return nds.Put(ctx, t.Key(ctx), t)
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	auditEventKind = "AuditEvent"
+)
+
+// Audited actions.
+const (
+	AuditUserDeleted           = "user.deleted"
+	AuditUserDeactivated       = "user.deactivated"
+	AuditUserReactivated       = "user.reactivated"
+	AuditRoleChanged           = "user.role_changed"
+	AuditOwnershipTransferred  = "user.ownership_transferred"
+	AuditInviteSent            = "invite.sent"
+	AuditInviteResent          = "invite.resent"
+	AuditInviteRevoked         = "invite.revoked"
+	AuditInviteSettings        = "invite.settings_changed"
+	AuditInviteJobCreated      = "invite.job_created"
+	AuditBulkInviteCreated     = "invite.bulk_created"
+	AuditBulkInviteRevoked     = "invite.bulk_revoked"
+	AuditPlanChanged           = "billing.plan_changed"
+	AuditVATIDChanged          = "billing.vat_id_changed"
+	AuditSubscriptionCanceled  = "billing.subscription_canceled"
+	AuditIntegrationConnected  = "integration.connected"
+	AuditIntegrationDisconnect = "integration.disconnected"
+	AuditSAMLUpdated           = "sso.saml_updated"
+	AuditSAMLDeleted           = "sso.saml_deleted"
+	AuditGoogleSignInUpdated   = "sso.google_updated"
+	AuditTwoFactorPolicy       = "two_factor.policy_changed"
+	AuditPasswordPolicy        = "password.policy_changed"
+	AuditPasswordResetForced   = "password.reset_forced"
+	AuditDomainAdded           = "domain.added"
+	AuditDomainVerified        = "domain.verified"
+	AuditDomainRemoved         = "domain.removed"
+	AuditDomainJoinPolicy      = "domain.join_policy_changed"
+	AuditJoinRequestApproved   = "join_request.approved"
+	AuditJoinRequestDenied     = "join_request.denied"
+	AuditDataExportRequested   = "privacy.export_requested"
+	AuditDataErasureRequested  = "privacy.erasure_requested"
+	AuditCompanyClosed         = "company.closed"
+	AuditCompanyReopened       = "company.reopened"
+	AuditProfileFieldCreated   = "profile_field.created"
+	AuditProfileFieldUpdated   = "profile_field.updated"
+	AuditProfileFieldDeleted   = "profile_field.deleted"
+	AuditGroupCreated          = "group.created"
+	AuditGroupUpdated          = "group.updated"
+	AuditGroupDeleted          = "group.deleted"
+)
+
+// AuditEvent records an administrative action taken within a Company.
+// AuditEvents are append-only: they are never updated or deleted
+// while the Company exists, except to anonymize them when a User's
+// personal data is erased.  Every AuditEvent has a Company as an
+// ancestor in its Key.
+type AuditEvent struct {
+	Company *datastore.Key `json:"-"`
+
+	Actor     string `json:"actor"`
+	ActorName string `json:"actorName" datastore:",noindex"`
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+	IP        string `json:"ip" datastore:",noindex"`
+
+	// Before and After are JSON snapshots of the target.
+	Before string `json:"-" datastore:",noindex"`
+	After  string `json:"-" datastore:",noindex"`
+
+	Times
+}
+
+// AuditFilter narrows down the AuditEvents returned by
+// FindAuditEvents.  Zero values are ignored.
+type AuditFilter struct {
+	Action string
+	Actor  string
+	Since  time.Time
+	Until  time.Time
+}
+
+func marshalSnapshot(v interface{}) (string, error) {
+	if v == nil {
+		return "", nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// RecordAuditEvent appends an AuditEvent to the Company's log.  actor
+// may be nil for actions that weren't taken by a User.
+func RecordAuditEvent(
+	ctx context.Context,
+	company *datastore.Key, actor *User,
+	action, target, ip string,
+	before, after interface{},
+) (*AuditEvent, error) {
+
+	event := AuditEvent{
+		Company: company,
+		Action:  action,
+		Target:  target,
+		IP:      ip,
+	}
+	event.initTimes()
+
+	if actor != nil {
+		event.Actor = actor.Email
+		event.ActorName = actor.FullName()
+	}
+
+	var err error
+	if event.Before, err = marshalSnapshot(before); err != nil {
+		return nil, err
+	}
+
+	if event.After, err = marshalSnapshot(after); err != nil {
+		return nil, err
+	}
+
+	key := datastore.NewIncompleteKey(ctx, auditEventKind, company)
+	if _, err := nds.Put(ctx, key, &event); err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
+
+// anonymize removes every reference to email from the AuditEvent.
+// Snapshots of erased Users are dropped entirely.
+func (e *AuditEvent) anonymize(email string) {
+	if strings.EqualFold(e.Actor, email) {
+		e.Actor = ""
+		e.ActorName = ""
+		e.IP = ""
+	}
+
+	if strings.EqualFold(e.Target, email) {
+		e.Target = ""
+		e.Before = ""
+		e.After = ""
+	}
+}
+
+// FindAuditEvents returns a query that will retrieve a Company's
+// AuditEvents matching filter, newest first.
+func FindAuditEvents(company *datastore.Key, filter AuditFilter) *datastore.Query {
+	q := datastore.NewQuery(auditEventKind).Ancestor(company)
+	if filter.Action != "" {
+		q = q.Filter("Action=", filter.Action)
+	}
+
+	if filter.Actor != "" {
+		q = q.Filter("Actor=", filter.Actor)
+	}
+
+	if !filter.Since.IsZero() {
+		q = q.Filter("CreatedAt>=", filter.Since)
+	}
+
+	if !filter.Until.IsZero() {
+		q = q.Filter("CreatedAt<", filter.Until)
+	}
+
+	return q.Order("-CreatedAt")
+}
+
+// Load tells datastore how to deserialize AuditEvents.
+func (e *AuditEvent) Load(p []datastore.Property) error {
+	return datastore.LoadStruct(e, p)
+}
+
+// Save tells datastore how to serialize AuditEvents.
+func (e *AuditEvent) Save() ([]datastore.Property, error) {
+	e.updateTimes()
+
+	return datastore.SaveStruct(e)
+}
@@ -0,0 +1,25 @@
+package models
+
+import "testing"
+
+func TestAuditEventAnonymizeIgnoresCase(t *testing.T) {
+	t.Parallel()
+
+	event := &AuditEvent{
+		Actor:     "Peter.Parker@example.com",
+		ActorName: "Peter Parker",
+		IP:        "127.0.0.1",
+		Target:    "PETER.PARKER@EXAMPLE.COM",
+		Before:    "{}",
+		After:     "{}",
+	}
+	event.anonymize("peter.parker@example.com")
+
+	if event.Actor != "" || event.ActorName != "" || event.IP != "" {
+		t.Errorf("actor was not anonymized: %+v", event)
+	}
+
+	if event.Target != "" || event.Before != "" || event.After != "" {
+		t.Errorf("target was not anonymized: %+v", event)
+	}
+}
@@ -0,0 +1,224 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	closedCompanyKind = "ClosedCompany"
+
+	// ClosureGracePeriod is how long a closed Company can be
+	// reopened before its data is deleted.
+	ClosureGracePeriod = 14 * 24 * time.Hour
+
+	// InvoiceRetention is how long the billing records of deleted
+	// Companies are kept for accounting purposes.
+	InvoiceRetention = 10 * 365 * 24 * time.Hour
+)
+
+var (
+	// ErrCompanyClosed is returned when closing a Company twice.
+	ErrCompanyClosed = errors.New("This team has already been closed.")
+	// ErrCompanyNotClosed is returned when reopening a Company that
+	// isn't closed or that can no longer be reopened.
+	ErrCompanyNotClosed = errors.New("This team can't be reopened.")
+)
+
+// ClosedCompany keeps the billing details of a deleted Company for as
+// long as its invoices have to be retained.  The Company's
+// Transactions are copied under it before the Company is deleted so
+// that they aren't picked up by a new Company with the same
+// subdomain.
+type ClosedCompany struct {
+	Name      string
+	Subdomain string
+
+	SubscriptionCustomerID string
+	SubscriptionFirstName  string `datastore:",noindex"`
+	SubscriptionLastName   string `datastore:",noindex"`
+	SubscriptionAddress1   string `datastore:",noindex"`
+	SubscriptionAddress2   string `datastore:",noindex"`
+	SubscriptionCity       string `datastore:",noindex"`
+	SubscriptionRegion     string `datastore:",noindex"`
+	SubscriptionPostalCode string `datastore:",noindex"`
+	SubscriptionCountry    string `datastore:",noindex"`
+	SubscriptionVATID      string `datastore:",noindex"`
+
+	ClosedAt    time.Time
+	RetainUntil time.Time
+
+	Times
+}
+
+// Closed returns true if the Company's owner has closed it.
+func (c *Company) Closed() bool {
+	return !c.ClosedAt.IsZero()
+}
+
+// Close transactionally marks the Company as closed and schedules it
+// for deletion once the grace period is over.
+func (c *Company) Close(ctx context.Context, closedBy string) error {
+	return nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		company, err := GetCompany(ctx, c.Subdomain)
+		if err != nil {
+			return err
+		}
+
+		if company.Closed() {
+			return ErrCompanyClosed
+		}
+
+		company.ClosedAt = time.Now()
+		company.ClosedBy = closedBy
+		company.DeleteAt = company.ClosedAt.Add(ClosureGracePeriod)
+		if _, err := company.Put(ctx); err != nil {
+			return err
+		}
+
+		*c = *company
+		return nil
+	}, nil)
+}
+
+// Reopen transactionally undoes Close during the grace period.
+func (c *Company) Reopen(ctx context.Context) error {
+	return nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		company, err := GetCompany(ctx, c.Subdomain)
+		if err != nil {
+			return err
+		}
+
+		if !company.Closed() || !time.Now().Before(company.DeleteAt) {
+			return ErrCompanyNotClosed
+		}
+
+		company.ClosedAt = time.Time{}
+		company.ClosedBy = ""
+		company.DeleteAt = time.Time{}
+		if _, err := company.Put(ctx); err != nil {
+			return err
+		}
+
+		*c = *company
+		return nil
+	}, nil)
+}
+
+// ArchiveInvoices copies a closed Company's billing details and
+// Transactions into a ClosedCompany.  It's safe to call more than once.
+func ArchiveInvoices(ctx context.Context, company *Company) (*datastore.Key, error) {
+	archive := ClosedCompany{
+		Name:      company.Name,
+		Subdomain: company.Subdomain,
+
+		SubscriptionCustomerID: company.SubscriptionCustomerID,
+		SubscriptionFirstName:  company.SubscriptionFirstName,
+		SubscriptionLastName:   company.SubscriptionLastName,
+		SubscriptionAddress1:   company.SubscriptionAddress1,
+		SubscriptionAddress2:   company.SubscriptionAddress2,
+		SubscriptionCity:       company.SubscriptionCity,
+		SubscriptionRegion:     company.SubscriptionRegion,
+		SubscriptionPostalCode: company.SubscriptionPostalCode,
+		SubscriptionCountry:    company.SubscriptionCountry,
+		SubscriptionVATID:      company.SubscriptionVATID,
+
+		ClosedAt:    company.ClosedAt,
+		RetainUntil: company.ClosedAt.Add(InvoiceRetention),
+	}
+	archive.initTimes()
+
+	name := fmt.Sprintf("%s-%d", company.Subdomain, company.ClosedAt.Unix())
+	archiveKey := datastore.NewKey(ctx, closedCompanyKind, name, 0, nil)
+	if _, err := nds.Put(ctx, archiveKey, &archive); err != nil {
+		return nil, err
+	}
+
+	var transactions []*Transaction
+	keys, err := datastore.NewQuery(transactionKind).
+		Ancestor(company.Key(ctx)).
+		GetAll(ctx, &transactions)
+	if err != nil {
+		return nil, err
+	}
+
+	archivedKeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		transactions[i].Company = archiveKey
+		archivedKeys[i] = datastore.NewKey(ctx, transactionKind, key.StringID(), 0, archiveKey)
+	}
+
+	if _, err := nds.PutMulti(ctx, archivedKeys, transactions); err != nil {
+		return nil, err
+	}
+
+	return archiveKey, nil
+}
+
+// DeleteDescendants deletes up to limit of the entities that have key
+// as an ancestor and returns how many were deleted.
+func DeleteDescendants(ctx context.Context, key *datastore.Key, limit int) (int, error) {
+	keys, err := datastore.NewQuery("").
+		Ancestor(key).
+		KeysOnly().
+		Limit(limit+1).
+		GetAll(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	descendants := keys[:0]
+	for _, k := range keys {
+		if !k.Equal(key) && len(descendants) < limit {
+			descendants = append(descendants, k)
+		}
+	}
+
+	return len(descendants), nds.DeleteMulti(ctx, descendants)
+}
+
+// DeleteExpiredArchives deletes the ClosedCompanies, along with their
+// Transactions, whose retention period is over.
+func DeleteExpiredArchives(ctx context.Context) error {
+	keys, err := datastore.NewQuery(closedCompanyKind).
+		Filter("RetainUntil<", time.Now()).
+		KeysOnly().
+		GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		transactionKeys, err := datastore.NewQuery(transactionKind).
+			Ancestor(key).
+			KeysOnly().
+			GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := nds.DeleteMulti(ctx, append(transactionKeys, key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Load tells datastore how to deserialize ClosedCompanies.
+func (c *ClosedCompany) Load(p []datastore.Property) error {
+	return datastore.LoadStruct(c, p)
+}
+
+// Save tells datastore how to serialize ClosedCompanies.
+func (c *ClosedCompany) Save() ([]datastore.Property, error) {
+	c.updateTimes()
+
+	return datastore.SaveStruct(c)
+}
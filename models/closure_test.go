@@ -0,0 +1,140 @@
+package models
+
+import (
+	"teamzones/testutils"
+	"testing"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"google.golang.org/appengine/datastore"
+)
+
+func TestCloseAndReopen(t *testing.T) {
+	ctx, done, err := testutils.AEContext()
+	if err != nil {
+		t.Skipf("appengine test environment is unavailable: %v", err)
+	}
+	defer done()
+
+	company := NewCompany("Dunder Mifflin", "dunder")
+	if _, err := company.Put(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := company.Reopen(ctx); err != ErrCompanyNotClosed {
+		t.Errorf("expected reopening an open company to fail, got %v", err)
+	}
+
+	if err := company.Close(ctx, "michael@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !company.Closed() || company.ClosedBy != "michael@example.com" || !company.DeleteAt.Equal(company.ClosedAt.Add(ClosureGracePeriod)) {
+		t.Errorf("unexpected closed company: %+v", company)
+	}
+
+	if err := company.Close(ctx, "michael@example.com"); err != ErrCompanyClosed {
+		t.Errorf("expected closing twice to fail, got %v", err)
+	}
+
+	if err := company.Reopen(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := GetCompany(ctx, "dunder")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Closed() || !stored.DeleteAt.IsZero() || stored.ClosedBy != "" {
+		t.Errorf("expected company to be reopened, got %+v", stored)
+	}
+
+	// Companies can't be reopened once their grace period is over.
+	stored.ClosedAt = time.Now().Add(-ClosureGracePeriod - time.Hour)
+	stored.DeleteAt = time.Now().Add(-time.Hour)
+	if _, err := stored.Put(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := company.Reopen(ctx); err != ErrCompanyNotClosed {
+		t.Errorf("expected reopening after the grace period to fail, got %v", err)
+	}
+}
+
+func TestArchiveInvoicesAndDeleteDescendants(t *testing.T) {
+	ctx, done, err := testutils.AEContext()
+	if err != nil {
+		t.Skipf("appengine test environment is unavailable: %v", err)
+	}
+	defer done()
+
+	company := NewCompany("Dunder Mifflin", "dunder")
+	company.SubscriptionCustomerID = "customer"
+	company.SubscriptionVATID = "RO123"
+	company.ClosedAt = time.Now()
+	companyKey, err := company.Put(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"t1", "t2"} {
+		key := datastore.NewKey(ctx, transactionKind, id, 0, companyKey)
+		if _, err := nds.Put(ctx, key, &Transaction{Company: companyKey, TransactionID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, email := range []string{"jim@example.com", "pam@example.com", "dwight@example.com"} {
+		if _, err := CreateUser(ctx, companyKey, "First", "Last", email, "password", "UTC"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Archiving twice must not duplicate anything.
+	archiveKey, err := ArchiveInvoices(ctx, company)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ArchiveInvoices(ctx, company); err != nil {
+		t.Fatal(err)
+	}
+
+	var archive ClosedCompany
+	if err := nds.Get(ctx, archiveKey, &archive); err != nil {
+		t.Fatal(err)
+	}
+
+	if archive.SubscriptionCustomerID != "customer" || archive.SubscriptionVATID != "RO123" ||
+		!archive.RetainUntil.Equal(company.ClosedAt.Add(InvoiceRetention)) {
+		t.Errorf("unexpected archive: %+v", archive)
+	}
+
+	var transactions []*Transaction
+	if _, err := datastore.NewQuery(transactionKind).Ancestor(archiveKey).GetAll(ctx, &transactions); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(transactions) != 2 || !transactions[0].Company.Equal(archiveKey) {
+		t.Errorf("expected 2 archived transactions, got %+v", transactions)
+	}
+
+	// 2 Transactions and 3 Users are deleted in batches of 3, while
+	// the Company itself is left alone.
+	for _, expected := range []int{3, 2, 0} {
+		n, err := DeleteDescendants(ctx, companyKey, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != expected {
+			t.Errorf("expected %d deleted entities, got %d", expected, n)
+		}
+	}
+
+	if _, err := GetCompany(ctx, "dunder"); err != nil {
+		t.Errorf("expected company to be kept, got %v", err)
+	}
+}
@@ -41,6 +41,24 @@ type Company struct {
 	SubscriptionStatus     string    `json:"-"` // never Expired or Unrecognized
 	SubscriptionValidUntil time.Time `json:"-"` // used when subscription status is canceled or past due
 
+	// Sign in with Google
+	GoogleHostedDomain string `json:"-"` // restricts sign in to a G Suite domain when set
+
+	// Security
+	RequireTwoFactor bool           `json:"requireTwoFactor"`
+	PasswordPolicy   PasswordPolicy `json:"passwordPolicy"`
+
+	// Invites
+	InviteTTLDays int `json:"inviteTTLDays"` // DefaultInviteTTLDays when 0
+
+	// Domains
+	DomainJoinPolicy string `json:"domainJoinPolicy"` // see DomainJoinOff, DomainJoinApprove and DomainJoinAuto
+
+	// Closure
+	ClosedAt time.Time `json:"-"` // zero unless the owner has closed the Company
+	ClosedBy string    `json:"-"`
+	DeleteAt time.Time `json:"-"` // the Company can be reopened until then
+
 	Times
 }
 
@@ -72,6 +90,12 @@ func GetCompany(ctx context.Context, subdomain string) (*Company, error) {
 	return &company, nil
 }
 
+// FindCompanies returns a query that will retrieve all the
+// Companies.
+func FindCompanies() *datastore.Query {
+	return datastore.NewQuery(companyKind)
+}
+
 // GetCompanyBySubID searches for a Company by its subscription id.
 func GetCompanyBySubID(ctx context.Context, subID string) (*Company, error) {
 	var company Company
@@ -88,12 +112,22 @@ func GetCompanyBySubID(ctx context.Context, subID string) (*Company, error) {
 	return &company, nil
 }
 
-// GetCompanySize returns the number of members a given Company has.
+// GetCompanySize returns the number of active members a given
+// Company has.
 func GetCompanySize(ctx context.Context, company *datastore.Key) (int, error) {
-	return datastore.NewQuery(userKind).
+	n, err := datastore.NewQuery(userKind).
 		Ancestor(company).
 		Count(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	m, err := CountDeactivatedUsers(ctx, company)
+	if err != nil {
+		return 0, err
+	}
 
+	return n - m, nil
 }
 
 // Resubscribe creates a new subscription information for a Company.
@@ -337,15 +371,33 @@ func (c *Company) Suspended() bool {
 }
 
 // SeatsLeft returns the number of remaining seats on a Company.
-// Could potentially return values <0.
+// Pending individual invites hold on to a seat until they expire and
+// deactivated members don't take one up.  Could potentially return
+// values <0.
 func (c *Company) SeatsLeft(ctx context.Context) int {
 
 	p, _ := integrations.LookupBraintreePlan(c.SubscriptionPlanID)
-	n, _ := datastore.NewQuery(userKind).
-		Ancestor(c.Key(ctx)).
-		Count(ctx)
+	n, _ := GetCompanySize(ctx, c.Key(ctx))
+	m, _ := CountPendingInvites(ctx, c.Key(ctx))
+
+	return p.Members - n - m
+}
+
+// InviteTTL returns how long individual invites sent by the Company
+// are valid for.
+func (c *Company) InviteTTL() time.Duration {
+	return InviteTTL(c.InviteTTLDays)
+}
+
+// SetInviteTTLDays updates how many days individual invites are
+// valid for.
+func (c *Company) SetInviteTTLDays(days int) error {
+	if days < 1 || days > MaxInviteTTLDays {
+		return ErrInvalidInviteTTL
+	}
 
-	return p.Members - n
+	c.InviteTTLDays = days
+	return nil
 }
 
 // IsDemo returns true if the Company is the demo account.
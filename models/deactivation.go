@@ -0,0 +1,142 @@
+package models
+
+import (
+	"errors"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	// ErrUserDeactivated is returned when deactivating a User twice.
+	ErrUserDeactivated = errors.New("This member has already been deactivated.")
+	// ErrUserActive is returned when reactivating or deleting a User
+	// that hasn't been deactivated.
+	ErrUserActive = errors.New("This member is active.")
+)
+
+// GetActiveUsers returns all of a Company's Users that haven't been
+// deactivated.
+func GetActiveUsers(ctx context.Context, companyKey *datastore.Key) ([]User, error) {
+	var users []User
+	if _, err := FindUsers(companyKey).GetAll(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	active := users[:0]
+	for _, user := range users {
+		if !user.Deactivated {
+			active = append(active, user)
+		}
+	}
+
+	return active, nil
+}
+
+// FindDeactivatedUsers returns a query that will retrieve all of a
+// Company's deactivated Users.
+func FindDeactivatedUsers(companyKey *datastore.Key) *datastore.Query {
+	return FindUsers(companyKey).Filter("Deactivated=", true)
+}
+
+// CountDeactivatedUsers returns the number of deactivated Users a
+// Company has.
+func CountDeactivatedUsers(ctx context.Context, companyKey *datastore.Key) (int, error) {
+	return FindDeactivatedUsers(companyKey).Count(ctx)
+}
+
+// DeactivateUser transactionally deactivates a User.
+func DeactivateUser(ctx context.Context, userKey *datastore.Key, deactivatedBy string) (*User, error) {
+	var user User
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := nds.Get(ctx, userKey, &user); err != nil {
+			return err
+		}
+
+		if user.Role == RoleMain {
+			return ErrLastOwner
+		}
+
+		if user.Deactivated {
+			return ErrUserDeactivated
+		}
+
+		user.Deactivated = true
+		user.DeactivatedAt = time.Now()
+		user.DeactivatedBy = deactivatedBy
+		_, err := nds.Put(ctx, userKey, &user)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// ReactivateUser transactionally reactivates a User.
+func ReactivateUser(ctx context.Context, userKey *datastore.Key) (*User, error) {
+	var user User
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := nds.Get(ctx, userKey, &user); err != nil {
+			return err
+		}
+
+		if !user.Deactivated {
+			return ErrUserActive
+		}
+
+		user.Deactivated = false
+		user.DeactivatedAt = time.Time{}
+		user.DeactivatedBy = ""
+		_, err := nds.Put(ctx, userKey, &user)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// ReassignMeeting transactionally hands a Meeting over to another User.
+// The original Meeting is kept but marked as canceled and the new one
+// has to be scheduled on its new owner's calendar.
+func ReassignMeeting(
+	ctx context.Context,
+	key *datastore.Key, to *datastore.Key,
+) (*datastore.Key, error) {
+
+	var newKey *datastore.Key
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		var meeting Meeting
+		if err := nds.Get(ctx, key, &meeting); err != nil {
+			return err
+		}
+
+		reassigned := meeting
+		reassigned.EventID = ""
+		reassigned.initTimes()
+
+		meeting.Status = MeetingStatusCanceled
+		keys, err := nds.PutMulti(
+			ctx,
+			[]*datastore.Key{NewMeetingKey(ctx, to), key},
+			[]interface{}{&reassigned, &meeting},
+		)
+		if err != nil {
+			return err
+		}
+
+		newKey = keys[0]
+		return nil
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKey, nil
+}
@@ -0,0 +1,266 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"teamzones/utils"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	domainKind         = "Domain"
+	verifiedDomainKind = "VerifiedDomain"
+)
+
+// Domain join policies decide what happens when someone with an
+// address on one of a Company's verified Domains asks to join.
+const (
+	DomainJoinOff     = ""
+	DomainJoinApprove = "approve"
+	DomainJoinAuto    = "auto"
+)
+
+var (
+	// ErrDomainExists is returned when claiming a Domain twice.
+	ErrDomainExists = errors.New("This domain has already been added.")
+	// ErrDomainTaken is returned when verifying a Domain that has
+	// already been verified by another Company.
+	ErrDomainTaken = errors.New("This domain has been verified by another team.")
+	// ErrInvalidJoinPolicy is returned when setting an unknown
+	// domain join policy.
+	ErrInvalidJoinPolicy = errors.New("Invalid join policy.")
+)
+
+// Domain is an e-mail domain claimed by a Company.  Claims have to be
+// verified by publishing Token in a DNS TXT record before they take
+// effect.  Every Domain has a Company as an ancestor in its Key and
+// its name as the key name.
+type Domain struct {
+	Company    *datastore.Key `json:"-"`
+	Name       string         `json:"name"`
+	Token      string         `json:"token" datastore:",noindex"`
+	Verified   bool           `json:"verified"`
+	VerifiedAt time.Time      `json:"verifiedAt" datastore:",noindex"`
+	CreatedBy  string         `json:"createdBy" datastore:",noindex"`
+
+	Times
+}
+
+// VerifiedDomain maps a verified domain name to the Company that owns
+// it.  VerifiedDomains are root entities so that each domain can only
+// be verified by a single Company.
+type VerifiedDomain struct {
+	Company *datastore.Key
+
+	Times
+}
+
+// EmailDomain returns the lowercased domain part of an e-mail address.
+func EmailDomain(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i == -1 {
+		return ""
+	}
+
+	return strings.ToLower(email[i+1:])
+}
+
+// NewDomainKey creates fully-qualified datastore keys for Domains.
+func NewDomainKey(ctx context.Context, companyKey *datastore.Key, name string) *datastore.Key {
+	return datastore.NewKey(ctx, domainKind, name, 0, companyKey)
+}
+
+func newVerifiedDomainKey(ctx context.Context, name string) *datastore.Key {
+	return datastore.NewKey(ctx, verifiedDomainKind, name, 0, nil)
+}
+
+// CreateDomain claims a domain on behalf of a Company.
+func CreateDomain(
+	ctx context.Context,
+	companyKey *datastore.Key, name, createdBy string,
+) (*Domain, error) {
+
+	domain := Domain{
+		Company:   companyKey,
+		Name:      strings.ToLower(name),
+		Token:     strings.Replace(utils.UUID4(), "-", "", -1),
+		CreatedBy: createdBy,
+	}
+	domain.initTimes()
+
+	key := NewDomainKey(ctx, companyKey, domain.Name)
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		var existing Domain
+		if err := nds.Get(ctx, key, &existing); err != datastore.ErrNoSuchEntity {
+			if err == nil {
+				return ErrDomainExists
+			}
+
+			return err
+		}
+
+		_, err := nds.Put(ctx, key, &domain)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &domain, nil
+}
+
+// GetDomain returns one of a Company's Domains by name.
+func GetDomain(ctx context.Context, companyKey *datastore.Key, name string) (*Domain, error) {
+	var domain Domain
+	if err := nds.Get(ctx, NewDomainKey(ctx, companyKey, strings.ToLower(name)), &domain); err != nil {
+		return nil, err
+	}
+
+	return &domain, nil
+}
+
+// GetDomains returns all of a Company's Domains.
+func GetDomains(ctx context.Context, companyKey *datastore.Key) ([]*Domain, error) {
+	domains := []*Domain{}
+	_, err := datastore.NewQuery(domainKind).
+		Ancestor(companyKey).
+		GetAll(ctx, &domains)
+	if err != nil {
+		return nil, err
+	}
+
+	return domains, nil
+}
+
+// MarkDomainVerified transactionally marks one of a Company's Domains
+// as verified.  ErrDomainTaken is returned if another Company got to
+// it first.
+func MarkDomainVerified(ctx context.Context, companyKey *datastore.Key, name string) (*Domain, error) {
+	var domain Domain
+	key := NewDomainKey(ctx, companyKey, name)
+	verifiedKey := newVerifiedDomainKey(ctx, name)
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := nds.Get(ctx, key, &domain); err != nil {
+			return err
+		}
+
+		var verified VerifiedDomain
+		switch err := nds.Get(ctx, verifiedKey, &verified); err {
+		case nil:
+			if !verified.Company.Equal(companyKey) {
+				return ErrDomainTaken
+			}
+		case datastore.ErrNoSuchEntity:
+			verified.Company = companyKey
+			verified.initTimes()
+		default:
+			return err
+		}
+
+		domain.Verified = true
+		domain.VerifiedAt = time.Now()
+		_, err := nds.PutMulti(
+			ctx,
+			[]*datastore.Key{key, verifiedKey},
+			[]interface{}{&domain, &verified},
+		)
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+	if err != nil {
+		return nil, err
+	}
+
+	return &domain, nil
+}
+
+// DeleteDomain removes one of a Company's Domains, releasing it if it
+// was verified.
+func DeleteDomain(ctx context.Context, companyKey *datastore.Key, name string) error {
+	key := NewDomainKey(ctx, companyKey, name)
+	verifiedKey := newVerifiedDomainKey(ctx, name)
+	return nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		var domain Domain
+		if err := nds.Get(ctx, key, &domain); err != nil {
+			return err
+		}
+
+		var verified VerifiedDomain
+		switch err := nds.Get(ctx, verifiedKey, &verified); err {
+		case nil:
+			if verified.Company.Equal(companyKey) {
+				if err := nds.Delete(ctx, verifiedKey); err != nil {
+					return err
+				}
+			}
+		case datastore.ErrNoSuchEntity:
+		default:
+			return err
+		}
+
+		return nds.Delete(ctx, key)
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// LookupDomainCompany returns the key of the Company that verified the
+// domain of an e-mail address.
+func LookupDomainCompany(ctx context.Context, email string) (*datastore.Key, error) {
+	name := EmailDomain(email)
+	if name == "" {
+		return nil, datastore.ErrNoSuchEntity
+	}
+
+	var verified VerifiedDomain
+	if err := nds.Get(ctx, newVerifiedDomainKey(ctx, name), &verified); err != nil {
+		return nil, err
+	}
+
+	return verified.Company, nil
+}
+
+// HasVerifiedDomain returns true if the Company has verified the domain
+// of an e-mail address.
+func (c *Company) HasVerifiedDomain(ctx context.Context, email string) bool {
+	companyKey, err := LookupDomainCompany(ctx, email)
+	return err == nil && companyKey.Equal(c.Key(ctx))
+}
+
+// SetDomainJoinPolicy updates what happens when someone with an
+// address on one of the Company's verified Domains asks to join.
+func (c *Company) SetDomainJoinPolicy(policy string) error {
+	switch policy {
+	case DomainJoinOff, DomainJoinApprove, DomainJoinAuto:
+		c.DomainJoinPolicy = policy
+		return nil
+	default:
+		return ErrInvalidJoinPolicy
+	}
+}
+
+// Load tells datastore how to deserialize Domains.
+func (d *Domain) Load(p []datastore.Property) error {
+	return datastore.LoadStruct(d, p)
+}
+
+// Save tells datastore how to serialize Domains.
+func (d *Domain) Save() ([]datastore.Property, error) {
+	d.updateTimes()
+
+	return datastore.SaveStruct(d)
+}
+
+// Load tells datastore how to deserialize VerifiedDomains.
+func (d *VerifiedDomain) Load(p []datastore.Property) error {
+	return datastore.LoadStruct(d, p)
+}
+
+// Save tells datastore how to serialize VerifiedDomains.
+func (d *VerifiedDomain) Save() ([]datastore.Property, error) {
+	d.updateTimes()
+
+	return datastore.SaveStruct(d)
+}
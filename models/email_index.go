@@ -0,0 +1,139 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	emailIndexKind = "EmailIndex"
+)
+
+// EmailIndex maps an e-mail address to the Companies that it is a
+// member of.  Users are keyed under their Company so this is the only
+// way to find someone's teams from their address alone.  EmailIndexes
+// are root entities keyed by the lowercased address and are updated
+// in the same transaction as the Users they index.
+type EmailIndex struct {
+	Companies []*datastore.Key
+
+	Times
+}
+
+// xgTransaction is used by transactions that update Users along with
+// their EmailIndex.
+var xgTransaction = &datastore.TransactionOptions{XG: true}
+
+func newEmailIndexKey(ctx context.Context, email string) *datastore.Key {
+	return datastore.NewKey(ctx, emailIndexKind, strings.ToLower(email), 0, nil)
+}
+
+// indexEmail adds companyKey to email's EmailIndex.  It must be called
+// from within a cross-group transaction.
+func indexEmail(ctx context.Context, companyKey *datastore.Key, email string) error {
+	var index EmailIndex
+	key := newEmailIndexKey(ctx, email)
+	if err := nds.Get(ctx, key, &index); err == datastore.ErrNoSuchEntity {
+		index.initTimes()
+	} else if err != nil {
+		return err
+	}
+
+	for _, k := range index.Companies {
+		if k.Equal(companyKey) {
+			return nil
+		}
+	}
+
+	index.Companies = append(index.Companies, companyKey)
+	_, err := nds.Put(ctx, key, &index)
+	return err
+}
+
+// unindexEmail removes companyKey from email's EmailIndex.  The
+// address' Account is deleted along with its last Membership.  It must
+// be called from within a cross-group transaction.
+func unindexEmail(ctx context.Context, companyKey *datastore.Key, email string) error {
+	var index EmailIndex
+	key := newEmailIndexKey(ctx, email)
+	if err := nds.Get(ctx, key, &index); err == datastore.ErrNoSuchEntity {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	companies := index.Companies[:0]
+	for _, k := range index.Companies {
+		if !k.Equal(companyKey) {
+			companies = append(companies, k)
+		}
+	}
+
+	if len(companies) == 0 {
+		return nds.DeleteMulti(ctx, []*datastore.Key{key, NewAccountKey(ctx, email)})
+	}
+
+	index.Companies = companies
+	_, err := nds.Put(ctx, key, &index)
+	return err
+}
+
+// LookupEmailCompanies returns the keys of all the Companies that an
+// e-mail address is a member of.
+func LookupEmailCompanies(ctx context.Context, email string) ([]*datastore.Key, error) {
+	var index EmailIndex
+	if err := nds.Get(ctx, newEmailIndexKey(ctx, email), &index); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return index.Companies, nil
+}
+
+// ReindexCompany adds all of a Company's Users to the EmailIndex.  It
+// is used to backfill the index for Users created before it existed.
+func ReindexCompany(ctx context.Context, companyKey *datastore.Key) error {
+	keys, err := FindUsers(companyKey).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+			return indexEmail(ctx, companyKey, key.StringID())
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DeleteUser deletes a User and removes them from the EmailIndex.
+func DeleteUser(ctx context.Context, userKey *datastore.Key) error {
+	return nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := nds.Delete(ctx, userKey); err != nil {
+			return err
+		}
+
+		return unindexEmail(ctx, userKey.Parent(), userKey.StringID())
+	}, xgTransaction)
+}
+
+// Load tells datastore how to deserialize EmailIndexes.
+func (i *EmailIndex) Load(p []datastore.Property) error {
+	return datastore.LoadStruct(i, p)
+}
+
+// Save tells datastore how to serialize EmailIndexes.
+func (i *EmailIndex) Save() ([]datastore.Property, error) {
+	i.updateTimes()
+
+	return datastore.SaveStruct(i)
+}
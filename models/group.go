@@ -0,0 +1,256 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	groupKind = "Group"
+
+	// MaxGroups is the maximum number of Groups a Company may have.
+	MaxGroups = 100
+)
+
+var (
+	// ErrTooManyGroups is returned when a Company attempts to create
+	// more than MaxGroups.
+	ErrTooManyGroups = fmt.Errorf("Teams may have at most %d groups.", MaxGroups)
+	// ErrGroupLeadNotMember is returned when a Group's lead isn't
+	// one of its members.
+	ErrGroupLeadNotMember = errors.New("Group leads must be members of the group.")
+)
+
+// Group is a named subset of a Company's Users, such as a department
+// or a squad.  Users may belong to any number of Groups.  Leads are
+// members that may manage the Group's membership.  Every Group has a
+// Company as an ancestor in its Key.
+type Group struct {
+	Company *datastore.Key `json:"-"`
+
+	ID      int64    `json:"id" datastore:"-"`
+	Name    string   `json:"name" datastore:",noindex"`
+	Members []string `json:"members"`
+	Leads   []string `json:"leads" datastore:",noindex"`
+
+	Times
+}
+
+// NewGroupKey creates fully-qualified datastore keys for Groups.
+func NewGroupKey(ctx context.Context, companyKey *datastore.Key, id int64) *datastore.Key {
+	return datastore.NewKey(ctx, groupKind, "", id, companyKey)
+}
+
+// Validate ensures that a Group's name is acceptable and that its
+// leads are among its members.  Duplicate members are dropped.
+func (g *Group) Validate() error {
+	g.Name = strings.TrimSpace(g.Name)
+	if g.Name == "" || len(g.Name) > 50 {
+		return errors.New("Group names must be between 1 and 50 characters long.")
+	}
+
+	g.Members = uniqueEmails(g.Members)
+	g.Leads = uniqueEmails(g.Leads)
+	for _, lead := range g.Leads {
+		if !g.HasMember(lead) {
+			return ErrGroupLeadNotMember
+		}
+	}
+
+	return nil
+}
+
+// HasMember returns true if email is one of the Group's members.
+func (g *Group) HasMember(email string) bool {
+	for _, member := range g.Members {
+		if member == email {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsLead returns true if email is one of the Group's leads.
+func (g *Group) IsLead(email string) bool {
+	for _, lead := range g.Leads {
+		if lead == email {
+			return true
+		}
+	}
+
+	return false
+}
+
+// removeMember removes email from the Group's members and leads.  It
+// returns false if email wasn't a member.
+func (g *Group) removeMember(email string) bool {
+	if !g.HasMember(email) {
+		return false
+	}
+
+	g.Members = withoutEmail(g.Members, email)
+	g.Leads = withoutEmail(g.Leads, email)
+	return true
+}
+
+// GetGroups returns all of a Company's Groups.
+func GetGroups(ctx context.Context, companyKey *datastore.Key) ([]*Group, error) {
+	var groups []*Group
+	keys, err := datastore.NewQuery(groupKind).Ancestor(companyKey).GetAll(ctx, &groups)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		groups[i].ID = key.IntID()
+	}
+
+	return groups, nil
+}
+
+// GetGroup gets one of a Company's Groups by its id.
+func GetGroup(ctx context.Context, companyKey *datastore.Key, id int64) (*Group, error) {
+	var group Group
+	if err := nds.Get(ctx, NewGroupKey(ctx, companyKey, id), &group); err != nil {
+		return nil, err
+	}
+
+	group.ID = id
+	return &group, nil
+}
+
+// CreateGroup stores a new Group for a Company.
+func CreateGroup(ctx context.Context, companyKey *datastore.Key, group *Group) error {
+	if err := group.Validate(); err != nil {
+		return err
+	}
+
+	n, err := datastore.NewQuery(groupKind).Ancestor(companyKey).Count(ctx)
+	if err != nil {
+		return err
+	} else if n >= MaxGroups {
+		return ErrTooManyGroups
+	}
+
+	group.Company = companyKey
+	group.initTimes()
+
+	key := datastore.NewIncompleteKey(ctx, groupKind, companyKey)
+	key, err = nds.Put(ctx, key, group)
+	if err != nil {
+		return err
+	}
+
+	group.ID = key.IntID()
+	return nil
+}
+
+// Put saves the Group to datastore.
+func (g *Group) Put(ctx context.Context) error {
+	if err := g.Validate(); err != nil {
+		return err
+	}
+
+	g.updateTimes()
+	_, err := nds.Put(ctx, NewGroupKey(ctx, g.Company, g.ID), g)
+	return err
+}
+
+// DeleteGroup deletes one of a Company's Groups.
+func DeleteGroup(ctx context.Context, companyKey *datastore.Key, id int64) error {
+	return nds.Delete(ctx, NewGroupKey(ctx, companyKey, id))
+}
+
+// AddGroupMembers transactionally adds a User to each of the given
+// Groups.  Groups that no longer exist are skipped.
+func AddGroupMembers(ctx context.Context, companyKey *datastore.Key, ids []int64, email string) error {
+	for _, id := range ids {
+		key := NewGroupKey(ctx, companyKey, id)
+		err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+			var group Group
+			if err := nds.Get(ctx, key, &group); err != nil {
+				return err
+			}
+
+			if group.HasMember(email) {
+				return nil
+			}
+
+			group.Members = append(group.Members, email)
+			group.updateTimes()
+			_, err := nds.Put(ctx, key, &group)
+			return err
+		}, nil)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveGroupMember removes a User from all of the Groups they belong
+// to.
+func RemoveGroupMember(ctx context.Context, companyKey *datastore.Key, email string) error {
+	keys, err := datastore.NewQuery(groupKind).
+		Ancestor(companyKey).
+		Filter("Members=", email).
+		KeysOnly().
+		GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+			var group Group
+			if err := nds.Get(ctx, key, &group); err != nil {
+				return err
+			}
+
+			if !group.removeMember(email) {
+				return nil
+			}
+
+			group.updateTimes()
+			_, err := nds.Put(ctx, key, &group)
+			return err
+		}, nil)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func uniqueEmails(emails []string) []string {
+	seen := make(map[string]bool, len(emails))
+	unique := []string{}
+	for _, email := range emails {
+		if !seen[email] {
+			seen[email] = true
+			unique = append(unique, email)
+		}
+	}
+
+	return unique
+}
+
+func withoutEmail(emails []string, email string) []string {
+	remaining := []string{}
+	for _, e := range emails {
+		if e != email {
+			remaining = append(remaining, e)
+		}
+	}
+
+	return remaining
+}
@@ -2,6 +2,7 @@ package models
 
 import (
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/qedus/nds"
@@ -11,103 +12,334 @@ import (
 )
 
 var (
-	// ErrInviteExpired is returned when attempting to retrieve a Bulk
+	// ErrInviteExpired is returned when attempting to retrieve an
 	// invite that has expired.
-	ErrInviteExpired = errors.New("Bulk invite has expired.")
+	ErrInviteExpired = errors.New("Invite has expired.")
+	// ErrInvalidInviteTTL is returned when setting an invite expiry
+	// that is out of bounds.
+	ErrInvalidInviteTTL = errors.New("Invites must expire within 1 to 90 days.")
+	// ErrInviteUsedUp is returned when attempting to retrieve a bulk
+	// invite that has reached its maximum number of uses.
+	ErrInviteUsedUp = errors.New("Invite link has reached its maximum number of uses.")
+	// ErrInviteDomain is returned when redeeming a bulk invite using
+	// an address outside of its allowed domain.
+	ErrInviteDomain = errors.New("This invite link is restricted to a different e-mail domain.")
 )
 
 const (
-	// BulkInviteTTL is the maximum amount of time that a bulk invite can be valid for.
+	// BulkInviteTTL is the amount of time that bulk invites are valid
+	// for unless they are given an expiry.
 	BulkInviteTTL = 2 * time.Hour
 
+	// DefaultInviteTTLDays is the number of days that individual
+	// invites are valid for unless the Company configures otherwise.
+	DefaultInviteTTLDays = 7
+	// MaxInviteTTLDays is the longest a Company can make invites last.
+	MaxInviteTTLDays = 90
+
 	inviteKind = "Invite"
 )
 
 // Invite represents an individual invitation that is sent out to a
 // User via e-mail.  Invites allow said users to join teams.
 type Invite struct {
-	Company   *datastore.Key
-	FirstName string
-	LastName  string
-	Email     string
-	Bulk      bool
+	Company   *datastore.Key `json:"-"`
+	FirstName string         `json:"firstName"`
+	LastName  string         `json:"lastName"`
+	Email     string         `json:"email"`
+	Bulk      bool           `json:"-"`
+
+	// AllowOtherEmail lets the invitee sign up with an address other
+	// than the one the Invite was sent to.  Such accounts have to be
+	// verified separately.
+	AllowOtherEmail bool `json:"allowOtherEmail"`
+
+	// InvitedBy is the e-mail address of the member that sent the
+	// Invite, if any.
+	InvitedBy string    `json:"invitedBy"`
+	SentAt    time.Time `json:"sentAt" datastore:",noindex"`
+	ExpiresAt time.Time `json:"expiresAt" datastore:",noindex"`
+
+	// Role and Timezone are applied to the invitee's account when
+	// they sign up.  Both are optional.
+	Role     string `json:"role" datastore:",noindex"`
+	Timezone string `json:"timezone" datastore:",noindex"`
+
+	// Groups are the ids of the Groups that the invitee joins when
+	// they sign up.
+	Groups []int64 `json:"groups" datastore:",noindex"`
+
+	// Bulk invites are shareable links that can be used by more than
+	// one person.  MaxUses is unlimited when 0 and Joined holds the
+	// addresses of everyone that signed up using the link.
+	Name          string   `json:"name" datastore:",noindex"`
+	MaxUses       int      `json:"maxUses" datastore:",noindex"`
+	Uses          int      `json:"uses" datastore:",noindex"`
+	AllowedDomain string   `json:"allowedDomain" datastore:",noindex"`
+	Joined        []string `json:"joined" datastore:",noindex"`
 
 	Times
 }
 
 // NewInvite initializes a new Invite struct.
-func NewInvite(companyKey *datastore.Key, firstName, lastName, email string) *Invite {
+func NewInvite(
+	companyKey *datastore.Key,
+	firstName, lastName, email string, allowOtherEmail bool,
+) *Invite {
 	invite := Invite{
-		Company:   companyKey,
-		FirstName: firstName,
-		LastName:  lastName,
-		Email:     email,
+		Company:         companyKey,
+		FirstName:       firstName,
+		LastName:        lastName,
+		Email:           email,
+		AllowOtherEmail: allowOtherEmail,
 	}
 	invite.initTimes()
+	invite.SentAt = invite.CreatedAt
+	invite.ExpiresAt = invite.CreatedAt.Add(InviteTTL(DefaultInviteTTLDays))
 	return &invite
 }
 
+// InviteTTL converts a number of days into the lifetime of an Invite.
+func InviteTTL(days int) time.Duration {
+	if days <= 0 {
+		days = DefaultInviteTTLDays
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// NewInviteKey creates fully-qualified datastore keys for Invites.
+func NewInviteKey(ctx context.Context, companyKey *datastore.Key, inviteID int64) *datastore.Key {
+	return datastore.NewKey(ctx, inviteKind, "", inviteID, companyKey)
+}
+
 // NewBulkInvite initializes an Invite struct that can be used to
 // invite multiple team members.
-func NewBulkInvite(companyKey *datastore.Key) *Invite {
+func NewBulkInvite(companyKey *datastore.Key, name string) *Invite {
 	invite := Invite{
 		Company: companyKey,
 		Bulk:    true,
+		Name:    name,
 	}
 	invite.initTimes()
+	invite.ExpiresAt = invite.CreatedAt.Add(BulkInviteTTL)
 	return &invite
 }
 
-// CreateInvite creates an invite entity in the datastore.  This
-// automatically sends out an e-mail invitation on success.
-func CreateInvite(
+// BoundEmail returns true if the invitee must sign up using the
+// address that the Invite was sent to.
+func (i *Invite) BoundEmail() bool {
+	return !i.Bulk && !i.AllowOtherEmail
+}
+
+// CreateInvite stores an Invite built by NewInvite or NewBulkInvite in
+// the datastore such that it expires after ttl.
+func CreateInvite(ctx context.Context, invite *Invite, ttl time.Duration) (*datastore.Key, error) {
+	invite.ExpiresAt = invite.CreatedAt.Add(ttl)
+	key := datastore.NewIncompleteKey(ctx, inviteKind, invite.Company)
+	return nds.Put(ctx, key, invite)
+}
+
+// GetInvite gets an invite belonging to a Company by its id.  Expired
+// invites are returned along with ErrInviteExpired and bulk invites
+// that can't be used anymore along with ErrInviteUsedUp.
+func GetInvite(
 	ctx context.Context,
-	companyKey *datastore.Key, firstName, lastName, email string,
-) (*datastore.Key, *Invite, error) {
+	companyKey *datastore.Key, inviteID int64,
+) (*Invite, error) {
+
+	invite := Invite{}
+	if err := nds.Get(ctx, NewInviteKey(ctx, companyKey, inviteID), &invite); err != nil {
+		return nil, err
+	}
+
+	if invite.Expired(time.Now()) {
+		return &invite, ErrInviteExpired
+	}
+
+	if invite.UsedUp() {
+		return &invite, ErrInviteUsedUp
+	}
 
-	invite := NewInvite(companyKey, firstName, lastName, email)
-	key := datastore.NewIncompleteKey(ctx, inviteKind, companyKey)
-	key, err := nds.Put(ctx, key, invite)
+	return &invite, nil
+}
+
+// GetBulkInvites returns all of a Company's bulk invites along with
+// their keys, including expired ones.
+func GetBulkInvites(ctx context.Context, companyKey *datastore.Key) ([]*datastore.Key, []*Invite, error) {
+	invites := []*Invite{}
+	keys, err := datastore.NewQuery(inviteKind).
+		Ancestor(companyKey).
+		Filter("Bulk=", true).
+		GetAll(ctx, &invites)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return key, invite, nil
+	return keys, invites, nil
 }
 
-// CreateBulkInvite creates a bulk invite entity in the datastore.
-func CreateBulkInvite(
+// CreateInvitedUser transactionally creates a team member and uses up
+// the Invite that they followed.  Bulk invites record that email
+// joined using them and individual ones are deleted, so that neither
+// can be used more often than allowed even by concurrent sign ups.
+func CreateInvitedUser(
 	ctx context.Context,
-	companyKey *datastore.Key,
+	companyKey *datastore.Key, inviteID int64,
+	firstName, lastName, email, password, timezone string,
+	unverified bool,
+) (*User, error) {
+
+	key := NewInviteKey(ctx, companyKey, inviteID)
+	return createUser(
+		ctx, companyKey,
+		firstName, lastName, email, password, timezone, unverified,
+		func(ctx context.Context) error {
+			var invite Invite
+			if err := nds.Get(ctx, key, &invite); err != nil {
+				return err
+			}
+
+			switch {
+			case invite.Expired(time.Now()):
+				return ErrInviteExpired
+			case !invite.Bulk:
+				return nds.Delete(ctx, key)
+			case invite.UsedUp():
+				return ErrInviteUsedUp
+			case !invite.AllowsEmail(email):
+				return ErrInviteDomain
+			}
+
+			invite.Uses++
+			invite.Joined = append(invite.Joined, email)
+			_, err := nds.Put(ctx, key, &invite)
+			return err
+		},
+	)
+}
+
+// FindPendingInvites returns a query that will retrieve all of a
+// Company's individual Invites, including expired ones.
+func FindPendingInvites(companyKey *datastore.Key) *datastore.Query {
+	return datastore.NewQuery(inviteKind).
+		Ancestor(companyKey).
+		Filter("Bulk=", false)
+}
+
+// GetPendingInvites returns all of a Company's individual Invites
+// along with their keys, including expired ones.
+func GetPendingInvites(ctx context.Context, companyKey *datastore.Key) ([]*datastore.Key, []*Invite, error) {
+	invites := []*Invite{}
+	keys, err := FindPendingInvites(companyKey).GetAll(ctx, &invites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, invites, nil
+}
+
+// CountPendingInvites returns the number of individual Invites that
+// haven't expired yet.  These hold on to a seat until they expire.
+func CountPendingInvites(ctx context.Context, companyKey *datastore.Key) (int, error) {
+	_, invites, err := GetPendingInvites(ctx, companyKey)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	now := time.Now()
+	for _, invite := range invites {
+		if !invite.Expired(now) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// FindPendingInvite looks up an individual Invite by the address it
+// was sent to.
+func FindPendingInvite(
+	ctx context.Context,
+	companyKey *datastore.Key, email string,
 ) (*datastore.Key, *Invite, error) {
 
-	invite := NewBulkInvite(companyKey)
-	key := datastore.NewIncompleteKey(ctx, inviteKind, companyKey)
-	key, err := nds.Put(ctx, key, invite)
+	var invite Invite
+	key, err := FindPendingInvites(companyKey).
+		Filter("Email=", email).
+		Run(ctx).
+		Next(&invite)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return key, invite, nil
+	return key, &invite, nil
 }
 
-// GetInvite gets an invite belonging to a Company by its id.
-func GetInvite(
+// RenewInvite pushes an Invite's expiry back to ttl from now.  It's
+// used when an Invite is sent again.  If it's not nil, update is
+// called within the same transaction to change the Invite's details.
+func RenewInvite(
 	ctx context.Context,
-	companyKey *datastore.Key, inviteID int64,
+	companyKey *datastore.Key, inviteID int64, ttl time.Duration,
+	update func(*Invite),
 ) (*Invite, error) {
 
-	invite := Invite{}
-	inviteKey := datastore.NewKey(ctx, inviteKind, "", inviteID, companyKey)
-	if err := nds.Get(ctx, inviteKey, &invite); err != nil {
+	var invite Invite
+	key := NewInviteKey(ctx, companyKey, inviteID)
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := nds.Get(ctx, key, &invite); err != nil {
+			return err
+		}
+
+		if invite.Bulk {
+			return datastore.ErrNoSuchEntity
+		}
+
+		if update != nil {
+			update(&invite)
+		}
+
+		invite.SentAt = time.Now()
+		invite.ExpiresAt = invite.SentAt.Add(ttl)
+		_, err := nds.Put(ctx, key, &invite)
+		return err
+	}, nil)
+	if err != nil {
 		return nil, err
 	}
 
-	if invite.Bulk && time.Now().Sub(invite.CreatedAt) >= BulkInviteTTL {
-		return nil, ErrInviteExpired
+	return &invite, nil
+}
+
+// Expired returns true if the Invite can no longer be used.  Invites
+// created before they had an expiry date use the default one.
+func (i *Invite) Expired(now time.Time) bool {
+	expiresAt := i.ExpiresAt
+	if expiresAt.IsZero() && i.Bulk {
+		expiresAt = i.CreatedAt.Add(BulkInviteTTL)
+	} else if expiresAt.IsZero() {
+		expiresAt = i.CreatedAt.Add(InviteTTL(DefaultInviteTTLDays))
+	}
+
+	return !now.Before(expiresAt)
+}
+
+// UsedUp returns true if a bulk invite has reached its maximum number
+// of uses.
+func (i *Invite) UsedUp() bool {
+	return i.Bulk && i.MaxUses > 0 && i.Uses >= i.MaxUses
+}
+
+// AllowsEmail returns true if email may be used to sign up with the
+// Invite.  Only bulk invites can be restricted to a domain.
+func (i *Invite) AllowsEmail(email string) bool {
+	if i.AllowedDomain == "" {
+		return true
 	}
 
-	return &invite, nil
+	return strings.HasSuffix(strings.ToLower(email), "@"+strings.ToLower(i.AllowedDomain))
 }
 
 // DeleteInvite deletes an invite belonging to a Company by its id
@@ -116,8 +348,5 @@ func DeleteInvite(
 	companyKey *datastore.Key, inviteID int64,
 ) error {
 
-	return nds.Delete(
-		ctx,
-		datastore.NewKey(ctx, inviteKind, "", inviteID, companyKey),
-	)
+	return nds.Delete(ctx, NewInviteKey(ctx, companyKey, inviteID))
 }
@@ -0,0 +1,118 @@
+package models
+
+import (
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	inviteJobKind = "InviteJob"
+)
+
+// InviteJob statuses.
+const (
+	InviteJobPending = "pending"
+	InviteJobDone    = "done"
+)
+
+// InviteJobRow is a single invitation within an InviteJob.
+type InviteJobRow struct {
+	FirstName string
+	LastName  string
+	Email     string
+	Role      string
+	Timezone  string
+}
+
+// InviteJob tracks the progress of sending out a batch of invites,
+// usually uploaded as a CSV file.  Rows are validated before the job
+// is created so the job only has to enqueue them.  Every InviteJob
+// has a Company as an ancestor in its Key.
+type InviteJob struct {
+	Company   *datastore.Key `json:"-"`
+	CreatedBy string         `json:"createdBy"`
+
+	ID       int64          `json:"id" datastore:"-"`
+	Status   string         `json:"status"`
+	Total    int            `json:"total" datastore:",noindex"`
+	Enqueued int            `json:"enqueued" datastore:",noindex"`
+	Rows     []InviteJobRow `json:"-" datastore:",noindex"`
+
+	Times
+}
+
+// NewInviteJobKey creates fully-qualified datastore keys for
+// InviteJobs.
+func NewInviteJobKey(ctx context.Context, companyKey *datastore.Key, jobID int64) *datastore.Key {
+	return datastore.NewKey(ctx, inviteJobKind, "", jobID, companyKey)
+}
+
+// CreateInviteJob stores a new InviteJob for the given rows.
+func CreateInviteJob(
+	ctx context.Context,
+	companyKey *datastore.Key, createdBy string, rows []InviteJobRow,
+) (*InviteJob, error) {
+
+	job := InviteJob{
+		Company:   companyKey,
+		CreatedBy: createdBy,
+		Status:    InviteJobPending,
+		Total:     len(rows),
+		Rows:      rows,
+	}
+	job.initTimes()
+
+	key := datastore.NewIncompleteKey(ctx, inviteJobKind, companyKey)
+	key, err := nds.Put(ctx, key, &job)
+	if err != nil {
+		return nil, err
+	}
+
+	job.ID = key.IntID()
+	return &job, nil
+}
+
+// GetInviteJob gets an InviteJob belonging to a Company by its id.
+func GetInviteJob(ctx context.Context, companyKey *datastore.Key, jobID int64) (*InviteJob, error) {
+	var job InviteJob
+	if err := nds.Get(ctx, NewInviteJobKey(ctx, companyKey, jobID), &job); err != nil {
+		return nil, err
+	}
+
+	job.ID = jobID
+	return &job, nil
+}
+
+// Advance records that the rows before enqueued have been enqueued,
+// marking the InviteJob as done once all of them have been.
+func (j *InviteJob) Advance(enqueued int) {
+	j.Enqueued = enqueued
+	if j.Enqueued >= j.Total {
+		j.Status = InviteJobDone
+	}
+}
+
+// Key is a helper function for building an InviteJob's key.
+func (j *InviteJob) Key(ctx context.Context) *datastore.Key {
+	return NewInviteJobKey(ctx, j.Company, j.ID)
+}
+
+// Load tells datastore how to deserialize InviteJobs.  The id is the
+// key id so it has to be set by the caller.
+func (j *InviteJob) Load(p []datastore.Property) error {
+	return datastore.LoadStruct(j, p)
+}
+
+// Save tells datastore how to serialize InviteJobs.
+func (j *InviteJob) Save() ([]datastore.Property, error) {
+	j.updateTimes()
+
+	return datastore.SaveStruct(j)
+}
+
+// Put saves the InviteJob to Datastore.
+func (j *InviteJob) Put(ctx context.Context) (*datastore.Key, error) {
+	return nds.Put(ctx, j.Key(ctx), j)
+}
@@ -0,0 +1,99 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	joinRequestKind = "JoinRequest"
+)
+
+// JoinRequest is a request to join a Company made by someone with an
+// address on one of its verified Domains.  JoinRequests are only
+// created once the address has been confirmed and wait for a manager
+// to approve or deny them.  Every JoinRequest has a Company as an
+// ancestor in its Key and the lowercased address as the key name.
+type JoinRequest struct {
+	Company   *datastore.Key `json:"-"`
+	FirstName string         `json:"firstName" datastore:",noindex"`
+	LastName  string         `json:"lastName" datastore:",noindex"`
+	Email     string         `json:"email" datastore:",noindex"`
+	Timezone  string         `json:"timezone" datastore:",noindex"`
+
+	Times
+}
+
+// NewJoinRequestKey creates fully-qualified datastore keys for
+// JoinRequests.
+func NewJoinRequestKey(ctx context.Context, companyKey *datastore.Key, email string) *datastore.Key {
+	return datastore.NewKey(ctx, joinRequestKind, strings.ToLower(email), 0, companyKey)
+}
+
+// CreateJoinRequest stores a JoinRequest, replacing any previous
+// request made using the same address.
+func CreateJoinRequest(
+	ctx context.Context,
+	companyKey *datastore.Key, firstName, lastName, email, timezone string,
+) (*JoinRequest, error) {
+
+	request := JoinRequest{
+		Company:   companyKey,
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     email,
+		Timezone:  timezone,
+	}
+	request.initTimes()
+	if _, err := nds.Put(ctx, NewJoinRequestKey(ctx, companyKey, email), &request); err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// GetJoinRequest returns a Company's JoinRequest by e-mail address.
+func GetJoinRequest(ctx context.Context, companyKey *datastore.Key, email string) (*JoinRequest, error) {
+	var request JoinRequest
+	if err := nds.Get(ctx, NewJoinRequestKey(ctx, companyKey, email), &request); err != nil {
+		return nil, err
+	}
+
+	return &request, nil
+}
+
+// GetJoinRequests returns all of a Company's pending JoinRequests,
+// oldest first.
+func GetJoinRequests(ctx context.Context, companyKey *datastore.Key) ([]*JoinRequest, error) {
+	requests := []*JoinRequest{}
+	_, err := datastore.NewQuery(joinRequestKind).
+		Ancestor(companyKey).
+		Order("CreatedAt").
+		GetAll(ctx, &requests)
+	if err != nil {
+		return nil, err
+	}
+
+	return requests, nil
+}
+
+// DeleteJoinRequest removes a Company's JoinRequest by e-mail address.
+func DeleteJoinRequest(ctx context.Context, companyKey *datastore.Key, email string) error {
+	return nds.Delete(ctx, NewJoinRequestKey(ctx, companyKey, email))
+}
+
+// Load tells datastore how to deserialize JoinRequests.
+func (r *JoinRequest) Load(p []datastore.Property) error {
+	return datastore.LoadStruct(r, p)
+}
+
+// Save tells datastore how to serialize JoinRequests.
+func (r *JoinRequest) Save() ([]datastore.Property, error) {
+	r.updateTimes()
+
+	return datastore.SaveStruct(r)
+}
@@ -32,6 +32,10 @@ type Meeting struct {
 	Description string   `json:"description"`
 	Attendees   []string `json:"attendees"`
 
+	// Group is the id of the Group whose members were invited to
+	// the Meeting, if any.
+	Group int64 `json:"group" datastore:",noindex"`
+
 	EventID string `json:"eventId"`
 
 	Times
@@ -0,0 +1,100 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"teamzones/utils"
+	"unicode"
+)
+
+const (
+	// MinPasswordLength is the shortest password length that a
+	// PasswordPolicy may allow.
+	MinPasswordLength = 8
+	// MaxPasswordLength is bounded by bcrypt, which ignores
+	// everything past the 72nd byte.
+	MaxPasswordLength = 72
+)
+
+var (
+	// ErrCommonPassword is returned when a password is on the list of
+	// common and breached passwords.
+	ErrCommonPassword = errors.New("This password is too common. Please choose a different one.")
+	// ErrInvalidPasswordPolicy is returned when a PasswordPolicy's
+	// minimum length is out of bounds.
+	ErrInvalidPasswordPolicy = fmt.Errorf(
+		"The minimum length must be between %d and %d characters.",
+		MinPasswordLength, MaxPasswordLength,
+	)
+)
+
+// PasswordPolicy is the set of rules that a Company's passwords must
+// follow.  The zero value is the default policy.
+type PasswordPolicy struct {
+	MinLength        int  `json:"minLength"`
+	RequireMixedCase bool `json:"requireMixedCase"`
+	RequireNumber    bool `json:"requireNumber"`
+	RequireSymbol    bool `json:"requireSymbol"`
+}
+
+// DefaultPasswordPolicy applies when there is no Company yet, for
+// example when signing up.
+var DefaultPasswordPolicy = PasswordPolicy{}
+
+// Check returns an error if the policy itself is invalid.
+func (p PasswordPolicy) Check() error {
+	if p.MinLength != 0 && (p.MinLength < MinPasswordLength || p.MinLength > MaxPasswordLength) {
+		return ErrInvalidPasswordPolicy
+	}
+
+	return nil
+}
+
+func (p PasswordPolicy) minLength() int {
+	if p.MinLength < MinPasswordLength {
+		return MinPasswordLength
+	}
+
+	return p.MinLength
+}
+
+// Validate returns an error describing the first rule that password
+// breaks.  Its signature matches forms.Validator.
+func (p PasswordPolicy) Validate(password string) error {
+	if len(password) < p.minLength() {
+		return fmt.Errorf("Passwords must be at least %d characters long.", p.minLength())
+	}
+
+	if len(password) > MaxPasswordLength {
+		return fmt.Errorf("Passwords can be at most %d characters long.", MaxPasswordLength)
+	}
+
+	var lower, upper, number, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			number = true
+		default:
+			symbol = true
+		}
+	}
+
+	switch {
+	case p.RequireMixedCase && !(lower && upper):
+		return errors.New("Passwords must contain both upper and lower case letters.")
+	case p.RequireNumber && !number:
+		return errors.New("Passwords must contain at least one number.")
+	case p.RequireSymbol && !symbol:
+		return errors.New("Passwords must contain at least one symbol.")
+	}
+
+	if utils.IsCommonPassword(password) {
+		return ErrCommonPassword
+	}
+
+	return nil
+}
@@ -0,0 +1,302 @@
+package models
+
+import (
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+// PersonalData is everything that is tied to a single User within a
+// Company.  It's used to fulfill data subject access requests.
+type PersonalData struct {
+	User *User
+
+	// Meetings are the Meetings owned by the User and
+	// AttendedMeetings are the ones they were invited to by other
+	// members.
+	Meetings         []*PersonalMeeting
+	AttendedMeetings []*PersonalMeeting
+
+	GCalendarData *GCalendarData
+	OAuth2Tokens  []*OAuth2Token
+
+	Sessions            []*Session
+	APITokens           []*APIToken
+	WebAuthnCredentials []*WebAuthnCredential
+
+	// Invites are the Invites sent to the User's address as well as
+	// the ones that they sent to others.
+	Invites     []*Invite
+	AuditEvents []*AuditEvent
+}
+
+// PersonalMeeting is a Meeting along with the address of its owner.
+type PersonalMeeting struct {
+	ID    int64  `json:"id"`
+	Owner string `json:"owner"`
+
+	*Meeting
+}
+
+// CollectPersonalData gathers all of a User's PersonalData.
+func CollectPersonalData(ctx context.Context, userKey *datastore.Key) (*PersonalData, error) {
+	var user User
+	if err := nds.Get(ctx, userKey, &user); err != nil {
+		return nil, err
+	}
+
+	companyKey, email := userKey.Parent(), user.Email
+	data := PersonalData{User: &user}
+
+	var meetings []*Meeting
+	keys, err := datastore.NewQuery(meetingKind).Ancestor(userKey).GetAll(ctx, &meetings)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		meeting := PersonalMeeting{key.IntID(), email, meetings[i]}
+		data.Meetings = append(data.Meetings, &meeting)
+	}
+
+	meetings = nil
+	keys, err = findAttendedMeetings(companyKey, email).GetAll(ctx, &meetings)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		if !key.Parent().Equal(userKey) {
+			meeting := PersonalMeeting{key.IntID(), key.Parent().StringID(), meetings[i]}
+			data.AttendedMeetings = append(data.AttendedMeetings, &meeting)
+		}
+	}
+
+	if user.GCalendarData != nil {
+		var calendar GCalendarData
+		if err := nds.Get(ctx, user.GCalendarData, &calendar); err == nil {
+			data.GCalendarData = &calendar
+		} else if err != datastore.ErrNoSuchEntity {
+			return nil, err
+		}
+	}
+
+	_, err = datastore.NewQuery(oauth2TokenKind).Ancestor(userKey).GetAll(ctx, &data.OAuth2Tokens)
+	if err != nil {
+		return nil, err
+	}
+
+	if data.Sessions, err = GetSessions(ctx, userKey); err != nil {
+		return nil, err
+	}
+
+	if data.APITokens, err = GetAPITokens(ctx, userKey); err != nil {
+		return nil, err
+	}
+
+	_, err = FindWebAuthnCredentials(userKey).GetAll(ctx, &data.WebAuthnCredentials)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, property := range []string{"Email=", "InvitedBy="} {
+		var invites []*Invite
+		_, err := datastore.NewQuery(inviteKind).
+			Ancestor(companyKey).
+			Filter(property, email).
+			GetAll(ctx, &invites)
+		if err != nil {
+			return nil, err
+		}
+
+		data.Invites = append(data.Invites, invites...)
+	}
+
+	for _, property := range []string{"Actor=", "Target="} {
+		var events []*AuditEvent
+		_, err := datastore.NewQuery(auditEventKind).
+			Ancestor(companyKey).
+			Filter(property, email).
+			GetAll(ctx, &events)
+		if err != nil {
+			return nil, err
+		}
+
+		data.AuditEvents = append(data.AuditEvents, events...)
+	}
+
+	return &data, nil
+}
+
+// ErasePersonalData deletes a User along with everything that belongs
+// to them and anonymizes the records that other members still need,
+// such as the Company's AuditEvents and other members' Meetings.  The
+// User's avatar blob isn't deleted since it's not stored in
+// datastore.
+func ErasePersonalData(ctx context.Context, userKey *datastore.Key) error {
+	var user User
+	if err := nds.Get(ctx, userKey, &user); err != nil {
+		return err
+	}
+
+	companyKey, email := userKey.Parent(), user.Email
+
+	// Meetings that other members invited the User to.
+	var meetings []*Meeting
+	keys, err := findAttendedMeetings(companyKey, email).GetAll(ctx, &meetings)
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		if key.Parent().Equal(userKey) {
+			continue
+		}
+
+		attendees := meetings[i].Attendees[:0]
+		for _, attendee := range meetings[i].Attendees {
+			if attendee != email {
+				attendees = append(attendees, attendee)
+			}
+		}
+
+		meetings[i].Attendees = attendees
+		if _, err := nds.Put(ctx, key, meetings[i]); err != nil {
+			return err
+		}
+	}
+
+	// Invites sent to the User are deleted and ones sent by them
+	// are anonymized.
+	var invites []*Invite
+	keys, err = datastore.NewQuery(inviteKind).
+		Ancestor(companyKey).
+		Filter("Email=", email).
+		KeysOnly().
+		GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := nds.DeleteMulti(ctx, keys); err != nil {
+		return err
+	}
+
+	keys, err = datastore.NewQuery(inviteKind).
+		Ancestor(companyKey).
+		Filter("InvitedBy=", email).
+		GetAll(ctx, &invites)
+	if err != nil {
+		return err
+	}
+
+	for _, invite := range invites {
+		invite.InvitedBy = ""
+	}
+
+	if _, err := nds.PutMulti(ctx, keys, invites); err != nil {
+		return err
+	}
+
+	// Shareable invite links keep the addresses of the people that
+	// used them.
+	invites = nil
+	keys, err = datastore.NewQuery(inviteKind).
+		Ancestor(companyKey).
+		Filter("Bulk=", true).
+		GetAll(ctx, &invites)
+	if err != nil {
+		return err
+	}
+
+	for i, invite := range invites {
+		joined := invite.Joined[:0]
+		for _, address := range invite.Joined {
+			if address != email {
+				joined = append(joined, address)
+			}
+		}
+
+		if len(joined) != len(invite.Joined) {
+			invite.Joined = joined
+			if _, err := nds.Put(ctx, keys[i], invite); err != nil {
+				return err
+			}
+		}
+	}
+
+	// AuditEvents are kept for the Company's sake but they no longer
+	// identify the User.
+	for _, property := range []string{"Actor=", "Target="} {
+		var events []*AuditEvent
+		keys, err := datastore.NewQuery(auditEventKind).
+			Ancestor(companyKey).
+			Filter(property, email).
+			GetAll(ctx, &events)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			event.anonymize(email)
+		}
+
+		if _, err := nds.PutMulti(ctx, keys, events); err != nil {
+			return err
+		}
+	}
+
+	if err := RevokeAPITokens(ctx, userKey); err != nil {
+		return err
+	}
+
+	for _, kind := range []string{signInTokenKind, tokenKind} {
+		keys, err := datastore.NewQuery(kind).
+			Ancestor(companyKey).
+			Filter("User=", userKey).
+			KeysOnly().
+			GetAll(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if err := nds.DeleteMulti(ctx, keys); err != nil {
+			return err
+		}
+	}
+
+	if err := DeleteJoinRequest(ctx, companyKey, email); err != nil {
+		return err
+	}
+
+	if err := RemoveGroupMember(ctx, companyKey, email); err != nil {
+		return err
+	}
+
+	// Meetings, GCalendarData, OAuth2Tokens, Sessions and
+	// WebAuthnCredentials all live under the User.
+	keys, err = datastore.NewQuery("").Ancestor(userKey).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	descendants := keys[:0]
+	for _, key := range keys {
+		if !key.Equal(userKey) {
+			descendants = append(descendants, key)
+		}
+	}
+
+	if err := nds.DeleteMulti(ctx, descendants); err != nil {
+		return err
+	}
+
+	return DeleteUser(ctx, userKey)
+}
+
+func findAttendedMeetings(companyKey *datastore.Key, email string) *datastore.Query {
+	return datastore.NewQuery(meetingKind).
+		Ancestor(companyKey).
+		Filter("Attendees=", email)
+}
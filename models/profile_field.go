@@ -0,0 +1,291 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	profileFieldKind = "ProfileField"
+
+	// MaxProfileFields is the maximum number of ProfileFields a
+	// Company may define.
+	MaxProfileFields = 20
+	// maxProfileFieldOptions is the maximum number of options a
+	// select ProfileField may have.
+	maxProfileFieldOptions = 50
+	// maxCustomFieldLength is the maximum length of a custom field's
+	// value.
+	maxCustomFieldLength = 200
+)
+
+// ProfileField kinds.
+const (
+	ProfileFieldText   = "text"
+	ProfileFieldSelect = "select"
+	ProfileFieldURL    = "url"
+)
+
+// ProfileField visibilities decide who can see a member's value for a
+// ProfileField.  Members can always see their own values.
+const (
+	ProfileFieldVisibleTeam     = "team"
+	ProfileFieldVisibleManagers = "managers"
+)
+
+var (
+	// ErrTooManyProfileFields is returned when a Company attempts to
+	// define more than MaxProfileFields.
+	ErrTooManyProfileFields = fmt.Errorf("Teams may define at most %d custom fields.", MaxProfileFields)
+	// ErrInvalidProfileField is returned when a ProfileField's kind
+	// or visibility is unknown.
+	ErrInvalidProfileField = errors.New("Invalid custom field.")
+)
+
+// ProfileField is a custom profile field defined by a Company.  Each
+// of the Company's Users may have a CustomFieldValue for it.  Every
+// ProfileField has a Company as an ancestor in its Key.
+type ProfileField struct {
+	Company *datastore.Key `json:"-"`
+
+	ID         int64    `json:"id" datastore:"-"`
+	Name       string   `json:"name" datastore:",noindex"`
+	Kind       string   `json:"kind" datastore:",noindex"`
+	Options    []string `json:"options" datastore:",noindex"`
+	Visibility string   `json:"visibility" datastore:",noindex"`
+
+	Times
+}
+
+// CustomFieldValue is a User's value for one of their Company's
+// ProfileFields.
+type CustomFieldValue struct {
+	FieldID int64  `json:"fieldId"`
+	Value   string `json:"value"`
+}
+
+// NewProfileFieldKey creates fully-qualified datastore keys for
+// ProfileFields.
+func NewProfileFieldKey(ctx context.Context, companyKey *datastore.Key, id int64) *datastore.Key {
+	return datastore.NewKey(ctx, profileFieldKind, "", id, companyKey)
+}
+
+// Validate ensures that a ProfileField's definition is consistent.
+func (f *ProfileField) Validate() error {
+	f.Name = strings.TrimSpace(f.Name)
+	if f.Name == "" || len(f.Name) > 50 {
+		return errors.New("Custom field names must be between 1 and 50 characters long.")
+	}
+
+	switch f.Visibility {
+	case ProfileFieldVisibleTeam, ProfileFieldVisibleManagers:
+	default:
+		return ErrInvalidProfileField
+	}
+
+	switch f.Kind {
+	case ProfileFieldText, ProfileFieldURL:
+		f.Options = nil
+	case ProfileFieldSelect:
+		if len(f.Options) == 0 || len(f.Options) > maxProfileFieldOptions {
+			return fmt.Errorf("Select fields must have between 1 and %d options.", maxProfileFieldOptions)
+		}
+	default:
+		return ErrInvalidProfileField
+	}
+
+	return nil
+}
+
+// ValidateValue ensures that value is acceptable for the ProfileField.
+// Empty values are always allowed.
+func (f *ProfileField) ValidateValue(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	if len(value) > maxCustomFieldLength {
+		return fmt.Errorf("%s can contain at most %d characters.", f.Name, maxCustomFieldLength)
+	}
+
+	switch f.Kind {
+	case ProfileFieldSelect:
+		for _, option := range f.Options {
+			if option == value {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("%q is not a valid option for %s.", value, f.Name)
+	case ProfileFieldURL:
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s must be a valid URL.", f.Name)
+		}
+	}
+
+	return nil
+}
+
+// VisibleTo returns true if viewer may see other members' values for
+// the ProfileField.
+func (f *ProfileField) VisibleTo(viewer *User) bool {
+	return f.Visibility == ProfileFieldVisibleTeam ||
+		viewer.Role == RoleMain ||
+		viewer.Role == RoleManager
+}
+
+// GetProfileFields returns all of a Company's ProfileFields.
+func GetProfileFields(ctx context.Context, companyKey *datastore.Key) ([]*ProfileField, error) {
+	var fields []*ProfileField
+	keys, err := datastore.NewQuery(profileFieldKind).
+		Ancestor(companyKey).
+		GetAll(ctx, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range keys {
+		fields[i].ID = key.IntID()
+	}
+
+	return fields, nil
+}
+
+// CreateProfileField stores a new ProfileField for a Company.
+func CreateProfileField(
+	ctx context.Context,
+	companyKey *datastore.Key, field *ProfileField,
+) error {
+
+	if err := field.Validate(); err != nil {
+		return err
+	}
+
+	n, err := datastore.NewQuery(profileFieldKind).Ancestor(companyKey).Count(ctx)
+	if err != nil {
+		return err
+	} else if n >= MaxProfileFields {
+		return ErrTooManyProfileFields
+	}
+
+	field.Company = companyKey
+	field.initTimes()
+
+	key := datastore.NewIncompleteKey(ctx, profileFieldKind, companyKey)
+	key, err = nds.Put(ctx, key, field)
+	if err != nil {
+		return err
+	}
+
+	field.ID = key.IntID()
+	return nil
+}
+
+// GetProfileField gets one of a Company's ProfileFields by its id.
+func GetProfileField(ctx context.Context, companyKey *datastore.Key, id int64) (*ProfileField, error) {
+	var field ProfileField
+	if err := nds.Get(ctx, NewProfileFieldKey(ctx, companyKey, id), &field); err != nil {
+		return nil, err
+	}
+
+	field.ID = id
+	return &field, nil
+}
+
+// Put saves the ProfileField to datastore.
+func (f *ProfileField) Put(ctx context.Context) error {
+	if err := f.Validate(); err != nil {
+		return err
+	}
+
+	f.updateTimes()
+	_, err := nds.Put(ctx, NewProfileFieldKey(ctx, f.Company, f.ID), f)
+	return err
+}
+
+// DeleteProfileField deletes one of a Company's ProfileFields.  Users'
+// values for it are left behind and ignored from then on.
+func DeleteProfileField(ctx context.Context, companyKey *datastore.Key, id int64) error {
+	return nds.Delete(ctx, NewProfileFieldKey(ctx, companyKey, id))
+}
+
+// ValidateCustomFields checks a set of CustomFieldValues against a
+// Company's ProfileFields.  Empty values and duplicates are dropped.
+func ValidateCustomFields(fields []*ProfileField, values []CustomFieldValue) ([]CustomFieldValue, error) {
+	byID := make(map[int64]*ProfileField, len(fields))
+	for _, field := range fields {
+		byID[field.ID] = field
+	}
+
+	seen := make(map[int64]bool, len(values))
+	valid := []CustomFieldValue{}
+	for _, value := range values {
+		field, ok := byID[value.FieldID]
+		if !ok {
+			return nil, ErrInvalidProfileField
+		}
+
+		value.Value = strings.TrimSpace(value.Value)
+		if err := field.ValidateValue(value.Value); err != nil {
+			return nil, err
+		}
+
+		if value.Value != "" && !seen[value.FieldID] {
+			seen[value.FieldID] = true
+			valid = append(valid, value)
+		}
+	}
+
+	return valid, nil
+}
+
+// VisibleCustomFields returns the subset of a User's CustomFieldValues
+// that viewer is allowed to see.  Values for ProfileFields that no
+// longer exist are dropped.
+func (u *User) VisibleCustomFields(viewer *User, fields []*ProfileField) []CustomFieldValue {
+	byID := make(map[int64]*ProfileField, len(fields))
+	for _, field := range fields {
+		byID[field.ID] = field
+	}
+
+	visible := []CustomFieldValue{}
+	for _, value := range u.CustomFields {
+		field, ok := byID[value.FieldID]
+		if ok && (u.Email == viewer.Email || field.VisibleTo(viewer)) {
+			visible = append(visible, value)
+		}
+	}
+
+	return visible
+}
+
+// Matches returns true if every word in query appears in one of the
+// User's names, e-mail address, profile details or custom field
+// values.  Matching is case insensitive.
+func (u *User) Matches(query string) bool {
+	haystack := []string{
+		u.FirstName, u.LastName, u.Email,
+		u.JobTitle, u.Department, u.City, u.Pronouns, u.Bio,
+	}
+
+	for _, value := range u.CustomFields {
+		haystack = append(haystack, value.Value)
+	}
+
+	text := strings.ToLower(strings.Join(haystack, "\n"))
+	for _, word := range strings.Fields(strings.ToLower(query)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,111 @@
+package models
+
+import (
+	"errors"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+var (
+	// ErrLastOwner is returned when a change would leave a Company
+	// without an owner.
+	ErrLastOwner = errors.New("Every team must have an owner. Transfer ownership first.")
+	// ErrInvalidRole is returned when assigning an unknown role.
+	ErrInvalidRole = errors.New("Invalid role.")
+	// ErrNotOwner is returned when someone other than the owner
+	// attempts to transfer ownership.
+	ErrNotOwner = errors.New("Only the owner can transfer ownership.")
+	// ErrInvalidOwner is returned when transferring ownership to a
+	// member that is deactivated or hasn't verified their address.
+	ErrInvalidOwner = errors.New("Ownership can only be transferred to active, verified members.")
+)
+
+// AssignableRoles are the roles that can be given to team members.
+// Ownership can only be transferred, see TransferOwnership.
+var AssignableRoles = []string{
+	RoleManager,
+	RoleBilling,
+	RoleUser,
+}
+
+// IsAssignableRole returns true if role can be given to team members.
+func IsAssignableRole(role string) bool {
+	for _, r := range AssignableRoles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// CanManageBilling returns true if the User may manage their
+// Company's subscription.
+func (u *User) CanManageBilling() bool {
+	return u.Role == RoleMain || u.Role == RoleBilling
+}
+
+// SetRole transactionally changes a User's role.  The owner's role
+// can't be changed since that would leave the Company without one.
+func SetRole(ctx context.Context, userKey *datastore.Key, role string) (*User, error) {
+	if !IsAssignableRole(role) {
+		return nil, ErrInvalidRole
+	}
+
+	var user User
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := nds.Get(ctx, userKey, &user); err != nil {
+			return err
+		}
+
+		if user.Role == RoleMain {
+			return ErrLastOwner
+		}
+
+		user.Role = role
+		_, err := nds.Put(ctx, userKey, &user)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// TransferOwnership transactionally makes another member the owner
+// of a Company.  The previous owner becomes a manager.  The new owner
+// must be active and have verified their e-mail address.
+func TransferOwnership(ctx context.Context, fromKey, toKey *datastore.Key) (*User, *User, error) {
+	var from, to User
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := nds.Get(ctx, fromKey, &from); err != nil {
+			return err
+		}
+
+		if err := nds.Get(ctx, toKey, &to); err != nil {
+			return err
+		}
+
+		if from.Role != RoleMain {
+			return ErrNotOwner
+		}
+
+		if to.Deactivated || to.Unverified {
+			return ErrInvalidOwner
+		}
+
+		from.Role = RoleManager
+		to.Role = RoleMain
+		_, err := nds.PutMulti(ctx, []*datastore.Key{fromKey, toKey}, []*User{&from, &to})
+		return err
+	}, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &from, &to, nil
+}
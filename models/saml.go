@@ -0,0 +1,87 @@
+package models
+
+import (
+	"teamzones/integrations"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	samlProviderKind = "SAMLProvider"
+	samlProviderID   = "default"
+)
+
+// SAMLProvider represents a Company's SAML 2.0 Identity Provider.
+// Every Company can have at most one SAMLProvider and it is always
+// stored under the same key.
+type SAMLProvider struct {
+	Company *datastore.Key `json:"-"`
+
+	EntityID string `json:"entityId"`
+	SSOURL   string `json:"ssoUrl"`
+	Metadata string `json:"-" datastore:",noindex"`
+
+	// Enforced disables password sign in for everyone except for
+	// the Company's owner.
+	Enforced bool `json:"enforced"`
+
+	Times
+}
+
+// NewSAMLProvider initializes a SAMLProvider from an IdP's metadata.
+func NewSAMLProvider(company *datastore.Key, metadata string) (*SAMLProvider, error) {
+	idp, err := integrations.ParseSAMLMetadata([]byte(metadata))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := SAMLProvider{
+		Company:  company,
+		EntityID: idp.EntityID,
+		SSOURL:   idp.SSOURL,
+		Metadata: metadata,
+	}
+	provider.initTimes()
+	return &provider, nil
+}
+
+// NewSAMLProviderKey creates the datastore key for a Company's
+// SAMLProvider.
+func NewSAMLProviderKey(ctx context.Context, company *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, samlProviderKind, samlProviderID, 0, company)
+}
+
+// GetSAMLProvider retrieves a Company's SAMLProvider.
+func GetSAMLProvider(ctx context.Context, company *datastore.Key) (*SAMLProvider, error) {
+	var provider SAMLProvider
+	if err := nds.Get(ctx, NewSAMLProviderKey(ctx, company), &provider); err != nil {
+		return nil, err
+	}
+
+	return &provider, nil
+}
+
+// IdentityProvider parses the SAMLProvider's stored metadata.
+func (p *SAMLProvider) IdentityProvider() (*integrations.SAMLIdentityProvider, error) {
+	return integrations.ParseSAMLMetadata([]byte(p.Metadata))
+}
+
+// Load tells datastore how to deserialize SAMLProviders.
+func (p *SAMLProvider) Load(ps []datastore.Property) error {
+	return datastore.LoadStruct(p, ps)
+}
+
+// Save tells datastore how to serialize SAMLProviders.
+func (p *SAMLProvider) Save() ([]datastore.Property, error) {
+	p.updateTimes()
+
+	return datastore.SaveStruct(p)
+}
+
+// Put saves the SAMLProvider to Datastore.
+func (p *SAMLProvider) Put(ctx context.Context) (*datastore.Key, error) {
+	return nds.Put(ctx, NewSAMLProviderKey(ctx, p.Company), p)
+}
@@ -0,0 +1,206 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"teamzones/utils"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	sessionKind = "Session"
+
+	sessionIdleTimeout               = 2 * time.Hour
+	sessionAbsoluteTimeout           = 12 * time.Hour
+	sessionRememberedIdleTimeout     = 30 * 24 * time.Hour
+	sessionRememberedAbsoluteTimeout = 90 * 24 * time.Hour
+
+	// sessionTouchInterval limits how often LastSeenAt is updated so
+	// that every request doesn't result in a write.
+	sessionTouchInterval = 5 * time.Minute
+)
+
+// Session is the server-side record of a signed-in browser.  The
+// session cookie holds a random id whose hash is the Session's key
+// name.  Every Session has a User as its parent.
+type Session struct {
+	Company *datastore.Key `json:"-"`
+	User    *datastore.Key `json:"-"`
+
+	ID         string    `json:"id" datastore:"-"`
+	UserAgent  string    `json:"userAgent" datastore:",noindex"`
+	IP         string    `json:"ip" datastore:",noindex"`
+	RememberMe bool      `json:"rememberMe" datastore:",noindex"`
+	LastSeenAt time.Time `json:"lastSeenAt" datastore:",noindex"`
+	ExpiresAt  time.Time `json:"expiresAt" datastore:",noindex"`
+
+	Times
+}
+
+func hashSessionID(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewSessionKey creates fully-qualified datastore keys for Sessions
+// from the hashed session id.
+func NewSessionKey(ctx context.Context, user *datastore.Key, hashedID string) *datastore.Key {
+	return datastore.NewKey(ctx, sessionKind, hashedID, 0, user)
+}
+
+// CreateSession stores a new Session for the given User and returns
+// the plain text session id that should be stored in their cookie.
+func CreateSession(
+	ctx context.Context, user *User,
+	userAgent, ip string, rememberMe bool,
+) (string, *Session, error) {
+
+	id := utils.UUID4()
+	session := Session{
+		Company:    user.Company,
+		User:       user.Key(ctx),
+		ID:         hashSessionID(id),
+		UserAgent:  userAgent,
+		IP:         ip,
+		RememberMe: rememberMe,
+	}
+	session.initTimes()
+	session.LastSeenAt = session.CreatedAt
+	session.ExpiresAt = session.CreatedAt.Add(session.absoluteTimeout())
+	if _, err := session.Put(ctx); err != nil {
+		return "", nil, err
+	}
+
+	return id, &session, nil
+}
+
+// GetSession looks up a User's Session by its plain text id.  Expired
+// sessions are treated as if they don't exist.
+func GetSession(ctx context.Context, user *datastore.Key, id string) (*Session, error) {
+	var session Session
+	if err := nds.Get(ctx, NewSessionKey(ctx, user, hashSessionID(id)), &session); err != nil {
+		return nil, err
+	}
+
+	if session.Expired(time.Now()) {
+		return nil, datastore.ErrNoSuchEntity
+	}
+
+	session.ID = hashSessionID(id)
+	return &session, nil
+}
+
+// GetSessions returns all of a User's active Sessions.
+func GetSessions(ctx context.Context, user *datastore.Key) ([]*Session, error) {
+	var sessions []*Session
+	keys, err := FindSessions(user).GetAll(ctx, &sessions)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	active := make([]*Session, 0, len(sessions))
+	for i, session := range sessions {
+		if !session.Expired(now) {
+			session.ID = keys[i].StringID()
+			active = append(active, session)
+		}
+	}
+
+	return active, nil
+}
+
+// FindSessions returns a query that will retrieve all of a User's
+// Sessions.
+func FindSessions(user *datastore.Key) *datastore.Query {
+	return datastore.NewQuery(sessionKind).Ancestor(user)
+}
+
+// RevokeSession deletes a single Session by its hashed id.
+func RevokeSession(ctx context.Context, user *datastore.Key, hashedID string) error {
+	return nds.Delete(ctx, NewSessionKey(ctx, user, hashedID))
+}
+
+// RevokeSessions deletes all of a User's Sessions, signing them out
+// everywhere.
+func RevokeSessions(ctx context.Context, user *datastore.Key) error {
+	keys, err := FindSessions(user).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	return nds.DeleteMulti(ctx, keys)
+}
+
+func (s *Session) idleTimeout() time.Duration {
+	if s.RememberMe {
+		return sessionRememberedIdleTimeout
+	}
+
+	return sessionIdleTimeout
+}
+
+func (s *Session) absoluteTimeout() time.Duration {
+	if s.RememberMe {
+		return sessionRememberedAbsoluteTimeout
+	}
+
+	return sessionAbsoluteTimeout
+}
+
+// MaxAge is the lifetime of the Session's cookie.  Sessions that
+// aren't remembered use cookies that expire with the browser.
+func (s *Session) MaxAge() time.Duration {
+	if s.RememberMe {
+		return s.absoluteTimeout()
+	}
+
+	return 0
+}
+
+// Expired returns true if the Session has been idle for too long or
+// if it has reached its absolute timeout.
+func (s *Session) Expired(now time.Time) bool {
+	return !now.Before(s.ExpiresAt) || !now.Before(s.LastSeenAt.Add(s.idleTimeout()))
+}
+
+// Touch records activity on the Session.  It returns true when the
+// Session needs to be saved.
+func (s *Session) Touch(now time.Time, ip string) bool {
+	if now.Sub(s.LastSeenAt) < sessionTouchInterval && s.IP == ip {
+		return false
+	}
+
+	s.LastSeenAt = now
+	s.IP = ip
+	return true
+}
+
+// Key is a helper function for building a Session's key.
+func (s *Session) Key(ctx context.Context) *datastore.Key {
+	return NewSessionKey(ctx, s.User, s.ID)
+}
+
+// Load tells datastore how to deserialize Sessions.  The id isn't
+// stored as a property since it's the key name so it has to be set
+// by the caller.
+func (s *Session) Load(p []datastore.Property) error {
+	return datastore.LoadStruct(s, p)
+}
+
+// Save tells datastore how to serialize Sessions.
+func (s *Session) Save() ([]datastore.Property, error) {
+	s.updateTimes()
+
+	return datastore.SaveStruct(s)
+}
+
+// Put saves the Session to Datastore.
+func (s *Session) Put(ctx context.Context) (*datastore.Key, error) {
+	return nds.Put(ctx, s.Key(ctx), s)
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"teamzones/utils"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	signInTokenKind = "SignInToken"
+	signInTokenTTL  = 15 * time.Minute
+)
+
+// ErrSignInTokenExpired is returned when a SignInToken has expired.
+var ErrSignInTokenExpired = errors.New("Sign in link has expired.")
+
+// SignInToken represents a single-use nonce that signs a User in when
+// they follow a link sent to their e-mail address.  Only a hash of
+// the nonce is stored so that the datastore can't be used to sign
+// in.  Every SignInToken has a Company as an ancestor in its Key.
+type SignInToken struct {
+	Company *datastore.Key `json:"-"`
+	User    *datastore.Key `json:"-"`
+
+	// Switch is set on tokens that hand a signed in User over to
+	// another Membership of their Account.
+	Switch bool `json:"-" datastore:",noindex"`
+
+	Times
+}
+
+func hashSignInToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// NewSignInTokenKey creates fully-qualified datastore keys for
+// SignInTokens from a plain text token.
+func NewSignInTokenKey(
+	ctx context.Context,
+	parent *datastore.Key, token string,
+) *datastore.Key {
+	return datastore.NewKey(ctx, signInTokenKind, hashSignInToken(token), 0, parent)
+}
+
+// CreateSignInToken stores a new sign in token for the given
+// company, user pair and returns the plain text token.
+func CreateSignInToken(
+	ctx context.Context,
+	company, user *datastore.Key,
+) (string, *SignInToken, error) {
+	return createSignInToken(ctx, company, user, false)
+}
+
+// CreateSwitchToken stores a new token that hands a User over to
+// another Membership of their Account and returns the plain text
+// token.
+func CreateSwitchToken(
+	ctx context.Context,
+	company, user *datastore.Key,
+) (string, *SignInToken, error) {
+	return createSignInToken(ctx, company, user, true)
+}
+
+func createSignInToken(
+	ctx context.Context,
+	company, user *datastore.Key, isSwitch bool,
+) (string, *SignInToken, error) {
+	token := SignInToken{}
+	token.Company = company
+	token.User = user
+	token.Switch = isSwitch
+	token.initTimes()
+	nonce := utils.UUID4()
+
+	if _, err := nds.Put(ctx, NewSignInTokenKey(ctx, company, nonce), &token); err != nil {
+		return "", nil, err
+	}
+
+	return nonce, &token, nil
+}
+
+// GetSignInToken returns a token without consuming it.  It's used to
+// show who a token signs in before it's confirmed.
+func GetSignInToken(
+	ctx context.Context,
+	company *datastore.Key,
+	nonce string,
+) (*SignInToken, error) {
+
+	var token SignInToken
+	if err := nds.Get(ctx, NewSignInTokenKey(ctx, company, nonce), &token); err != nil {
+		return nil, err
+	}
+
+	if time.Now().Sub(token.CreatedAt) >= signInTokenTTL {
+		return nil, ErrSignInTokenExpired
+	}
+
+	return &token, nil
+}
+
+// ConsumeSignInToken transactionally retrieves and deletes a token so
+// that it can't be used more than once.
+func ConsumeSignInToken(
+	ctx context.Context,
+	company *datastore.Key,
+	nonce string,
+) (*SignInToken, error) {
+
+	var token SignInToken
+	key := NewSignInTokenKey(ctx, company, nonce)
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		if err := nds.Get(ctx, key, &token); err != nil {
+			return err
+		}
+
+		return nds.Delete(ctx, key)
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if time.Now().Sub(token.CreatedAt) >= signInTokenTTL {
+		return nil, ErrSignInTokenExpired
+	}
+
+	return &token, nil
+}
@@ -0,0 +1,151 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"teamzones/utils"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	totpIssuer        = "Teamzones"
+	recoveryCodeCount = 10
+)
+
+var (
+	// ErrInvalidSecondFactor is returned when a TOTP or recovery
+	// code is incorrect or has already been used.
+	ErrInvalidSecondFactor = errors.New("Invalid authentication code.")
+	// ErrTOTPNotEnabled is returned when attempting to verify a code
+	// for a User that hasn't enrolled in two-factor authentication.
+	ErrTOTPNotEnabled = errors.New("Two-factor authentication is not enabled.")
+)
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func newRecoveryCode() string {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	code := hex.EncodeToString(b)
+	return fmt.Sprintf("%s-%s", code[:5], code[5:])
+}
+
+// TOTPProvisioningURI returns the otpauth:// URI for the given
+// secret, labeled with the User's e-mail address.
+func (u *User) TOTPProvisioningURI(secret string) string {
+	return utils.TOTPProvisioningURI(totpIssuer, u.Email, secret)
+}
+
+// EnableTOTP enrolls the User in two-factor authentication.  code
+// must be valid for secret, proving that the User's authenticator
+// has been set up correctly.  A fresh set of recovery codes is
+// returned in plain text; only their hashes are stored.
+func (u *User) EnableTOTP(secret, code string) ([]string, error) {
+	step, ok := utils.ValidateTOTP(secret, code, time.Now())
+	if !ok {
+		return nil, ErrInvalidSecondFactor
+	}
+
+	u.TOTPEnabled = true
+	u.TOTPSecret = secret
+	u.TOTPLastStep = step
+	return u.ResetRecoveryCodes(), nil
+}
+
+// DisableTOTP removes the User's second factor and recovery codes.
+func (u *User) DisableTOTP() {
+	u.TOTPEnabled = false
+	u.TOTPSecret = ""
+	u.TOTPLastStep = 0
+	u.RecoveryCodes = nil
+}
+
+// ResetRecoveryCodes replaces the User's recovery codes, returning
+// the new codes in plain text.
+func (u *User) ResetRecoveryCodes() []string {
+	codes := make([]string, recoveryCodeCount)
+	u.RecoveryCodes = make([]string, recoveryCodeCount)
+	for i := range codes {
+		codes[i] = newRecoveryCode()
+		u.RecoveryCodes[i] = hashRecoveryCode(codes[i])
+	}
+
+	return codes
+}
+
+// CheckSecondFactor validates either a TOTP code or a recovery code.
+// Codes can only be used once so the User must be saved afterwards.
+// Use UseSecondFactor instead unless already inside a transaction.
+func (u *User) CheckSecondFactor(code string) error {
+	if !u.TOTPEnabled {
+		return ErrTOTPNotEnabled
+	}
+
+	if step, ok := utils.ValidateTOTP(u.TOTPSecret, code, time.Now()); ok {
+		if step <= u.TOTPLastStep {
+			return ErrInvalidSecondFactor
+		}
+
+		u.TOTPLastStep = step
+		return nil
+	}
+
+	hashed := hashRecoveryCode(code)
+	for i, candidate := range u.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(candidate), []byte(hashed)) == 1 {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrInvalidSecondFactor
+}
+
+// UseSecondFactor transactionally validates a TOTP or recovery code
+// against the stored User and marks it as used so that concurrent
+// requests can't use the same code twice.  If update is not nil, it is
+// applied to the User within the same transaction.  On success, u is
+// replaced by the updated User.
+func (u *User) UseSecondFactor(ctx context.Context, code string, update func(*User)) error {
+	key := u.Key(ctx)
+	var user User
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		user = User{}
+		if err := nds.Get(ctx, key, &user); err != nil {
+			return err
+		}
+
+		if err := user.CheckSecondFactor(code); err != nil {
+			return err
+		}
+
+		if update != nil {
+			update(&user)
+		}
+
+		_, err := nds.Put(ctx, key, &user)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	*u = user
+	return nil
+}
@@ -40,6 +40,9 @@ const (
 	RoleMain = "main"
 	// RoleManager is the role of "admin" users within a Company.
 	RoleManager = "manager"
+	// RoleBilling is the role of members that may manage a
+	// Company's subscription without being its owner.
+	RoleBilling = "billing"
 	// RoleUser is the role of standard Company members.
 	RoleUser = "user"
 )
@@ -62,6 +65,26 @@ type Workdays struct {
 	Sunday    Workday `json:"sunday"`
 }
 
+// On returns the Workday for the given day of the week.
+func (w *Workdays) On(day time.Weekday) Workday {
+	switch day {
+	case time.Monday:
+		return w.Monday
+	case time.Tuesday:
+		return w.Tuesday
+	case time.Wednesday:
+		return w.Wednesday
+	case time.Thursday:
+		return w.Thursday
+	case time.Friday:
+		return w.Friday
+	case time.Saturday:
+		return w.Saturday
+	default:
+		return w.Sunday
+	}
+}
+
 // User represents an account belonging to a Company.  Every User has
 // a Company as an ancestor in its Key.
 type User struct {
@@ -70,9 +93,14 @@ type User struct {
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
 	Email     string `json:"email"`
-	Password  string `json:"-"`
 	Role      string `json:"role"`
 
+	// Account is the global identity that the User signs in with.
+	// Users that aren't linked to one yet, such as unverified ones,
+	// sign in using their own Password instead.
+	Account  *datastore.Key `json:"-"`
+	Password string         `json:"-"`
+
 	Timezone string   `json:"timezone"`
 	Workdays Workdays `json:"workdays"`
 
@@ -80,9 +108,47 @@ type User struct {
 	AvatarSm   string            `json:"smallAvatar"`
 	AvatarFile appengine.BlobKey `json:"-"`
 
+	// Optional profile details.
+	JobTitle   string `json:"jobTitle" datastore:",noindex"`
+	Department string `json:"department" datastore:",noindex"`
+	Phone      string `json:"phone" datastore:",noindex"`
+	City       string `json:"city" datastore:",noindex"`
+	Pronouns   string `json:"pronouns" datastore:",noindex"`
+	Bio        string `json:"bio" datastore:",noindex"`
+
+	// CustomFields are the User's values for their Company's
+	// ProfileFields.
+	CustomFields []CustomFieldValue `json:"customFields" datastore:",noindex"`
+
 	GCalendarToken *datastore.Key `json:"-"`
 	GCalendarData  *datastore.Key `json:"-"`
 
+	// Two-factor authentication
+	TOTPEnabled   bool     `json:"totpEnabled"`
+	TOTPSecret    string   `json:"-" datastore:",noindex"`
+	TOTPLastStep  int64    `json:"-" datastore:",noindex"` // prevents codes from being reused
+	RecoveryCodes []string `json:"-" datastore:",noindex"` // SHA-256 hashes
+
+	// LockedUntil is set when the account is locked out after too
+	// many failed sign in attempts.
+	LockedUntil time.Time `json:"-" datastore:",noindex"`
+
+	// PasswordResetRequired is set when the Company's owner forces
+	// the User to choose a new password before they can sign in.
+	PasswordResetRequired bool `json:"-" datastore:",noindex"`
+
+	// Unverified is set until the User confirms that they own their
+	// e-mail address.  Users created before verification existed are
+	// treated as verified.
+	Unverified bool `json:"unverified" datastore:",noindex"`
+
+	// Deactivated Users can't sign in, don't take up a seat and are
+	// hidden from the team.  They are kept around so that they can
+	// be reactivated until they are deleted for good.
+	Deactivated   bool      `json:"deactivated"`
+	DeactivatedAt time.Time `json:"deactivatedAt" datastore:",noindex"`
+	DeactivatedBy string    `json:"-" datastore:",noindex"`
+
 	Times
 }
 
@@ -124,10 +190,12 @@ func (u *User) Key(ctx context.Context) *datastore.Key {
 }
 
 // CreateMainUser transactionally creates the initial Company and User
-// pair for a company.
+// pair for a company.  Unverified Users are stored as such from the
+// start so that they can't act before confirming their address.
 func CreateMainUser(
 	ctx context.Context, company *Company,
 	firstName, lastName, email, password, timezone string,
+	unverified bool,
 ) (*User, error) {
 
 	companyKey := NewCompanyKey(ctx, company.Subdomain)
@@ -144,6 +212,8 @@ func CreateMainUser(
 	user.SetPassword(password)
 	user.Timezone = timezone
 	user.Role = RoleMain
+	user.Unverified = unverified
+	hashed := user.Password
 
 	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
 		_, err := nds.Put(ctx, companyKey, company)
@@ -151,9 +221,16 @@ func CreateMainUser(
 			return err
 		}
 
-		_, err = nds.Put(ctx, userKey, user)
-		return err
-	}, nil)
+		if err := linkNewUser(ctx, user, hashed, password); err != nil {
+			return err
+		}
+
+		if _, err = nds.Put(ctx, userKey, user); err != nil {
+			return err
+		}
+
+		return indexEmail(ctx, companyKey, email)
+	}, xgTransaction)
 
 	return user, err
 }
@@ -165,40 +242,153 @@ func CreateUser(
 	firstName, lastName, email, password, timezone string,
 ) (*User, error) {
 
+	return createUser(ctx, companyKey, firstName, lastName, email, password, timezone, false, nil)
+}
+
+// createUser creates a team member.  If it's not nil, before is called
+// within the same transaction right before the User is stored and any
+// error it returns aborts the transaction.
+func createUser(
+	ctx context.Context,
+	companyKey *datastore.Key,
+	firstName, lastName, email, password, timezone string,
+	unverified bool,
+	before func(context.Context) error,
+) (*User, error) {
+
 	user := NewUser()
 	userKey := NewUserKey(ctx, companyKey, email)
-	if err := nds.Get(ctx, userKey, &user); err != datastore.ErrNoSuchEntity {
-		return nil, ErrUserExists
-	}
-
 	user.Company = companyKey
 	user.FirstName = firstName
 	user.LastName = lastName
 	user.Email = email
 	user.SetPassword(password)
 	user.Timezone = timezone
-	if _, err := nds.Put(ctx, userKey, user); err != nil {
+	user.Unverified = unverified
+	hashed := user.Password
+
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		var existing User
+		if err := nds.Get(ctx, userKey, &existing); err != datastore.ErrNoSuchEntity {
+			return ErrUserExists
+		}
+
+		if before != nil {
+			if err := before(ctx); err != nil {
+				return err
+			}
+		}
+
+		if err := linkNewUser(ctx, user, hashed, password); err != nil {
+			return err
+		}
+
+		if _, err := nds.Put(ctx, userKey, user); err != nil {
+			return err
+		}
+
+		return indexEmail(ctx, companyKey, email)
+	}, xgTransaction)
+	if err != nil {
 		return nil, err
 	}
 
 	return user, nil
 }
 
-// SetPassword updates the User's password by hashing the given string.
+// linkNewUser links a verified User that is about to be created to the
+// Account for their address.  Joining with an address whose Account
+// has a different password fails with ErrAccountExists.  hashed is the
+// User's own password, which is restored in case the transaction is
+// retried after a previous attempt linked them.
+func linkNewUser(ctx context.Context, user *User, hashed, password string) error {
+	user.Account = nil
+	user.Password = hashed
+	if user.Unverified {
+		return nil
+	}
+
+	linked, err := linkAccount(ctx, user, password)
+	if err != nil {
+		return err
+	} else if !linked {
+		return ErrAccountExists
+	}
+
+	return nil
+}
+
+// ProvisionUser returns the team member with the given e-mail address,
+// creating them without a password if they don't exist yet.  This is
+// used to create accounts just-in-time for users that authenticate
+// via an external identity provider.  The boolean return value is
+// true when a new User was created.
+func ProvisionUser(
+	ctx context.Context,
+	companyKey *datastore.Key,
+	firstName, lastName, email, timezone string,
+) (*User, bool, error) {
+
+	var user *User
+	created := false
+	userKey := NewUserKey(ctx, companyKey, email)
+	err := nds.RunInTransaction(ctx, func(ctx context.Context) error {
+		user = NewUser()
+		created = false
+
+		err := nds.Get(ctx, userKey, user)
+		if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		user.Company = companyKey
+		user.FirstName = firstName
+		user.LastName = lastName
+		user.Email = email
+		user.Timezone = timezone
+		created = true
+
+		if _, err = nds.Put(ctx, userKey, user); err != nil {
+			return err
+		}
+
+		return indexEmail(ctx, companyKey, email)
+	}, xgTransaction)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return user, created, nil
+}
+
+func hashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
+	return string(hashed), err
+}
+
+func checkPassword(hashed, password string) error {
+	return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password))
+}
+
+// SetPassword updates the User's own password by hashing the given
+// string.  Users that are linked to an Account use its password.
 func (u *User) SetPassword(password string) error {
-	hashed, error := bcrypt.GenerateFromPassword([]byte(password), passwordCost)
-	u.Password = string(hashed)
-	return error
+	hashed, err := hashPassword(password)
+	u.Password = hashed
+	return err
 }
 
-// CheckPassword compares the User's hashed password against a given
-// password.  If nil is returned, the passwords are the same.
+// CheckPassword compares the User's own hashed password against a
+// given password.  If nil is returned, the passwords are the same.
 func (u *User) CheckPassword(password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
+	return checkPassword(u.Password, password)
 }
 
 // Authenticate attempts to read a user from the datastore by e-mail
 // and, if successful, validates that the given password is correct.
+// Users that are linked to an Account are checked against its
+// password.  Verified Users that aren't are linked to it once their
+// own password checks out.
 func Authenticate(
 	ctx context.Context,
 	company *datastore.Key,
@@ -214,11 +404,34 @@ func Authenticate(
 		return nil, err
 	}
 
+	if user.Deactivated {
+		return nil, ErrInvalidCredentials
+	}
+
+	if user.Account != nil {
+		var account Account
+		if err := nds.Get(ctx, user.Account, &account); err == datastore.ErrNoSuchEntity {
+			return nil, ErrInvalidCredentials
+		} else if err != nil {
+			return nil, err
+		}
+
+		if err := account.CheckPassword(password); err != nil {
+			return nil, ErrInvalidCredentials
+		}
+
+		return user, nil
+	}
+
 	if err := user.CheckPassword(password); err != nil {
 		return nil, ErrInvalidCredentials
 	}
 
-	return user, nil
+	if user.Unverified {
+		return user, nil
+	}
+
+	return LinkAccount(ctx, user.Key(ctx), password)
 }
 
 // FindUsers returns a query that will retrieve all the users
@@ -256,6 +469,11 @@ func (u *User) Put(ctx context.Context) (*datastore.Key, error) {
 	return nds.Put(ctx, u.Key(ctx), u)
 }
 
+// Locked returns true if the User is currently locked out.
+func (u *User) Locked() bool {
+	return time.Now().Before(u.LockedUntil)
+}
+
 // FullName returns the User's full name.
 func (u *User) FullName() string {
 	return u.FirstName + " " + u.LastName
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"crypto/sha256"
+	"teamzones/integrations"
+	"time"
+
+	"github.com/qedus/nds"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+)
+
+const (
+	webAuthnCredentialKind = "WebAuthnCredential"
+)
+
+// WebAuthnCredential represents a security key or passkey that a User
+// has registered.  Every WebAuthnCredential has a User as its parent
+// and the base64url-encoded credential id as its key name.
+type WebAuthnCredential struct {
+	Company *datastore.Key `json:"-"`
+	User    *datastore.Key `json:"-"`
+
+	CredentialID string    `json:"id"`
+	Name         string    `json:"name"`
+	PublicKey    []byte    `json:"-" datastore:",noindex"`
+	SignCount    int64     `json:"-" datastore:",noindex"`
+	LastUsedAt   time.Time `json:"lastUsedAt"`
+
+	Times
+}
+
+// NewWebAuthnCredentialKey creates fully-qualified datastore keys for
+// WebAuthnCredentials.
+func NewWebAuthnCredentialKey(ctx context.Context, user *datastore.Key, id string) *datastore.Key {
+	return datastore.NewKey(ctx, webAuthnCredentialKind, id, 0, user)
+}
+
+// WebAuthnUserHandle returns the opaque user handle that is stored on
+// the User's authenticators.  It's derived from the User's key so that
+// it doesn't leak their e-mail address.
+func (u *User) WebAuthnUserHandle(ctx context.Context) []byte {
+	sum := sha256.Sum256([]byte(u.Key(ctx).Encode()))
+	return sum[:]
+}
+
+// CreateWebAuthnCredential stores a newly-registered credential for
+// the given User.
+func CreateWebAuthnCredential(
+	ctx context.Context, user *User,
+	name string, credential *integrations.WebAuthnCredential,
+) (*WebAuthnCredential, error) {
+
+	c := WebAuthnCredential{
+		Company:      user.Company,
+		User:         user.Key(ctx),
+		CredentialID: integrations.EncodeWebAuthnID(credential.ID),
+		Name:         name,
+		PublicKey:    credential.PublicKey,
+		SignCount:    int64(credential.SignCount),
+	}
+	c.initTimes()
+	if _, err := c.Put(ctx); err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// FindWebAuthnCredentials returns a query that will retrieve all the
+// credentials belonging to the given User.
+func FindWebAuthnCredentials(user *datastore.Key) *datastore.Query {
+	return datastore.NewQuery(webAuthnCredentialKind).Ancestor(user)
+}
+
+// GetWebAuthnCredential looks up a credential by its id within a
+// Company.  This is used during passwordless sign in when the User
+// isn't known up front.
+func GetWebAuthnCredential(ctx context.Context, company *datastore.Key, id string) (*WebAuthnCredential, error) {
+	var credentials []*WebAuthnCredential
+	_, err := datastore.NewQuery(webAuthnCredentialKind).
+		Ancestor(company).
+		Filter("CredentialID =", id).
+		Limit(1).
+		GetAll(ctx, &credentials)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(credentials) == 0 {
+		return nil, datastore.ErrNoSuchEntity
+	}
+
+	return credentials[0], nil
+}
+
+// HasWebAuthnCredentials returns true if the User has registered at
+// least one credential.
+func HasWebAuthnCredentials(ctx context.Context, user *datastore.Key) (bool, error) {
+	n, err := FindWebAuthnCredentials(user).KeysOnly().Limit(1).Count(ctx)
+	return n > 0, err
+}
+
+// Credential converts the stored credential into the form that is
+// used to verify assertions.
+func (c *WebAuthnCredential) Credential() (*integrations.WebAuthnCredential, error) {
+	id, err := integrations.DecodeWebAuthnID(c.CredentialID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &integrations.WebAuthnCredential{
+		ID:        id,
+		PublicKey: c.PublicKey,
+		SignCount: uint32(c.SignCount),
+	}, nil
+}
+
+// Key is a helper function for building a WebAuthnCredential's key.
+func (c *WebAuthnCredential) Key(ctx context.Context) *datastore.Key {
+	return NewWebAuthnCredentialKey(ctx, c.User, c.CredentialID)
+}
+
+// Load tells datastore how to deserialize WebAuthnCredentials.
+func (c *WebAuthnCredential) Load(p []datastore.Property) error {
+	return datastore.LoadStruct(c, p)
+}
+
+// Save tells datastore how to serialize WebAuthnCredentials.
+func (c *WebAuthnCredential) Save() ([]datastore.Property, error) {
+	c.updateTimes()
+
+	return datastore.SaveStruct(c)
+}
+
+// Put saves the WebAuthnCredential to Datastore.
+func (c *WebAuthnCredential) Put(ctx context.Context) (*datastore.Key, error) {
+	return nds.Put(ctx, c.Key(ctx), c)
+}
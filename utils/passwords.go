@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/binary"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// commonPasswords is a sorted list of the first 8 bytes of the SHA-1
+// hashes of common passwords.  Truncating the hashes keeps the list
+// compact at the cost of a negligible false positive rate.
+var commonPasswords []uint64
+
+func init() {
+	commonPasswords = loadPasswordHashes("data/common-passwords.txt")
+}
+
+func loadPasswordHashes(filename string) []uint64 {
+	f, err := os.Open(filename)
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	var hashes []uint64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		hash, err := strconv.ParseUint(line, 16, 64)
+		if err != nil {
+			panic(err)
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	if err := scanner.Err(); err != nil {
+		panic(err)
+	}
+
+	return hashes
+}
+
+func passwordHash(password string) uint64 {
+	sum := sha1.Sum([]byte(strings.ToLower(password)))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// IsCommonPassword returns true if password (ignoring case) is on the
+// bundled list of common and breached passwords.
+func IsCommonPassword(password string) bool {
+	hash := passwordHash(password)
+	i := sort.Search(len(commonPasswords), func(i int) bool {
+		return commonPasswords[i] >= hash
+	})
+
+	return i < len(commonPasswords) && commonPasswords[i] == hash
+}
@@ -0,0 +1,39 @@
+package utils
+
+import "testing"
+
+func TestIsCommonPassword(t *testing.T) {
+	t.Parallel()
+
+	for _, password := range []string{"password", "Password", "123456", "qwerty123", "letmein"} {
+		if !IsCommonPassword(password) {
+			t.Errorf("expected %q to be common", password)
+		}
+	}
+
+	for _, password := range []string{"", "correct horse battery staple", "Tz-8f2k-91Lq"} {
+		if IsCommonPassword(password) {
+			t.Errorf("expected %q not to be common", password)
+		}
+	}
+}
+
+func TestIsCommonPasswordRejectsLongBreachedPasswords(t *testing.T) {
+	t.Parallel()
+
+	for _, password := range []string{"baseball", "football", "iloveyou", "trustno1", "superman", "sunshine", "princess"} {
+		if !IsCommonPassword(password) {
+			t.Errorf("expected breached password %q to be common", password)
+		}
+	}
+}
+
+func TestCommonPasswordsAreSorted(t *testing.T) {
+	t.Parallel()
+
+	for i := 1; i < len(commonPasswords); i++ {
+		if commonPasswords[i-1] >= commonPasswords[i] {
+			t.Fatalf("common passwords are not sorted at line %d", i)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrInvalidSignature is returned when a signed value has been
+	// tampered with.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrSignatureExpired is returned when a signed value is past its
+	// expiry time.
+	ErrSignatureExpired = errors.New("signature has expired")
+)
+
+func signature(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignValue returns a URL-safe token containing value and its expiry
+// time, authenticated with key.
+func SignValue(key []byte, value string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value)) +
+		"." + strconv.FormatInt(expires.Unix(), 10)
+
+	return payload + "." + signature(key, payload)
+}
+
+// VerifySignedValue checks a token created by SignValue and returns
+// the value that it contains.
+func VerifySignedValue(key []byte, token string, now time.Time) (string, error) {
+	i := strings.LastIndex(token, ".")
+	if i == -1 {
+		return "", ErrInvalidSignature
+	}
+
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(signature(key, payload))) {
+		return "", ErrInvalidSignature
+	}
+
+	parts := strings.SplitN(payload, ".", 2)
+	if len(parts) != 2 {
+		return "", ErrInvalidSignature
+	}
+
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	if now.Unix() >= expires {
+		return "", ErrSignatureExpired
+	}
+
+	value, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", ErrInvalidSignature
+	}
+
+	return string(value), nil
+}
@@ -0,0 +1,38 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignedValues(t *testing.T) {
+	t.Parallel()
+
+	key := []byte("secret")
+	now := time.Unix(1470000000, 0)
+	token := SignValue(key, "acme|jim@acme.com", now.Add(time.Hour))
+
+	value, err := VerifySignedValue(key, token, now)
+	if err != nil || value != "acme|jim@acme.com" {
+		t.Fatalf("expected token to be valid, got %q, %v", value, err)
+	}
+
+	if _, err := VerifySignedValue(key, token, now.Add(2*time.Hour)); err != ErrSignatureExpired {
+		t.Errorf("expected token to expire, got %v", err)
+	}
+
+	if _, err := VerifySignedValue([]byte("other"), token, now); err != ErrInvalidSignature {
+		t.Errorf("expected token signed with another key to be rejected, got %v", err)
+	}
+
+	forged := SignValue([]byte("other"), "acme|eve@acme.com", now.Add(time.Hour))
+	if _, err := VerifySignedValue(key, forged, now); err != ErrInvalidSignature {
+		t.Errorf("expected forged token to be rejected, got %v", err)
+	}
+
+	for _, malformed := range []string{"", "abc", "a.b", "a.b.c"} {
+		if _, err := VerifySignedValue(key, malformed, now); err == nil {
+			t.Errorf("expected %q to be rejected", malformed)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHOTPMatchesRFC6238(t *testing.T) {
+	key := []byte("12345678901234567890")
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, test := range cases {
+		code := hotp(key, TOTPStep(time.Unix(test.unix, 0)), 8)
+		if code != test.code {
+			t.Errorf("expected %q at %d, got %q", test.code, test.unix, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	code, err := TOTPCode(secret, TOTPStep(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if step, ok := ValidateTOTP(secret, code, now); !ok || step != TOTPStep(now) {
+		t.Errorf("expected current code to be valid")
+	}
+
+	if _, ok := ValidateTOTP(secret, code, now.Add(30*time.Second)); !ok {
+		t.Errorf("expected previous code to be valid")
+	}
+
+	if _, ok := ValidateTOTP(secret, code, now.Add(2*time.Minute)); ok {
+		t.Errorf("expected stale code to be invalid")
+	}
+
+	if _, ok := ValidateTOTP(secret, "12345", now); ok {
+		t.Errorf("expected short code to be invalid")
+	}
+}
+
+func TestTOTPProvisioningURI(t *testing.T) {
+	uri := TOTPProvisioningURI("Teamzones", "jim@acme.com", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/Teamzones%3Ajim%40acme.com?") {
+		t.Errorf("unexpected label in %q", uri)
+	}
+
+	if !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") {
+		t.Errorf("missing secret in %q", uri)
+	}
+}